@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"encoding/gob"
+	"os"
+	"sync"
+	"time"
+)
+
+// autoSaver periodically saves the items of a cache to a file (see
+// WithAutoSave.)
+type autoSaver struct {
+	path     string
+	interval time.Duration
+	// stop is nil if the items are only saved when the cache is closed.
+	stop     chan bool
+	stopOnce sync.Once
+	// done is closed when Run returns
+	done chan bool
+}
+
+func (a *autoSaver) Run(c *cache) {
+	defer close(a.done)
+	ticker := time.NewTicker(a.interval)
+	for {
+		select {
+		case <-ticker.C:
+			// There is nobody to report an error to; the next save or
+			// Close will try again.
+			c.SaveFileAtomic(a.path)
+		case <-a.stop:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func runAutoSaver(c *cache, path string, interval time.Duration) {
+	a := &autoSaver{
+		path:     path,
+		interval: interval,
+	}
+	if interval > 0 {
+		a.stop = make(chan bool)
+		a.done = make(chan bool)
+		go a.Run(c)
+	}
+	c.autoSaver = a
+}
+
+// Stop stops saving the items periodically, waiting for a save in progress to
+// finish, so that it can't overwrite a later one. It is safe to call Stop more
+// than once.
+func (a *autoSaver) Stop() {
+	if a.stop == nil {
+		return
+	}
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+	<-a.done
+}
+
+// stopAutoSaver stops saving the items of the cache periodically, and returns
+// the autoSaver that did, or nil if there was none.
+func (c *cache) stopAutoSaver() *autoSaver {
+	c.janitorMu.Lock()
+	a := c.autoSaver
+	c.autoSaver = nil
+	c.janitorMu.Unlock()
+
+	if a != nil {
+		a.Stop()
+	}
+	return a
+}
+
+// Stop the cache's janitor (see StopJanitor), and if the cache saves its items
+// to a file (see WithAutoSave), stop saving them periodically and save them one
+// last time. Returns an error if the items couldn't be saved. It is safe to
+// call Close (or StopJanitor) more than once; the items are only saved the
+// first time. If the cache is garbage collected without being closed, they are
+// no longer saved, and changes since the last periodic save are lost.
+func (c *cache) Close() error {
+	c.SetCleanupInterval(0)
+	if a := c.stopAutoSaver(); a != nil {
+		return c.SaveFileAtomic(a.path)
+	}
+	return nil
+}
+
+// Return a new cache configured by the given Options, starting with the items
+// saved to the given file (e.g. by SaveFile, or a cache using WithAutoSave with
+// the same path), if it exists. Returns an error if the file exists but can't
+// be read. As with Load, the types of the items must be registered with
+// gob.Register beforehand.
+func NewFromFile(path string, opts ...Option) (*Cache, error) {
+	items := map[string]Item{}
+	fp, err := os.Open(path)
+	if err == nil {
+		err = gob.NewDecoder(fp).Decode(&items)
+		fp.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Copy opts, so that appending to it doesn't overwrite the caller's array.
+	opts = append(opts[:len(opts):len(opts)], WithInitialItems(items))
+	return NewWithOptions(opts...), nil
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewFromFileMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	tc, err := NewFromFile(path)
+	if err != nil {
+		t.Fatal("Error creating a cache from a missing file:", err)
+	}
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("ItemCount is %d, want 0", n)
+	}
+}
+
+func TestNewFromFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	if err := os.WriteFile(path, []byte("not gob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFromFile(path); err == nil {
+		t.Error("No error creating a cache from an invalid file")
+	}
+}
+
+func TestAutoSaveClose(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.gob")
+	tc, err := NewFromFile(path, WithAutoSave(path, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("a", "aa", DefaultExpiration)
+	tc.Set("b", 2, time.Hour)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("file was saved before Close without an interval:", err)
+	}
+	if err := tc.Close(); err != nil {
+		t.Fatal("Error closing cache:", err)
+	}
+	if err := tc.Close(); err != nil {
+		t.Error("Error closing cache twice:", err)
+	}
+
+	tc2, err := NewFromFile(path)
+	if err != nil {
+		t.Fatal("Error loading cache:", err)
+	}
+	if x, found := tc2.Get("a"); !found || x.(string) != "aa" {
+		t.Errorf("a is %v (found: %v) after reloading, want aa", x, found)
+	}
+	if _, exp, found := tc2.GetWithExpiration("b"); !found || exp.IsZero() {
+		t.Errorf("b wasn't reloaded with its expiration time (found: %v)", found)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files were left in the directory, want 1", len(entries))
+	}
+}
+
+func TestAutoSaveInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	tc := NewWithOptions(WithAutoSave(path, 5*time.Millisecond))
+	defer tc.Close()
+	tc.Set("a", 1, DefaultExpiration)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		tc2, err := NewFromFile(path)
+		if err == nil {
+			if _, found := tc2.Get("a"); found {
+				return
+			}
+		}
+		<-time.After(time.Millisecond)
+	}
+	t.Error("items weren't saved periodically")
+}
+
+func TestAutoSaveStopJanitor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	tc := NewWithOptions(WithAutoSave(path, time.Hour), WithCleanupInterval(time.Hour))
+	tc.Set("a", 1, DefaultExpiration)
+	tc.StopJanitor()
+
+	tc2, err := NewFromFile(path)
+	if err != nil {
+		t.Fatal("Error loading cache:", err)
+	}
+	if _, found := tc2.Get("a"); !found {
+		t.Error("a wasn't saved by StopJanitor")
+	}
+
+	// The items were saved for the last time.
+	tc.Set("b", 2, DefaultExpiration)
+	tc.StopJanitor()
+	if err := tc.Close(); err != nil {
+		t.Error("Error closing cache after StopJanitor:", err)
+	}
+	tc3, err := NewFromFile(path)
+	if err != nil {
+		t.Fatal("Error loading cache:", err)
+	}
+	if _, found := tc3.Get("b"); found {
+		t.Error("b was saved after the janitor was stopped")
+	}
+}
+
+func TestNewFromFileOptions(t *testing.T) {
+	opts := make([]Option, 1, 2)
+	opts[0] = WithMaxItems(10)
+	if _, err := NewFromFile(filepath.Join(t.TempDir(), "cache.gob"), opts...); err != nil {
+		t.Fatal(err)
+	}
+	if opts[:2][1] != nil {
+		t.Error("NewFromFile appended to the array of the given options")
+	}
+}
@@ -1,21 +1,48 @@
 package cache
 
 import (
+	"context"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Item struct {
 	Object     interface{} `json:"object"`
 	Expiration int64       `json:"expiration"`
+	// source is an optional provenance tag set by SetWithSource. It is not
+	// serialized.
+	source string
+	// meta is optional metadata set by SetWithMeta. It is not serialized.
+	meta map[string]string
+	// weak is a weak reference to the value of an item set by SetWeak, whose
+	// Object is nil.
+	weak *weakRef
+	// size is the size of Object according to the cache's Sizer, if it has
+	// one.
+	size int64
+	// onEvicted is an optional callback set by SetWithCallback. It is not
+	// serialized.
+	onEvicted func(string, interface{})
+	// version is the version of the cache when the item was last changed
+	// (see Snapshot.)
+	version uint64
 }
 
-// Returns true if the item has expired.
+// Returns true if the item has expired. This uses time.Now(), not the Clock of
+// the cache the item is stored in.
 func (item Item) Expired() bool {
 	if item.Expiration == 0 {
 		return false
@@ -24,6 +51,19 @@ func (item Item) Expired() bool {
 	return time.Now().UnixNano() > item.Expiration
 }
 
+// A Clock tells a cache the current time, e.g. to determine whether its items
+// have expired. The default Clock returns time.Now(); a different one can be
+// set with WithClock, e.g. to control the passage of time in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
 const (
 	// For use with functions that take an expiration time.
 	NoExpiration time.Duration = -1
@@ -44,7 +84,117 @@ type cache struct {
 	items      map[string]Item
 	mutex      sync.RWMutex
 	onEvicted  func(string, interface{})
-	janitor    *janitor
+	// maximum number of items, or 0 if unlimited
+	maxItems int
+	// maximum total size of the items according to sizer, or 0 if
+	// unlimited, and their current total size, guarded by mutex
+	maxBytes int64
+	sizer    Sizer
+	size     int64
+	// whether expired items are removed before live ones are evicted when
+	// the cache is full
+	reclaimExpired bool
+	// whether onEvicted is called with the old value when an item is
+	// overwritten
+	evictOnOverwrite bool
+	// the maximum fraction of the duration by which the expiration times of
+	// items are randomly offset, and the source of the offsets
+	jitter float64
+	rand   *rand.Rand
+	randMu sync.Mutex
+	// the maximum number of expired items deleted while holding mutex by
+	// DeleteExpired, or 0 if unlimited
+	sweepBatchSize int
+	// when DeleteExpired last ran in nanoseconds, accessed atomically
+	lastCleanup int64
+	// the bounds of the expiration durations of items, or 0 if unbounded
+	minTTL time.Duration
+	maxTTL time.Duration
+	// copies the values returned by Get, if set
+	copier func(interface{}) interface{}
+	// incremented whenever an item is changed, guarded by mutex
+	version uint64
+	// chooses the items to evict when the cache is full, if set (see
+	// WithEvictionPolicy); otherwise they are chosen at random
+	policy EvictionPolicy
+	// keys of the items that expire, soonest first
+	expirations expirationHeap
+	// number of successful Gets of each key: map[string]*uint64, or nil if
+	// accesses aren't tracked (see WithAccessTracking)
+	accesses *sync.Map
+	// goroutines blocked in WaitGet, by key, guarded by mutex
+	waiters map[string]*waiter
+	// items evicted (or expired items deleted) to make room for new ones
+	// while mutex was held, whose callbacks are deferred until unlock
+	evictedItems []keyAndValue
+	expiredItems []keyAndValue
+	onExpired    func(string, interface{})
+	onSweep      func(int, time.Duration)
+	onFlush      func(map[string]interface{})
+	// itemCallbacks is set once any item was stored with SetWithCallback, so
+	// that deleted items are looked up for their callbacks.
+	itemCallbacks bool
+	// evictionPool is non-nil if onEvicted is dispatched asynchronously.
+	evictionPool     *evictionPool
+	droppedEvictions uint64
+	// counters reported by Stats, updated atomically
+	hitCount        uint64
+	missCount       uint64
+	evictionCount   uint64
+	expirationCount uint64
+	janitor         *janitor
+	// saves the items to a file, if WithAutoSave is used
+	autoSaver *autoSaver
+	// guards janitor, which SetCleanupInterval replaces, and autoSaver
+	janitorMu sync.Mutex
+	// cleanup interval the janitor is started with
+	cleanupInterval time.Duration
+	// file and interval the autoSaver is started with
+	autoSavePath     string
+	autoSaveInterval time.Duration
+	clock            Clock
+	// in-flight GetOrCompute calls, guarded by callsMu. callsMu may be held
+	// while acquiring mutex, but not the other way around.
+	calls   map[string]*call
+	callsMu sync.Mutex
+	// channels of the subscribers to events (see Subscribe), guarded by
+	// mutex
+	subscribers   []chan Event
+	droppedEvents uint64
+	// loads missing items in GetOrLoad, if set. It returns ErrNotLoaded if
+	// an item doesn't exist.
+	loader func(string) (interface{}, time.Duration, error)
+	// how long GetOrLoad remembers that the loader didn't find an item, and
+	// the expiration times of those keys, guarded by mutex. They are kept
+	// apart from the items so that they aren't visible to other methods.
+	negativeTTL time.Duration
+	negatives   map[string]int64
+	// the number of negatives at which setMissing deletes the expired ones
+	negativesPruneAt int
+	// how long after a GetOrCompute computation starts callers are served
+	// the previous value rather than waiting for it
+	coalescingWindow time.Duration
+	// how long before an item expires Get starts reloading it
+	refreshAhead time.Duration
+	// limits the number of concurrent calls of the loader, if set
+	loadSem chan struct{}
+	// the loader circuit breaker (see WithLoaderCircuitBreaker): the number of
+	// consecutive failures that open it, for how long, the current number of
+	// consecutive failures and the time it's open until in nanoseconds (0 if
+	// it's closed.) The last two are accessed atomically.
+	breakerThreshold int32
+	breakerCooldown  time.Duration
+	loaderFailures   int32
+	loaderOpenUntil  int64
+}
+
+// call is an in-flight GetOrCompute computation. done is closed once value and
+// err have been set.
+type call struct {
+	done    chan struct{}
+	started time.Time
+	value   interface{}
+	err     error
 }
 
 // Add an item to the cache, replacing any existing item. If the duration is 0
@@ -56,16 +206,48 @@ func (c *cache) Set(key string, value interface{}, duration time.Duration) {
 	if duration == DefaultExpiration {
 		duration = c.expiration
 	}
+	if duration > 0 && c.jitter > 0 {
+		duration = c.jittered(duration)
+	}
+	if c.minTTL > 0 || c.maxTTL > 0 {
+		duration = c.clampTTL(duration)
+	}
 	if duration > 0 {
-		expiration = time.Now().Add(duration).UnixNano()
+		expiration = c.clock.Now().Add(duration).UnixNano()
+	}
+	var size int64
+	if c.sizer != nil {
+		size = c.sizer(value)
 	}
 
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	defer c.unlock()
 
+	if c.maxItems > 0 || c.maxBytes > 0 {
+		c.makeRoom(key, size)
+	}
+	if c.evictOnOverwrite {
+		c.overwritten(key)
+	}
+	if c.sizer != nil {
+		c.size += size - c.items[key].size
+	}
 	c.items[key] = Item{
 		Object:     value,
 		Expiration: expiration,
+		size:       size,
+		version:    c.stamp(),
+	}
+	c.expirations.update(key, expiration)
+	c.publish(EventSet, key, value)
+	if c.policy != nil {
+		c.policy.OnAdd(key)
+	}
+	if c.waiters != nil {
+		c.wake(key)
+	}
+	if c.negatives != nil {
+		delete(c.negatives, key)
 	}
 }
 
@@ -74,254 +256,1457 @@ func (c *cache) set(key string, value interface{}, duration time.Duration) {
 	if duration == DefaultExpiration {
 		duration = c.expiration
 	}
+	if duration > 0 && c.jitter > 0 {
+		duration = c.jittered(duration)
+	}
+	if c.minTTL > 0 || c.maxTTL > 0 {
+		duration = c.clampTTL(duration)
+	}
 	if duration > 0 {
-		expiration = time.Now().Add(duration).UnixNano()
+		expiration = c.clock.Now().Add(duration).UnixNano()
+	}
+	var size int64
+	if c.sizer != nil {
+		size = c.sizer(value)
 	}
 
+	if c.maxItems > 0 || c.maxBytes > 0 {
+		c.makeRoom(key, size)
+	}
+	if c.evictOnOverwrite {
+		c.overwritten(key)
+	}
+	if c.sizer != nil {
+		c.size += size - c.items[key].size
+	}
 	c.items[key] = Item{
 		Object:     value,
 		Expiration: expiration,
+		size:       size,
+		version:    c.stamp(),
+	}
+	c.expirations.update(key, expiration)
+	c.publish(EventSet, key, value)
+	if c.policy != nil {
+		c.policy.OnAdd(key)
+	}
+	if c.waiters != nil {
+		c.wake(key)
+	}
+	if c.negatives != nil {
+		delete(c.negatives, key)
 	}
 }
 
-// Add an item to the cache, replacing any existing item, using the default
-// expiration.
-func (c *cache) SetDefault(key string, value interface{}) {
-	c.Set(key, value, DefaultExpiration)
+// overwritten defers the OnEvicted function (and the item's own callback) for
+// the item stored under key, if there is one, as it is about to be replaced. It
+// must be called while holding mutex.
+func (c *cache) overwritten(key string) {
+	old, found := c.items[key]
+	if found && (c.onEvicted != nil || old.onEvicted != nil) {
+		c.evictedItems = append(c.evictedItems, keyAndValue{key, old.Object, old.onEvicted, c.callbacks()})
+	}
 }
 
-// Add an item to the cache only if an item doesn't already exist for the given
-// key, or if the existing item has expired. Returns an error otherwise.
-func (c *cache) Add(key string, value interface{}, duration time.Duration) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
-	_, found := c.get(key)
-	if found {
-		return fmt.Errorf("item %s already exists", key)
+// expired returns true if the item has expired according to the cache's Clock.
+func (c *cache) expired(item Item) bool {
+	if item.Expiration == 0 {
+		return false
 	}
 
-	c.set(key, value, duration)
+	return c.clock.Now().UnixNano() > item.Expiration
+}
 
-	return nil
+// expirationFor returns the Expiration of an item stored now with the given
+// duration, following the same rules as Set.
+func (c *cache) expirationFor(duration time.Duration) int64 {
+	if duration == DefaultExpiration {
+		duration = c.expiration
+	}
+	if duration > 0 && c.jitter > 0 {
+		duration = c.jittered(duration)
+	}
+	if c.minTTL > 0 || c.maxTTL > 0 {
+		duration = c.clampTTL(duration)
+	}
+	if duration > 0 {
+		return c.clock.Now().Add(duration).UnixNano()
+	}
+	return 0
 }
 
-// Set a new value for the cache key only if it already exists, and the existing
-// item hasn't expired. Returns an error otherwise.
-func (c *cache) Replace(key string, value interface{}, duration time.Duration) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// clampTTL returns the expiration duration d raised to the minimum or lowered
+// to the maximum set by WithMinTTL and WithMaxTTL. If d is not positive (i.e.
+// the item doesn't expire), it is set to the maximum, if there is one.
+func (c *cache) clampTTL(d time.Duration) time.Duration {
+	if d <= 0 {
+		if c.maxTTL > 0 {
+			return c.maxTTL
+		}
+		return d
+	}
+	if d < c.minTTL {
+		return c.minTTL
+	}
+	if c.maxTTL > 0 && d > c.maxTTL {
+		return c.maxTTL
+	}
+	return d
+}
 
-	_, found := c.get(key)
-	if !found {
-		return fmt.Errorf("item %s doesn't exist", key)
+// jittered returns d offset by a random amount of up to ±jitter of d (see
+// WithExpirationJitter), but at least 1, as an item with an expiration
+// duration of 0 or less would never expire.
+func (c *cache) jittered(d time.Duration) time.Duration {
+	c.randMu.Lock()
+	f := c.rand.Float64()
+	c.randMu.Unlock()
+
+	d += time.Duration((2*f - 1) * c.jitter * float64(d))
+	if d < 1 {
+		d = 1
 	}
+	return d
+}
 
-	c.set(key, value, duration)
+// Add an item to the cache, replacing any existing item, and tag it with the
+// given source (e.g. "db", "computed" or "seed") for debugging purposes. The
+// source can be retrieved with GetSource, and is not serialized by Save or
+// included in any encoding of the Item. Duration rules are the same as for Set.
+func (c *cache) SetWithSource(key string, value interface{}, duration time.Duration, source string) {
+	c.mutex.Lock()
+	defer c.unlock()
 
-	return nil
+	c.set(key, value, duration)
+	item := c.items[key]
+	item.source = source
+	c.items[key] = item
 }
 
-// Get an item from the cache. Returns the item or nil, and a bool indicating
-// whether the key was found.
-func (c *cache) Get(key string) (interface{}, bool) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+// Add an item to the cache, replacing any existing item, with the given
+// metadata (e.g. a version or the origin of the value), which can be retrieved
+// with GetWithMeta. The map is copied, so later changes to it don't affect the
+// item. Like the source set by SetWithSource, the metadata is not serialized by
+// Save. Duration rules are the same as for Set.
+func (c *cache) SetWithMeta(key string, value interface{}, meta map[string]string, d time.Duration) {
+	c.mutex.Lock()
+	defer c.unlock()
 
-	// "Inlining" of get and Expired
-	item, found := c.items[key]
-	if !found {
-		return nil, false
+	c.set(key, value, d)
+	if meta == nil {
+		return
 	}
-	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
-			return nil, false
-		}
+	item := c.items[key]
+	item.meta = make(map[string]string, len(meta))
+	for k, v := range meta {
+		item.meta[k] = v
 	}
+	c.items[key] = item
+}
 
-	return item.Object, true
+// Add an item to the cache, replacing any existing item, with a callback that
+// is called with the key and value when that item is deleted, expires or is
+// evicted, before the OnEvicted or OnExpired function (if one is set.) Like
+// those, it is not called when the item is overwritten. Duration rules are the
+// same as for Set.
+func (c *cache) SetWithCallback(key string, value interface{}, d time.Duration, onEvict func(key string, value interface{})) {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	c.set(key, value, d)
+	if onEvict == nil {
+		return
+	}
+	item := c.items[key]
+	item.onEvicted = onEvict
+	c.items[key] = item
+	c.itemCallbacks = true
 }
 
-// GetWithExpiration returns an item and its expiration time from the cache.
-// It returns the item or nil, the expiration time if one is set (if the item
-// never expires a zero value for time.Time is returned), and a bool indicating
-// whether the key was found.
-func (c *cache) GetWithExpiration(key string) (interface{}, time.Time, bool) {
+// Get the source tag of an item set with SetWithSource. Returns the tag (or an
+// empty string if the item was set without one), and a bool indicating whether
+// the key was found.
+func (c *cache) GetSource(key string) (string, bool) {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
-	// "Inlining" of get and Expired
 	item, found := c.items[key]
-	if !found {
-		return nil, time.Time{}, false
-	}
-	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
-			return nil, time.Time{}, false
-		}
-		// Return the item and the expiration time
-		return item.Object, time.Unix(0, item.Expiration), true
+	if !found || c.expired(item) {
+		return "", false
 	}
 
-	// If expiration <= 0 (i.e. no expiration time set) then return the item
-	// and a zeroed time.Time
-	return item.Object, time.Time{}, true
+	return item.source, true
 }
 
-func (c *cache) get(key string) (interface{}, bool) {
-	item, found := c.items[key]
-	if !found {
-		return nil, false
+// Add several items to the cache, replacing any existing items, with the same
+// expiration duration, which follows the same rules as for Set. This only locks
+// the cache once, so it is faster than calling Set for each item.
+func (c *cache) SetMany(items map[string]interface{}, duration time.Duration) {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	for key, value := range items {
+		c.set(key, value, duration)
 	}
-	// "Inlining" of Expired
-	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
-			return nil, false
+}
+
+// Add several items to the cache, replacing any existing items, with the
+// expiration times in their Expiration fields, as returned by Items. Unlike the
+// durations passed to Set, these are never interpreted: an item with an
+// Expiration in the past has already expired, and one with an Expiration of 0
+// (or less) never expires. This only locks the cache once.
+func (c *cache) SetManyWithExpiration(items map[string]Item) {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	for key, item := range items {
+		expiration := item.Expiration
+		if expiration < 0 {
+			expiration = 0
 		}
+		c.insert(key, Item{
+			Object:     item.Object,
+			Expiration: expiration,
+		})
 	}
-	return item.Object, true
 }
 
-// Increment an item of type int, int8, int16, int32, int64, uintptr, uint,
-// uint8, uint32, or uint64, float32 or float64 by n. Returns an error if the
-// item's value is not an integer, if it was not found, or if it is not
-// possible to increment it by n. To retrieve the incremented value, use one
-// of the specialized methods, e.g. IncrementInt64.
-func (c *cache) Increment(key string, n int64) error {
+// Add an item to the cache for each exported field of the struct v (or the
+// struct v points to), replacing any existing items, under the key prefix
+// followed by the name of the field, e.g. to seed feature flags from a config
+// struct. Unexported fields are skipped. Duration rules are the same as for
+// Set. Returns an error, without storing anything, if v isn't a struct or a
+// non-nil pointer to one.
+func (c *cache) SetStruct(prefix string, v interface{}, d time.Duration) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("value of type %T is not a struct or a pointer to one", v)
+	}
+
 	c.mutex.Lock()
-	c.mutex.RUnlock()
+	defer c.unlock()
 
-	value, found := c.items[key]
-	if !found || value.Expired() {
-		c.mutex.Unlock()
-		return fmt.Errorf("item %s not found", key)
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.IsExported() {
+			c.set(prefix+f.Name, rv.Field(i).Interface(), d)
+		}
 	}
 
-	switch value.Object.(type) {
-	case int:
-		value.Object = value.Object.(int) + int(n)
-	case int8:
-		value.Object = value.Object.(int8) + int8(n)
-	case int16:
-		value.Object = value.Object.(int16) + int16(n)
-	case int32:
-		value.Object = value.Object.(int32) + int32(n)
-	case int64:
-		value.Object = value.Object.(int64) + n
-	case uint:
-		value.Object = value.Object.(uint) + uint(n)
-	case uintptr:
-		value.Object = value.Object.(uintptr) + uintptr(n)
-	case uint8:
-		value.Object = value.Object.(uint8) + uint8(n)
-	case uint16:
-		value.Object = value.Object.(uint16) + uint16(n)
-	case uint32:
-		value.Object = value.Object.(uint32) + uint32(n)
-	case uint64:
-		value.Object = value.Object.(uint64) + uint64(n)
-	case float32:
-		value.Object = value.Object.(float32) + float32(n)
-	case float64:
-		value.Object = value.Object.(float64) + float64(n)
-	default:
-		return fmt.Errorf("the value for %s is not an integer", key)
+	return nil
+}
+
+// Add an item to the cache, replacing any existing item, using the default
+// expiration.
+func (c *cache) SetDefault(key string, value interface{}) {
+	c.Set(key, value, DefaultExpiration)
+}
+
+// Add an item to the cache, replacing any existing item, that expires at the
+// given time. Unlike the durations passed to Set, this is never interpreted: if
+// at is in the past, the item has already expired, and if it is the zero time,
+// the item never expires.
+func (c *cache) SetWithAbsoluteExpiration(key string, value interface{}, at time.Time) {
+	var expiration int64
+	if !at.IsZero() {
+		expiration = at.UnixNano()
 	}
-	c.items[key] = value
 
-	return nil
+	c.mutex.Lock()
+	defer c.unlock()
+
+	c.insert(key, Item{
+		Object:     value,
+		Expiration: expiration,
+	})
 }
 
-// Increment an item of type float32 or float64 by n. Returns an error if the
-// item's value is not floating point, if it was not found, or if it is not
-// possible to increment it by n. Pass a negative number to decrement the
-// value. To retrieve the incremented value, use one of the specialized methods,
-// e.g. IncrementFloat64.
-func (c *cache) IncrementFloat(key string, n float64) error {
+// Add an item to the cache only if an item doesn't already exist for the given
+// key, or if the existing item has expired. Returns an error otherwise.
+func (c *cache) Add(key string, value interface{}, duration time.Duration) error {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	defer c.unlock()
 
-	value, found := c.items[key]
-	if !found || value.Expired() {
-		return fmt.Errorf("item %s not found", key)
-	}
-	switch value.Object.(type) {
-	case float32:
-		value.Object = value.Object.(float32) + float32(n)
-	case float64:
-		value.Object = value.Object.(float64) + n
-	default:
-		return fmt.Errorf("the value for %s does not have type float32 or float64", key)
+	_, found := c.get(key)
+	if found {
+		return fmt.Errorf("item %s already exists", key)
 	}
-	c.items[key] = value
+
+	c.set(key, value, duration)
 
 	return nil
 }
 
-// Increment an item of type int by n. Returns an error if the item's value is
-// not an int, or if it was not found. If there is no error, the incremented
-// value is returned.
-func (c *cache) IncrementInt(key string, n int) (int, error) {
+// Add an item to the cache only if an item doesn't already exist for the given
+// key, or if the existing item has expired, like Add. Returns true if the item
+// was stored, or false (leaving the existing item unchanged) otherwise.
+func (c *cache) SetNX(key string, value interface{}, duration time.Duration) bool {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	defer c.unlock()
 
-	value, found := c.items[key]
-	if !found || value.Expired() {
-		return 0, fmt.Errorf("item %s not found", key)
-	}
-	rv, ok := value.Object.(int)
-	if !ok {
-		return 0, fmt.Errorf("the value for %s is not an int", key)
+	_, found := c.get(key)
+	if found {
+		return false
 	}
-	nv := rv + n
-	value.Object = nv
-	c.items[key] = value
 
-	return nv, nil
+	c.set(key, value, duration)
+
+	return true
 }
 
-// Increment an item of type int8 by n. Returns an error if the item's value is
-// not an int8, or if it was not found. If there is no error, the incremented
-// value is returned.
-func (c *cache) IncrementInt8(key string, n int8) (int8, error) {
+// Replace an item in the cache only if it expires within the duration window,
+// e.g. to refresh a heartbeat only near the end of its lifetime, or add it if
+// it doesn't exist (or has expired.) Returns true if the item was stored, or
+// false (leaving the existing item unchanged) otherwise. Items that never
+// expire are never replaced. Duration rules for d are the same as for Set.
+func (c *cache) SetIfExpiringWithin(key string, value interface{}, window, d time.Duration) bool {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	defer c.unlock()
 
-	value, found := c.items[key]
-	if !found || value.Expired() {
-		return 0, fmt.Errorf("item %s not found", key)
-	}
-	rv, ok := value.Object.(int8)
-	if !ok {
-		return 0, fmt.Errorf("the value for %s is not an int8", key)
+	item, found := c.items[key]
+	if found && !c.expired(item) {
+		if item.Expiration <= 0 || item.Expiration-c.clock.Now().UnixNano() > int64(window) {
+			return false
+		}
 	}
-	nv := rv + n
-	value.Object = nv
-	c.items[key] = value
 
-	return nv, nil
+	c.set(key, value, d)
+
+	return true
 }
 
-// Increment an item of type int16 by n. Returns an error if the item's value is
-// not an int16, or if it was not found. If there is no error, the incremented
-// value is returned.
-func (c *cache) IncrementInt16(key string, n int16) (int16, error) {
+// Get an item from the cache, or add it if it doesn't exist (or has expired.)
+// Returns the existing item and true if it was already present, or the given
+// value and false if it was stored. The check and the store happen atomically,
+// so concurrent callers will all observe the same value.
+func (c *cache) GetOrSet(key string, value interface{}, duration time.Duration) (interface{}, bool) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	defer c.unlock()
 
-	value, found := c.items[key]
-	if !found || value.Expired() {
-		return 0, fmt.Errorf("item %s not found", key)
-	}
-	rv, ok := value.Object.(int16)
-	if !ok {
-		return 0, fmt.Errorf("the value for %s is not an int16", key)
+	if v, found := c.get(key); found {
+		if c.policy != nil {
+			c.policy.OnAccess(key)
+		}
+		return v, true
 	}
-	nv := rv + n
-	value.Object = nv
-	c.items[key] = value
+	c.set(key, value, duration)
 
-	return nv, nil
+	return value, false
+}
+
+// LoadOrStore returns the existing value for the key if it exists (and hasn't
+// expired), with loaded set to true. Otherwise, it stores value and returns it,
+// with loaded set to false. It is the same as GetOrSet, named like the method
+// of sync.Map.
+func (c *cache) LoadOrStore(key string, value interface{}, duration time.Duration) (actual interface{}, loaded bool) {
+	return c.GetOrSet(key, value, duration)
+}
+
+// Get an item from the cache, or compute it with fn and store it if it doesn't
+// exist (or has expired.) If several goroutines request the same missing key at
+// the same time, fn is only invoked once, and the other callers block until it
+// returns and then receive its result. If fn returns an error, nothing is
+// stored and all waiting callers receive the error. If fn panics, nothing is
+// stored, the panic is resumed in the caller that called fn, and the other
+// waiting callers receive an error wrapping ErrComputePanicked. The cache is not
+// locked while fn runs, so fn may safely use the cache.
+//
+// If a coalescing window is set (see WithCoalescingWindow), callers that find
+// a computation for the key in progress for less than the window are served
+// the previous, expired value of the item instead of waiting, if it hasn't been
+// deleted yet.
+func (c *cache) GetOrCompute(key string, duration time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	return c.getOrCompute(context.Background(), key, func(context.Context) (interface{}, time.Duration, error) {
+		v, err := fn()
+		return v, duration, err
+	})
+}
+
+// Get an item from the cache, or compute and store it like GetOrCompute, but
+// stop waiting for the computation and return ctx.Err() if ctx is done first.
+// The computation (which may be shared with other callers) isn't canceled, and
+// still stores the item when it finishes; fn is called with a context that
+// carries the values of ctx, but isn't canceled along with it. If ctx can be
+// canceled, fn runs in another goroutine, so if it panics, the panic isn't
+// resumed in the caller, which receives an error wrapping ErrComputePanicked
+// instead.
+func (c *cache) GetOrComputeCtx(ctx context.Context, key string, duration time.Duration, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	return c.getOrCompute(ctx, key, func(ctx context.Context) (interface{}, time.Duration, error) {
+		v, err := fn(ctx)
+		return v, duration, err
+	})
+}
+
+// Get an item from the cache, or load it with the loader set by WithLoader and
+// store it with the duration the loader returned if it doesn't exist (or has
+// expired.) Concurrent calls for the same missing key share a single call of
+// the loader, as with GetOrCompute. Returns the item or nil, and a bool
+// indicating whether it was found or loaded. Without a loader, this is
+// equivalent to Get.
+//
+// If a negative cache TTL is set (see WithNegativeCacheTTL), keys that the
+// loader didn't find aren't loaded again until the TTL has passed (or they are
+// set.)
+func (c *cache) GetOrLoad(key string) (interface{}, bool) {
+	if c.loader == nil {
+		return c.Get(key)
+	}
+	v, err := c.getOrLoad(key)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// Get an item from the cache, or load it like GetOrLoad. Returns the item, or
+// ErrNotLoaded if the loader didn't find it (or no loader is set), the error
+// returned by a loader set by WithLoaderErr if it failed, or
+// ErrLoaderUnavailable if the loader circuit breaker is open (see
+// WithLoaderCircuitBreaker).
+func (c *cache) GetOrLoadErr(key string) (interface{}, error) {
+	if c.loader == nil {
+		if v, found := c.Get(key); found {
+			return v, nil
+		}
+		return nil, ErrNotLoaded
+	}
+	return c.getOrLoad(key)
+}
+
+// getOrLoad implements GetOrLoad and GetOrLoadErr.
+func (c *cache) getOrLoad(key string) (interface{}, error) {
+	if c.negativeTTL > 0 || c.breakerThreshold > 0 {
+		if v, found := c.getKeepExpired(key); found {
+			return v, nil
+		}
+		if c.negativeTTL > 0 && c.knownMissing(key) {
+			return nil, ErrNotLoaded
+		}
+		if c.loaderOpen() {
+			return nil, ErrLoaderUnavailable
+		}
+	}
+	return c.getOrCompute(context.Background(), key, func(context.Context) (interface{}, time.Duration, error) {
+		v, d, err := c.callLoader(key)
+		if c.negativeTTL > 0 && errors.Is(err, ErrNotLoaded) {
+			c.setMissing(key)
+		}
+		return v, d, err
+	})
+}
+
+// callLoader calls the loader for key, waiting until fewer than the maximum
+// number of concurrent loads (see WithMaxConcurrentLoads) are in progress.
+// Returns the loader's error, or ErrLoaderUnavailable without calling it if the
+// loader circuit breaker is open.
+func (c *cache) callLoader(key string) (interface{}, time.Duration, error) {
+	if c.breakerThreshold > 0 && !c.tryLoad() {
+		return nil, 0, ErrLoaderUnavailable
+	}
+	if c.loadSem != nil {
+		c.loadSem <- struct{}{}
+		defer func() { <-c.loadSem }()
+	}
+	v, d, err := c.loader(key)
+	if c.breakerThreshold > 0 {
+		c.loaded(err == nil || errors.Is(err, ErrNotLoaded))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, d, nil
+}
+
+// loaderOpen returns true if the loader circuit breaker is open, and its
+// cooldown hasn't passed.
+func (c *cache) loaderOpen() bool {
+	until := atomic.LoadInt64(&c.loaderOpenUntil)
+	return until != 0 && c.clock.Now().UnixNano() < until
+}
+
+// tryLoad returns true if the loader may be called: if the loader circuit
+// breaker is closed, or if its cooldown has passed and no other trial load is
+// in progress. In the latter case, the breaker stays open for another cooldown
+// unless the trial load succeeds.
+func (c *cache) tryLoad() bool {
+	until := atomic.LoadInt64(&c.loaderOpenUntil)
+	if until == 0 {
+		return true
+	}
+	now := c.clock.Now()
+	if now.UnixNano() < until {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&c.loaderOpenUntil, until, now.Add(c.breakerCooldown).UnixNano())
+}
+
+// loaded records the result of a call of the loader for the loader circuit
+// breaker, opening it after breakerThreshold consecutive failures and closing
+// it after a call that didn't fail (including one that didn't find the item.)
+func (c *cache) loaded(ok bool) {
+	if ok {
+		atomic.StoreInt32(&c.loaderFailures, 0)
+		atomic.StoreInt64(&c.loaderOpenUntil, 0)
+		return
+	}
+	if atomic.AddInt32(&c.loaderFailures, 1) >= c.breakerThreshold {
+		atomic.StoreInt64(&c.loaderOpenUntil, c.clock.Now().Add(c.breakerCooldown).UnixNano())
+	}
+}
+
+// knownMissing returns true if the loader didn't find key within the negative
+// cache TTL.
+func (c *cache) knownMissing(key string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	expiration, found := c.negatives[key]
+	return found && c.clock.Now().UnixNano() <= expiration
+}
+
+// setMissing records that the loader didn't find key. Whenever the number of
+// recorded keys has doubled, the expired ones are deleted, so that keys that
+// aren't requested again don't accumulate when there is no janitor.
+func (c *cache) setMissing(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.clock.Now()
+	if c.negatives == nil {
+		c.negatives = make(map[string]int64)
+	}
+	if len(c.negatives) >= c.negativesPruneAt {
+		c.pruneNegatives(now.UnixNano())
+		c.negativesPruneAt = 2 * len(c.negatives)
+		if c.negativesPruneAt < 64 {
+			c.negativesPruneAt = 64
+		}
+	}
+	c.negatives[key] = now.Add(c.negativeTTL).UnixNano()
+}
+
+// pruneNegatives deletes the keys recorded by setMissing whose negative cache
+// TTL has passed.
+func (c *cache) pruneNegatives(now int64) {
+	for key, expiration := range c.negatives {
+		if now > expiration {
+			delete(c.negatives, key)
+		}
+	}
+}
+
+var (
+	// ErrNotLoaded is returned by GetOrLoadErr when the loader didn't find
+	// the item. A loader set by WithLoaderErr returns it (or an error
+	// wrapping it) in that case.
+	ErrNotLoaded = errors.New("item was not loaded")
+	// ErrLoaderUnavailable is returned by GetOrLoadErr when the loader circuit
+	// breaker is open (see WithLoaderCircuitBreaker).
+	ErrLoaderUnavailable = errors.New("loader unavailable")
+	// ErrComputePanicked is wrapped by the error returned by GetOrCompute
+	// (and the other methods sharing its computations) to the callers
+	// waiting for a computation whose function panicked.
+	ErrComputePanicked = errors.New("computation panicked")
+)
+
+// getOrCompute implements GetOrCompute and GetOrComputeCtx, with fn also
+// returning the expiration duration of the item it computes. If ctx can be
+// canceled, fn is called in a new goroutine (with a context that isn't canceled
+// along with ctx), so that the caller can stop waiting for it; if fn panics
+// there, the caller receives an error wrapping ErrComputePanicked like the
+// other waiting callers.
+func (c *cache) getOrCompute(ctx context.Context, key string, fn func(context.Context) (interface{}, time.Duration, error)) (interface{}, error) {
+	if v, found := c.getKeepExpired(key); found {
+		return v, nil
+	}
+
+	c.callsMu.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.callsMu.Unlock()
+		if c.coalescingWindow > 0 && c.clock.Now().Sub(cl.started) < c.coalescingWindow {
+			if v, _, found := c.GetStale(key); found {
+				return v, nil
+			}
+		}
+		return c.wait(ctx, cl)
+	}
+	// A previous call may have stored the item after the lookup above.
+	if v, found := c.getKeepExpired(key); found {
+		c.callsMu.Unlock()
+		return v, nil
+	}
+	cl := &call{
+		done:    make(chan struct{}),
+		started: c.clock.Now(),
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]*call)
+	}
+	c.calls[key] = cl
+	c.callsMu.Unlock()
+
+	if ctx.Done() == nil {
+		if r := c.compute(key, cl, func() (interface{}, time.Duration, error) {
+			return fn(ctx)
+		}); r != nil {
+			panic(r)
+		}
+		return cl.value, cl.err
+	}
+	detached := detachedContext{ctx}
+	go c.compute(key, cl, func() (interface{}, time.Duration, error) {
+		return fn(detached)
+	})
+
+	return c.wait(ctx, cl)
+}
+
+// detachedContext carries the values of its parent, but is never canceled and
+// has no deadline, like the context returned by context.WithoutCancel, which
+// requires Go 1.21.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
+
+// wait waits for cl to finish and returns its result, or ctx.Err() if ctx is
+// done first.
+func (c *cache) wait(ctx context.Context, cl *call) (interface{}, error) {
+	select {
+	case <-cl.done:
+		return cl.value, cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// getKeepExpired is like Get, but doesn't delete the item if it has expired, so
+// that it remains available to GetStale.
+func (c *cache) getKeepExpired(key string) (interface{}, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	v, found := c.get(key)
+	if found && c.policy != nil {
+		c.policy.OnAccess(key)
+	}
+	return v, found
+}
+
+// Get an item from the cache even if it has expired, as long as it hasn't been
+// deleted yet (e.g. by the janitor), so that a stale value can be served while
+// a fresh one is fetched. Returns the item or nil, a bool indicating whether
+// the item has expired, and a bool indicating whether the key was found.
+func (c *cache) GetStale(key string) (value interface{}, expired bool, found bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	item, found := c.items[key]
+	if !found {
+		return nil, false, false
+	}
+	return item.Object, c.expired(item), true
+}
+
+// compute runs fn for an in-flight call, stores its result if it succeeded,
+// and releases the callers waiting on cl, even if fn panics. In that case, they
+// receive an error wrapping ErrComputePanicked, and compute returns the value
+// passed to panic, so that a caller running it synchronously can resume the
+// panic. When it runs in its own goroutine, the panic is recovered so that it
+// doesn't crash the program.
+func (c *cache) compute(key string, cl *call, fn func() (interface{}, time.Duration, error)) (panicked interface{}) {
+	defer func() {
+		panicked = recover()
+		if panicked != nil {
+			cl.value = nil
+			cl.err = fmt.Errorf("%w: %v", ErrComputePanicked, panicked)
+		}
+		c.callsMu.Lock()
+		delete(c.calls, key)
+		c.callsMu.Unlock()
+		close(cl.done)
+	}()
+
+	var duration time.Duration
+	cl.value, duration, cl.err = fn()
+	if cl.err == nil {
+		c.Set(key, cl.value, duration)
+	}
+	return nil
+}
+
+// Set a new value for the cache key, moving its current value (if it exists and
+// hasn't expired) to archiveKey with the expiration duration archiveDuration.
+// Both updates happen atomically, so readers never see the new value without
+// the archived one. Returns a bool indicating whether a value was archived.
+// Duration rules are the same as for Set.
+func (c *cache) RotateValue(key string, value interface{}, duration time.Duration, archiveKey string, archiveDuration time.Duration) bool {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	old, found := c.get(key)
+	if found {
+		c.set(archiveKey, old, archiveDuration)
+	}
+	c.set(key, value, duration)
+
+	return found
+}
+
+// Set a new value for the cache key only if cond returns true when called with
+// the current value (or nil) and a bool indicating whether the key was found
+// (and hadn't expired.) Returns a bool indicating whether the value was set.
+// cond is called while the cache is locked, so it must not use the cache.
+func (c *cache) SetIf(key string, value interface{}, duration time.Duration, cond func(current interface{}, found bool) bool) bool {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	current, found := c.get(key)
+	if !cond(current, found) {
+		return false
+	}
+	c.set(key, value, duration)
+
+	return true
+}
+
+// Set a new value for the cache key only if its current value (if it exists and
+// hasn't expired) is equal to old, as determined by ==. Returns a bool
+// indicating whether the value was swapped. Values whose types aren't
+// comparable (e.g. slices, maps and funcs, or structs containing them) are
+// never equal, so swapping them always fails. Duration rules are the same as
+// for Set.
+func (c *cache) CompareAndSwap(key string, old, new interface{}, duration time.Duration) bool {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	current, found := c.get(key)
+	if !found || !equal(current, old) {
+		return false
+	}
+	c.set(key, new, duration)
+
+	return true
+}
+
+// equal reports whether a == b, treating values that can't be compared with ==
+// as unequal instead of panicking.
+func equal(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !reflect.ValueOf(a).Comparable() || !reflect.ValueOf(b).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// Atomically update an item: fn is called with the current value (or nil) and a
+// bool indicating whether the key was found (and hadn't expired), and returns
+// the new value and whether to keep the item. If it returns true, the new value
+// is stored, keeping the item's expiration time (or with the default
+// expiration if it was added); otherwise the item is deleted, calling the
+// OnEvicted function if one is set. Returns a bool indicating whether the
+// cache was changed. fn is called while the cache is locked, so it must not use
+// the cache.
+func (c *cache) Update(key string, fn func(value interface{}, found bool) (interface{}, bool)) bool {
+	c.mutex.Lock()
+	item, found := c.items[key]
+	if found && c.expired(item) {
+		found = false
+	}
+	var current interface{}
+	if found {
+		current = item.Object
+	}
+	value, keep := fn(current, found)
+	if keep {
+		if found {
+			item.Object = value
+			c.insert(key, item)
+		} else {
+			c.set(key, value, DefaultExpiration)
+		}
+		c.unlock()
+		return true
+	}
+	if !found {
+		c.mutex.Unlock()
+		return false
+	}
+	ov, evicted := c.remove(key)
+	c.mutex.Unlock()
+
+	if evicted {
+		c.evicted(ov)
+	}
+
+	return true
+}
+
+// Set a new value for the cache key only if it already exists, and the existing
+// item hasn't expired. Returns an error otherwise.
+func (c *cache) Replace(key string, value interface{}, duration time.Duration) error {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	_, found := c.get(key)
+	if !found {
+		return fmt.Errorf("item %s doesn't exist", key)
+	}
+
+	c.set(key, value, duration)
+
+	return nil
+}
+
+// Set a new value for the cache key only if it already exists, the existing
+// item hasn't expired, and fn returns true when called with its current value.
+// fn returns the new value and whether to store it; if not, the item is left
+// unchanged. Returns an error if the item doesn't exist. Duration rules are the
+// same as for Set. fn is called while the cache is locked, so it must not use
+// the cache.
+func (c *cache) ReplaceWithFunc(key string, fn func(old interface{}) (interface{}, bool), duration time.Duration) error {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	old, found := c.get(key)
+	if !found {
+		return fmt.Errorf("item %s doesn't exist", key)
+	}
+	if value, ok := fn(old); ok {
+		c.set(key, value, duration)
+	}
+
+	return nil
+}
+
+// Move an item to a new key, keeping its expiration time and replacing any
+// existing item with that key. Returns false, and does nothing, if the old key
+// doesn't exist or has expired. No OnEvicted function is called for either key.
+func (c *cache) Rename(oldKey, newKey string) bool {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	item, found := c.items[oldKey]
+	if !found || c.expired(item) {
+		return false
+	}
+	if oldKey == newKey {
+		return true
+	}
+	c.publishRemoval(EventDelete, oldKey)
+	c.delete(oldKey)
+	c.insert(newKey, item)
+
+	return true
+}
+
+// Get an item from the cache. Returns the item or nil, and a bool indicating
+// whether the key was found. If the item has expired, it is deleted, calling
+// the OnExpired (or OnEvicted) function if one is set.
+func (c *cache) Get(key string) (interface{}, bool) {
+	c.mutex.RLock()
+
+	// "Inlining" of get and Expired
+	item, found := c.items[key]
+	if !found {
+		c.mutex.RUnlock()
+		atomic.AddUint64(&c.missCount, 1)
+		return nil, false
+	}
+	refresh := false
+	if item.Expiration > 0 {
+		now := c.clock.Now().UnixNano()
+		if now > item.Expiration {
+			c.mutex.RUnlock()
+			atomic.AddUint64(&c.missCount, 1)
+			c.deleteIfExpired(key)
+			return nil, false
+		}
+		refresh = c.refreshAhead > 0 && item.Expiration-now <= int64(c.refreshAhead)
+	}
+	if item.weak != nil {
+		v, ok := item.weak.value()
+		if !ok {
+			c.mutex.RUnlock()
+			atomic.AddUint64(&c.missCount, 1)
+			c.deleteIfCollected(key)
+			return nil, false
+		}
+		item.Object = v
+	}
+	if c.policy != nil {
+		c.policy.OnAccess(key)
+	}
+	atomic.AddUint64(&c.hitCount, 1)
+	c.countAccess(key)
+	c.mutex.RUnlock()
+
+	if refresh && c.loader != nil {
+		c.refresh(key)
+	}
+	if c.copier != nil {
+		return c.copier(item.Object), true
+	}
+
+	return item.Object, true
+}
+
+// refresh reloads key with the loader in the background (see
+// WithRefreshAhead), unless it is already being loaded or computed. If the
+// loader panics, the item is left as is.
+func (c *cache) refresh(key string) {
+	c.callsMu.Lock()
+	if _, ok := c.calls[key]; ok {
+		c.callsMu.Unlock()
+		return
+	}
+	cl := &call{
+		done:    make(chan struct{}),
+		started: c.clock.Now(),
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]*call)
+	}
+	c.calls[key] = cl
+	c.callsMu.Unlock()
+
+	go c.compute(key, cl, func() (interface{}, time.Duration, error) {
+		return c.callLoader(key)
+	})
+}
+
+// Returns true if an item with the given key exists in the cache and hasn't
+// expired. Unlike Get, this is not counted as a use of the item: it doesn't
+// change the hit and miss counts reported by Stats, the access counts reported
+// by MostAccessed, or the recency of use of the item with LRU eviction, and it
+// doesn't delete the item if it has expired.
+func (c *cache) Has(key string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	_, found := c.get(key)
+	return found
+}
+
+// Get several items from the cache. Returns a map containing only the keys that
+// were found (and haven't expired) and their values. This only locks the cache
+// once, so it is faster than calling Get for each key.
+func (c *cache) GetMany(keys []string) map[string]interface{} {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	m := make(map[string]interface{}, len(keys))
+	now := c.clock.Now().UnixNano()
+	for _, key := range keys {
+		item, found := c.items[key]
+		if !found {
+			continue
+		}
+		// "Inlining" of Expired
+		if item.Expiration > 0 {
+			if now > item.Expiration {
+				continue
+			}
+		}
+		if c.policy != nil {
+			c.policy.OnAccess(key)
+		}
+		m[key] = item.Object
+	}
+
+	return m
+}
+
+// GetWithExpiration returns an item and its expiration time from the cache.
+// It returns the item or nil, the expiration time if one is set (if the item
+// never expires a zero value for time.Time is returned), and a bool indicating
+// whether the key was found. Like Get, it deletes the item if it has expired.
+func (c *cache) GetWithExpiration(key string) (interface{}, time.Time, bool) {
+	c.mutex.RLock()
+
+	// "Inlining" of get and Expired
+	item, found := c.items[key]
+	if !found {
+		c.mutex.RUnlock()
+		atomic.AddUint64(&c.missCount, 1)
+		return nil, time.Time{}, false
+	}
+	if item.Expiration > 0 {
+		if c.clock.Now().UnixNano() > item.Expiration {
+			c.mutex.RUnlock()
+			atomic.AddUint64(&c.missCount, 1)
+			c.deleteIfExpired(key)
+			return nil, time.Time{}, false
+		}
+	}
+	if c.policy != nil {
+		c.policy.OnAccess(key)
+	}
+	atomic.AddUint64(&c.hitCount, 1)
+	c.countAccess(key)
+	c.mutex.RUnlock()
+
+	if c.copier != nil {
+		item.Object = c.copier(item.Object)
+	}
+	if item.Expiration > 0 {
+		// Return the item and the expiration time
+		return item.Object, time.Unix(0, item.Expiration), true
+	}
+
+	// If expiration <= 0 (i.e. no expiration time set) then return the item
+	// and a zeroed time.Time
+	return item.Object, time.Time{}, true
+}
+
+// GetWithMeta is like Get, but also returns a copy of the metadata the item was
+// set with by SetWithMeta, or nil if it was set without any.
+func (c *cache) GetWithMeta(key string) (interface{}, map[string]string, bool) {
+	c.mutex.RLock()
+
+	// "Inlining" of get and Expired
+	item, found := c.items[key]
+	if !found {
+		c.mutex.RUnlock()
+		atomic.AddUint64(&c.missCount, 1)
+		return nil, nil, false
+	}
+	if item.Expiration > 0 {
+		if c.clock.Now().UnixNano() > item.Expiration {
+			c.mutex.RUnlock()
+			atomic.AddUint64(&c.missCount, 1)
+			c.deleteIfExpired(key)
+			return nil, nil, false
+		}
+	}
+	if c.policy != nil {
+		c.policy.OnAccess(key)
+	}
+	atomic.AddUint64(&c.hitCount, 1)
+	c.countAccess(key)
+	var meta map[string]string
+	if item.meta != nil {
+		meta = make(map[string]string, len(item.meta))
+		for k, v := range item.meta {
+			meta[k] = v
+		}
+	}
+	c.mutex.RUnlock()
+
+	if c.copier != nil {
+		item.Object = c.copier(item.Object)
+	}
+	return item.Object, meta, true
+}
+
+// GetWithTTL is like GetWithExpiration, but returns the remaining lifetime of
+// the item rather than its expiration time, or NoExpiration if it never
+// expires.
+func (c *cache) GetWithTTL(key string) (interface{}, time.Duration, bool) {
+	v, expiration, found := c.GetWithExpiration(key)
+	if !found {
+		return nil, 0, false
+	}
+	if expiration.IsZero() {
+		return v, NoExpiration, true
+	}
+	ttl := expiration.Sub(c.clock.Now())
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return v, ttl, true
+}
+
+// Returns the remaining lifetime of an item, or NoExpiration if it never
+// expires, and a bool indicating whether the key was found (and hadn't
+// expired.) Unlike GetWithExpiration, this doesn't count as a use of the item.
+func (c *cache) TTL(key string) (time.Duration, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	item, found := c.items[key]
+	if !found {
+		return 0, false
+	}
+	if item.Expiration <= 0 {
+		return NoExpiration, true
+	}
+	ttl := time.Duration(item.Expiration - c.clock.Now().UnixNano())
+	if ttl < 0 {
+		return 0, false
+	}
+
+	return ttl, true
+}
+
+// Returns the time at which an item expires, or the zero time if it never
+// expires, and a bool indicating whether the key was found (and hadn't
+// expired.) Unlike GetWithExpiration, this doesn't count as a use of the item.
+func (c *cache) ExpirationTime(key string) (time.Time, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	item, found := c.items[key]
+	if !found || c.expired(item) {
+		return time.Time{}, false
+	}
+	if item.Expiration <= 0 {
+		return time.Time{}, true
+	}
+
+	return time.Unix(0, item.Expiration), true
+}
+
+// waiter is a key that one or more goroutines are waiting for in WaitGet. ready
+// is closed when the key is set.
+type waiter struct {
+	ready chan struct{}
+	count int
+}
+
+// Get an item from the cache, waiting for it to be set if it doesn't exist (or
+// has expired.) Returns the item, or nil and ctx.Err() if ctx is done before
+// the item is set.
+func (c *cache) WaitGet(ctx context.Context, key string) (interface{}, error) {
+	if v, found := c.Get(key); found {
+		return v, nil
+	}
+
+	for {
+		c.mutex.Lock()
+		if v, found := c.get(key); found {
+			c.mutex.Unlock()
+			return v, nil
+		}
+		w, ok := c.waiters[key]
+		if !ok {
+			w = &waiter{ready: make(chan struct{})}
+			if c.waiters == nil {
+				c.waiters = make(map[string]*waiter)
+			}
+			c.waiters[key] = w
+		}
+		w.count++
+		c.mutex.Unlock()
+
+		select {
+		case <-w.ready:
+		case <-ctx.Done():
+			c.mutex.Lock()
+			w.count--
+			if w.count == 0 && c.waiters[key] == w {
+				delete(c.waiters, key)
+			}
+			c.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// wake releases the goroutines waiting for key in WaitGet. It must be called
+// while holding mutex.
+func (c *cache) wake(key string) {
+	if w, ok := c.waiters[key]; ok {
+		delete(c.waiters, key)
+		close(w.ready)
+	}
+}
+
+// countAccess increments the access count of key, if accesses are tracked. It
+// must be called while holding (at least a read lock on) mutex.
+func (c *cache) countAccess(key string) {
+	if c.accesses == nil {
+		return
+	}
+	v, ok := c.accesses.Load(key)
+	if !ok {
+		v, _ = c.accesses.LoadOrStore(key, new(uint64))
+	}
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// KeyCount is a key and the number of times it was accessed (see MostAccessed.)
+type KeyCount struct {
+	Key   string
+	Count uint64
+}
+
+// Returns up to n unexpired items' keys with the highest access counts, highest
+// first. An item's access count is the number of times Get or
+// GetWithExpiration found it since it was first set, and is reset when it is
+// deleted. Items that were never accessed are not included. Accesses are only
+// counted if the cache was created with WithAccessTracking; otherwise, this
+// returns nil.
+func (c *cache) MostAccessed(n int) []KeyCount {
+	if n < 1 || c.accesses == nil {
+		return nil
+	}
+
+	c.mutex.RLock()
+	var counts []KeyCount
+	now := c.clock.Now().UnixNano()
+	c.accesses.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		item, found := c.items[key]
+		// "Inlining" of expired
+		if !found || (item.Expiration > 0 && now > item.Expiration) {
+			return true
+		}
+		counts = append(counts, KeyCount{key, atomic.LoadUint64(v.(*uint64))})
+		return true
+	})
+	c.mutex.RUnlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+
+	return counts
+}
+
+// deleteIfExpired deletes the item with the given key if it (still) exists and
+// has expired, calling the OnExpired (or OnEvicted) function if one is set. It
+// must not be called while holding mutex.
+func (c *cache) deleteIfExpired(key string) {
+	c.mutex.Lock()
+	item, found := c.items[key]
+	if !found || !c.expired(item) {
+		c.mutex.Unlock()
+		return
+	}
+	c.publish(EventExpired, key, item.Object)
+	ov, evicted := c.delete(key)
+	c.mutex.Unlock()
+	atomic.AddUint64(&c.expirationCount, 1)
+
+	if evicted {
+		c.notifyExpired(ov)
+	}
+}
+
+func (c *cache) get(key string) (interface{}, bool) {
+	item, found := c.items[key]
+	if !found {
+		return nil, false
+	}
+	// "Inlining" of Expired
+	if item.Expiration > 0 {
+		if c.clock.Now().UnixNano() > item.Expiration {
+			return nil, false
+		}
+	}
+	if item.weak != nil {
+		return item.weak.value()
+	}
+	return item.Object, true
+}
+
+// Increment an item of type int, int8, int16, int32, int64, uintptr, uint,
+// uint8, uint32, or uint64, float32 or float64 by n. Returns an error if the
+// item's value is not an integer, if it was not found, or if it is not
+// possible to increment it by n. To retrieve the incremented value, use
+// IncrementAny or one of the specialized methods, e.g. IncrementInt64.
+func (c *cache) Increment(key string, n int64) error {
+	_, err := c.IncrementAny(key, n)
+	return err
+}
+
+// Increment an item of type int, int8, int16, int32, int64, uintptr, uint,
+// uint8, uint32, or uint64, float32 or float64 by n, like Increment. Returns
+// the incremented value, which has the same type as the item's value, or an
+// error.
+func (c *cache) IncrementAny(key string, n int64) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return nil, fmt.Errorf("item %s not found", key)
+	}
+
+	switch value.Object.(type) {
+	case int:
+		value.Object = value.Object.(int) + int(n)
+	case int8:
+		value.Object = value.Object.(int8) + int8(n)
+	case int16:
+		value.Object = value.Object.(int16) + int16(n)
+	case int32:
+		value.Object = value.Object.(int32) + int32(n)
+	case int64:
+		value.Object = value.Object.(int64) + n
+	case uint:
+		value.Object = value.Object.(uint) + uint(n)
+	case uintptr:
+		value.Object = value.Object.(uintptr) + uintptr(n)
+	case uint8:
+		value.Object = value.Object.(uint8) + uint8(n)
+	case uint16:
+		value.Object = value.Object.(uint16) + uint16(n)
+	case uint32:
+		value.Object = value.Object.(uint32) + uint32(n)
+	case uint64:
+		value.Object = value.Object.(uint64) + uint64(n)
+	case float32:
+		value.Object = value.Object.(float32) + float32(n)
+	case float64:
+		value.Object = value.Object.(float64) + float64(n)
+	default:
+		return nil, fmt.Errorf("the value for %s is not an integer", key)
+	}
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return value.Object, nil
+}
+
+// Increment an item of type float32 or float64 by n. Returns an error if the
+// item's value is not floating point, if it was not found, or if it is not
+// possible to increment it by n. Pass a negative number to decrement the
+// value. To retrieve the incremented value, use one of the specialized methods,
+// e.g. IncrementFloat64.
+func (c *cache) IncrementFloat(key string, n float64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return fmt.Errorf("item %s not found", key)
+	}
+	switch value.Object.(type) {
+	case float32:
+		value.Object = value.Object.(float32) + float32(n)
+	case float64:
+		value.Object = value.Object.(float64) + n
+	default:
+		return fmt.Errorf("the value for %s does not have type float32 or float64", key)
+	}
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nil
+}
+
+// Increment an item of type int by n. Returns an error if the item's value is
+// not an int, or if it was not found. If there is no error, the incremented
+// value is returned.
+func (c *cache) IncrementInt(key string, n int) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return 0, fmt.Errorf("item %s not found", key)
+	}
+	rv, ok := value.Object.(int)
+	if !ok {
+		return 0, fmt.Errorf("the value for %s is not an int", key)
+	}
+	nv := rv + n
+	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nv, nil
+}
+
+// Increment an item of type int by n, keeping its expiration time, or add an
+// item with the value n and the given expiration duration (which follows the
+// same rules as for Set) if it doesn't exist or has expired. Returns an error
+// if the item's value is not an int. If there is no error, the incremented
+// value is returned.
+func (c *cache) IncrementIntOrCreate(key string, n int, duration time.Duration) (int, error) {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		c.set(key, n, duration)
+		return n, nil
+	}
+	rv, ok := value.Object.(int)
+	if !ok {
+		return 0, fmt.Errorf("the value for %s is not an int", key)
+	}
+	nv := rv + n
+	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nv, nil
+}
+
+// Increment an item of type int8 by n. Returns an error if the item's value is
+// not an int8, or if it was not found. If there is no error, the incremented
+// value is returned.
+func (c *cache) IncrementInt8(key string, n int8) (int8, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return 0, fmt.Errorf("item %s not found", key)
+	}
+	rv, ok := value.Object.(int8)
+	if !ok {
+		return 0, fmt.Errorf("the value for %s is not an int8", key)
+	}
+	nv := rv + n
+	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nv, nil
+}
+
+// Increment an item of type int16 by n. Returns an error if the item's value is
+// not an int16, or if it was not found. If there is no error, the incremented
+// value is returned.
+func (c *cache) IncrementInt16(key string, n int16) (int16, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return 0, fmt.Errorf("item %s not found", key)
+	}
+	rv, ok := value.Object.(int16)
+	if !ok {
+		return 0, fmt.Errorf("the value for %s is not an int16", key)
+	}
+	nv := rv + n
+	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nv, nil
 }
 
 // Increment an item of type int32 by n. Returns an error if the item's value is
@@ -332,7 +1717,7 @@ func (c *cache) IncrementInt32(key string, n int32) (int32, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(int32)
@@ -341,6 +1726,7 @@ func (c *cache) IncrementInt32(key string, n int32) (int32, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -354,7 +1740,7 @@ func (c *cache) IncrementInt64(key string, n int64) (int64, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(int64)
@@ -363,6 +1749,34 @@ func (c *cache) IncrementInt64(key string, n int64) (int64, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nv, nil
+}
+
+// Increment an item of type int64 by n, keeping its expiration time, or add an
+// item with the value n and the given expiration duration (which follows the
+// same rules as for Set) if it doesn't exist or has expired. This makes it easy
+// to count events in fixed windows, e.g. for rate limiting. Returns an error if
+// the item's value is not an int64. If there is no error, the incremented value
+// is returned.
+func (c *cache) IncrementInt64WithExpiration(key string, n int64, duration time.Duration) (int64, error) {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		c.set(key, n, duration)
+		return n, nil
+	}
+	rv, ok := value.Object.(int64)
+	if !ok {
+		return 0, fmt.Errorf("the value for %s is not an int64", key)
+	}
+	nv := rv + n
+	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -376,7 +1790,7 @@ func (c *cache) IncrementUint(key string, n uint) (uint, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint)
@@ -385,6 +1799,7 @@ func (c *cache) IncrementUint(key string, n uint) (uint, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -398,7 +1813,7 @@ func (c *cache) IncrementUintptr(key string, n uintptr) (uintptr, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uintptr)
@@ -407,6 +1822,7 @@ func (c *cache) IncrementUintptr(key string, n uintptr) (uintptr, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -417,10 +1833,10 @@ func (c *cache) IncrementUintptr(key string, n uintptr) (uintptr, error) {
 // incremented value is returned.
 func (c *cache) IncrementUint8(key string, n uint8) (uint8, error) {
 	c.mutex.Lock()
-	c.mutex.Unlock()
+	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint8)
@@ -429,6 +1845,7 @@ func (c *cache) IncrementUint8(key string, n uint8) (uint8, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -442,7 +1859,7 @@ func (c *cache) IncrementUint16(key string, n uint16) (uint16, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint16)
@@ -451,6 +1868,7 @@ func (c *cache) IncrementUint16(key string, n uint16) (uint16, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -464,7 +1882,7 @@ func (c *cache) IncrementUint32(key string, n uint32) (uint32, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint32)
@@ -473,6 +1891,7 @@ func (c *cache) IncrementUint32(key string, n uint32) (uint32, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -486,7 +1905,7 @@ func (c *cache) IncrementUint64(key string, n uint64) (uint64, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint64)
@@ -495,6 +1914,7 @@ func (c *cache) IncrementUint64(key string, n uint64) (uint64, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -508,7 +1928,7 @@ func (c *cache) IncrementFloat32(key string, n float32) (float32, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(float32)
@@ -517,6 +1937,7 @@ func (c *cache) IncrementFloat32(key string, n float32) (float32, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -530,7 +1951,7 @@ func (c *cache) IncrementFloat64(key string, n float64) (float64, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(float64)
@@ -539,25 +1960,185 @@ func (c *cache) IncrementFloat64(key string, n float64) (float64, error) {
 	}
 	nv := rv + n
 	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nv, nil
+}
+
+// Increment an item of type time.Duration by n. Returns an error if the item's
+// value is not a time.Duration, or if it was not found. If there is no error,
+// the incremented value is returned.
+func (c *cache) IncrementDuration(key string, n time.Duration) (time.Duration, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return 0, fmt.Errorf("item %s not found", key)
+	}
+	rv, ok := value.Object.(time.Duration)
+	if !ok {
+		return 0, fmt.Errorf("the value for %s is not a time.Duration", key)
+	}
+	nv := rv + n
+	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nv, nil
+}
+
+// Increment an item of type *big.Int by n. The stored value is replaced with a new
+// *big.Int rather than modified in place, so values previously returned by the
+// cache are not changed. Returns an error if the item's value is not a
+// *big.Int, or if it was not found. If there is no error, the incremented
+// value is returned.
+func (c *cache) IncrementBigInt(key string, n *big.Int) (*big.Int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return nil, fmt.Errorf("item %s not found", key)
+	}
+	rv, ok := value.Object.(*big.Int)
+	if !ok || rv == nil {
+		return nil, fmt.Errorf("the value for %s is not a *big.Int", key)
+	}
+	nv := new(big.Int).Add(rv, n)
+	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return new(big.Int).Set(nv), nil
+}
+
+// ErrOverflow is returned by IncrementIntChecked and the other checked
+// increments when incrementing an item would overflow its type.
+var ErrOverflow = errors.New("integer overflow")
+
+// integer is the constraint of incrementChecked.
+type integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uintptr | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// incrementChecked implements IncrementIntChecked and the other checked
+// increments.
+func incrementChecked[T integer](c *cache, key string, n T) (T, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return 0, fmt.Errorf("item %s not found", key)
+	}
+	rv, ok := value.Object.(T)
+	if !ok {
+		return 0, fmt.Errorf("the value for %s does not have type %T", key, rv)
+	}
+	nv := rv + n
+	if (n > 0 && nv < rv) || (n < 0 && nv > rv) {
+		return rv, fmt.Errorf("incrementing %s by %d: %w", key, n, ErrOverflow)
+	}
+	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
 }
 
+// Increment an item of type int by n, like IncrementInt, but return an error
+// wrapping ErrOverflow, leaving the item unchanged, rather than wrapping around
+// if the result doesn't fit in an int. On overflow, the current value is
+// returned.
+func (c *cache) IncrementIntChecked(key string, n int) (int, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type int8 by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementInt8Checked(key string, n int8) (int8, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type int16 by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementInt16Checked(key string, n int16) (int16, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type int32 by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementInt32Checked(key string, n int32) (int32, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type int64 by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementInt64Checked(key string, n int64) (int64, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type uint by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementUintChecked(key string, n uint) (uint, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type uintptr by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementUintptrChecked(key string, n uintptr) (uintptr, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type uint8 by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementUint8Checked(key string, n uint8) (uint8, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type uint16 by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementUint16Checked(key string, n uint16) (uint16, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type uint32 by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementUint32Checked(key string, n uint32) (uint32, error) {
+	return incrementChecked(c, key, n)
+}
+
+// Increment an item of type uint64 by n, checking for overflow like
+// IncrementIntChecked.
+func (c *cache) IncrementUint64Checked(key string, n uint64) (uint64, error) {
+	return incrementChecked(c, key, n)
+}
+
 // Decrement an item of type int, int8, int16, int32, int64, uintptr, uint,
 // uint8, uint32, or uint64, float32 or float64 by n. Returns an error if the
 // item's value is not an integer, if it was not found, or if it is not
-// possible to decrement it by n. To retrieve the decremented value, use one
-// of the specialized methods, e.g. DecrementInt64.
+// possible to decrement it by n. To retrieve the decremented value, use
+// DecrementAny or one of the specialized methods, e.g. DecrementInt64.
 func (c *cache) Decrement(key string, n int64) error {
+	_, err := c.DecrementAny(key, n)
+	return err
+}
+
+// Decrement an item of type int, int8, int16, int32, int64, uintptr, uint,
+// uint8, uint32, or uint64, float32 or float64 by n, like Decrement. Returns
+// the decremented value, which has the same type as the item's value, or an
+// error.
+func (c *cache) DecrementAny(key string, n int64) (interface{}, error) {
 	// TODO: Implement Increment and Decrement more cleanly.
 	// (Cannot do Increment(key, n*-1) for uints.)
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
-		return fmt.Errorf("item %s not found", key)
+	if !found || c.expired(value) {
+		return nil, fmt.Errorf("item %s not found", key)
 	}
 	switch value.Object.(type) {
 	case int:
@@ -587,11 +2168,12 @@ func (c *cache) Decrement(key string, n int64) error {
 	case float64:
 		value.Object = value.Object.(float64) - float64(n)
 	default:
-		return fmt.Errorf("the value for %s is not an integer", key)
+		return nil, fmt.Errorf("the value for %s is not an integer", key)
 	}
+	value.version = c.stamp()
 	c.items[key] = value
 
-	return nil
+	return value.Object, nil
 }
 
 // Decrement an item of type float32 or float64 by n. Returns an error if the
@@ -604,7 +2186,7 @@ func (c *cache) DecrementFloat(key string, n float64) error {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return fmt.Errorf("item %s not found", key)
 	}
 	switch value.Object.(type) {
@@ -615,6 +2197,7 @@ func (c *cache) DecrementFloat(key string, n float64) error {
 	default:
 		return fmt.Errorf("the value for %s does not have type float32 or float64", key)
 	}
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nil
@@ -628,7 +2211,7 @@ func (c *cache) DecrementInt(key string, n int) (int, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(int)
@@ -637,6 +2220,7 @@ func (c *cache) DecrementInt(key string, n int) (int, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -650,7 +2234,7 @@ func (c *cache) DecrementInt8(key string, n int8) (int8, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(int8)
@@ -659,6 +2243,7 @@ func (c *cache) DecrementInt8(key string, n int8) (int8, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -672,7 +2257,7 @@ func (c *cache) DecrementInt16(key string, n int16) (int16, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(int16)
@@ -681,6 +2266,7 @@ func (c *cache) DecrementInt16(key string, n int16) (int16, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -694,7 +2280,7 @@ func (c *cache) DecrementInt32(key string, n int32) (int32, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(int32)
@@ -703,6 +2289,7 @@ func (c *cache) DecrementInt32(key string, n int32) (int32, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -716,7 +2303,7 @@ func (c *cache) DecrementInt64(key string, n int64) (int64, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(int64)
@@ -725,11 +2312,50 @@ func (c *cache) DecrementInt64(key string, n int64) (int64, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
 }
 
+// Decrement an item of type int64 by n, and delete it if the result is less
+// than or equal to zero, calling the OnEvicted function if one is set. Returns
+// the decremented value, a bool indicating whether the item was deleted, and an
+// error if the item's value is not an int64 or if it was not found. This is
+// useful for reference counting, as the check and the deletion happen
+// atomically.
+func (c *cache) DecrementAndDeleteAtZero(key string, n int64) (int64, bool, error) {
+	c.mutex.Lock()
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		c.mutex.Unlock()
+		return 0, false, fmt.Errorf("item %s not found", key)
+	}
+	rv, ok := value.Object.(int64)
+	if !ok {
+		c.mutex.Unlock()
+		return 0, false, fmt.Errorf("the value for %s is not an int64", key)
+	}
+	nv := rv - n
+	if nv > 0 {
+		value.Object = nv
+		value.version = c.stamp()
+		c.items[key] = value
+		c.mutex.Unlock()
+		return nv, false, nil
+	}
+	atomic.AddUint64(&c.evictionCount, 1)
+	c.publishRemoval(EventDelete, key)
+	ov, evicted := c.delete(key)
+	c.mutex.Unlock()
+
+	if evicted {
+		c.evicted(ov)
+	}
+
+	return nv, true, nil
+}
+
 // Decrement an item of type uint by n. Returns an error if the item's value is
 // not an uint, or if it was not found. If there is no error, the decremented
 // value is returned.
@@ -738,7 +2364,7 @@ func (c *cache) DecrementUint(key string, n uint) (uint, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint)
@@ -747,6 +2373,7 @@ func (c *cache) DecrementUint(key string, n uint) (uint, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -760,7 +2387,7 @@ func (c *cache) DecrementUintptr(key string, n uintptr) (uintptr, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uintptr)
@@ -769,6 +2396,7 @@ func (c *cache) DecrementUintptr(key string, n uintptr) (uintptr, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -782,7 +2410,7 @@ func (c *cache) DecrementUint8(key string, n uint8) (uint8, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint8)
@@ -791,6 +2419,7 @@ func (c *cache) DecrementUint8(key string, n uint8) (uint8, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -804,7 +2433,7 @@ func (c *cache) DecrementUint16(key string, n uint16) (uint16, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint16)
@@ -813,6 +2442,7 @@ func (c *cache) DecrementUint16(key string, n uint16) (uint16, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -826,7 +2456,7 @@ func (c *cache) DecrementUint32(key string, n uint32) (uint32, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint32)
@@ -835,6 +2465,7 @@ func (c *cache) DecrementUint32(key string, n uint32) (uint32, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
@@ -848,7 +2479,7 @@ func (c *cache) DecrementUint64(key string, n uint64) (uint64, error) {
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
 	rv, ok := value.Object.(uint64)
@@ -857,137 +2488,742 @@ func (c *cache) DecrementUint64(key string, n uint64) (uint64, error) {
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nv, nil
+}
+
+// Decrement an item of type float32 by n. Returns an error if the item's value
+// is not an float32, or if it was not found. If there is no error, the
+// decremented value is returned.
+func (c *cache) DecrementFloat32(key string, n float32) (float32, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return 0, fmt.Errorf("item %s not found", key)
+	}
+	rv, ok := value.Object.(float32)
+	if !ok {
+		return 0, fmt.Errorf("the value for %s is not an float32", key)
+	}
+	nv := rv - n
+	value.Object = nv
+	value.version = c.stamp()
+	c.items[key] = value
+
+	return nv, nil
+}
+
+// Decrement an item of type float64 by n. Returns an error if the item's value
+// is not an float64, or if it was not found. If there is no error, the
+// decremented value is returned.
+func (c *cache) DecrementFloat64(key string, n float64) (float64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.items[key]
+	if !found || c.expired(value) {
+		return 0, fmt.Errorf("item %s not found", key)
+	}
+	rv, ok := value.Object.(float64)
+	if !ok {
+		return 0, fmt.Errorf("the value for %s is not an float64", key)
+	}
+	nv := rv - n
+	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
 }
 
-// Decrement an item of type float32 by n. Returns an error if the item's value
-// is not an float32, or if it was not found. If there is no error, the
-// decremented value is returned.
-func (c *cache) DecrementFloat32(key string, n float32) (float32, error) {
+// Decrement an item of type time.Duration by n. Returns an error if the item's
+// value is not a time.Duration, or if it was not found. If there is no error,
+// the decremented value is returned.
+func (c *cache) DecrementDuration(key string, n time.Duration) (time.Duration, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
+	if !found || c.expired(value) {
 		return 0, fmt.Errorf("item %s not found", key)
 	}
-	rv, ok := value.Object.(float32)
+	rv, ok := value.Object.(time.Duration)
 	if !ok {
-		return 0, fmt.Errorf("the value for %s is not an float32", key)
+		return 0, fmt.Errorf("the value for %s is not a time.Duration", key)
 	}
 	nv := rv - n
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
 	return nv, nil
 }
 
-// Decrement an item of type float64 by n. Returns an error if the item's value
-// is not an float64, or if it was not found. If there is no error, the
-// decremented value is returned.
-func (c *cache) DecrementFloat64(key string, n float64) (float64, error) {
+// Decrement an item of type *big.Int by n. The stored value is replaced with a new
+// *big.Int rather than modified in place, so values previously returned by the
+// cache are not changed. Returns an error if the item's value is not a
+// *big.Int, or if it was not found. If there is no error, the decremented
+// value is returned.
+func (c *cache) DecrementBigInt(key string, n *big.Int) (*big.Int, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	value, found := c.items[key]
-	if !found || value.Expired() {
-		return 0, fmt.Errorf("item %s not found", key)
+	if !found || c.expired(value) {
+		return nil, fmt.Errorf("item %s not found", key)
 	}
-	rv, ok := value.Object.(float64)
-	if !ok {
-		return 0, fmt.Errorf("the value for %s is not an float64", key)
+	rv, ok := value.Object.(*big.Int)
+	if !ok || rv == nil {
+		return nil, fmt.Errorf("the value for %s is not a *big.Int", key)
 	}
-	nv := rv - n
+	nv := new(big.Int).Sub(rv, n)
 	value.Object = nv
+	value.version = c.stamp()
 	c.items[key] = value
 
-	return nv, nil
+	return new(big.Int).Set(nv), nil
+}
+
+// Append s to an item of type string, or add an item with the value s if it
+// doesn't exist (or has expired), and reset its expiration time following the
+// same rules as Set. Returns the new value, or an error if the existing item's
+// value is not a string.
+func (c *cache) AppendString(key string, s string, duration time.Duration) (string, error) {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	current, found := c.get(key)
+	if found {
+		cs, ok := current.(string)
+		if !ok {
+			return "", fmt.Errorf("the value for %s is not a string", key)
+		}
+		s = cs + s
+	}
+	c.set(key, s, duration)
+
+	return s, nil
 }
 
 // Delete an item from the cache. Does nothing if the key is not in the cache.
 func (c *cache) Delete(key string) {
 	c.mutex.Lock()
-	value, evicted := c.delete(key)
+	value, evicted := c.remove(key)
+	c.mutex.Unlock()
+
+	if evicted {
+		c.evicted(value)
+	}
+}
+
+// Delete several items from the cache, calling the OnEvicted function (if one is
+// set) for each of them once the cache is unlocked. Returns the number of keys
+// that were in the cache. This only locks the cache once, so it is faster than
+// calling Delete for each key.
+func (c *cache) DeleteMany(keys []string) int {
+	var evictedItems []keyAndValue
+	removed := 0
+
+	c.mutex.Lock()
+	for _, key := range keys {
+		if _, found := c.items[key]; !found {
+			continue
+		}
+		ov, evicted := c.remove(key)
+		if evicted {
+			evictedItems = append(evictedItems, ov)
+		}
+		removed++
+	}
+	c.mutex.Unlock()
+
+	for _, value := range evictedItems {
+		c.evicted(value)
+	}
+
+	return removed
+}
+
+// Reset the expiration time of an existing item that hasn't expired, as if it
+// had been set again with the given duration, which follows the same rules as
+// Set. Returns a bool indicating whether the key was found.
+func (c *cache) Touch(key string, duration time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	item, found := c.items[key]
+	if !found || c.expired(item) {
+		return false
+	}
+	item.Expiration = c.expirationFor(duration)
+	item.version = c.stamp()
+	c.items[key] = item
+	c.expirations.update(key, item.Expiration)
+
+	return true
+}
+
+// Get an item from the cache and reset its expiration time as if it had been
+// set again with the given duration, which follows the same rules as Set.
+// Returns the item or nil, and a bool indicating whether the key was found.
+// Expired items are not found, and are left untouched.
+func (c *cache) GetAndTouch(key string, duration time.Duration) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	item, found := c.items[key]
+	if !found || c.expired(item) {
+		return nil, false
+	}
+	item.Expiration = c.expirationFor(duration)
+	item.version = c.stamp()
+	c.items[key] = item
+	c.expirations.update(key, item.Expiration)
+	if c.policy != nil {
+		c.policy.OnAccess(key)
+	}
+
+	return item.Object, true
+}
+
+// Get an item from the cache and delete it, calling the OnEvicted function if
+// one is set. Returns the item or nil, and a bool indicating whether the key was
+// found (and hadn't expired.) When several goroutines call GetAndDelete for the
+// same key, exactly one of them receives the item.
+func (c *cache) GetAndDelete(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	v, found := c.get(key)
+	ov, evicted := c.remove(key)
+	c.mutex.Unlock()
+
+	if evicted {
+		c.evicted(ov)
+	}
+
+	return v, found
+}
+
+// Get an item and its expiration time from the cache and delete it, like
+// GetAndDelete, e.g. to move it to another cache with the same deadline using
+// SetWithAbsoluteExpiration. Returns the item or nil, its expiration time (or a
+// zero time.Time if it never expires), and a bool indicating whether the key was
+// found (and hadn't expired.)
+func (c *cache) Pop(key string) (interface{}, time.Time, bool) {
+	c.mutex.Lock()
+	item, found := c.items[key]
+	if found && c.expired(item) {
+		found = false
+	}
+	ov, evicted := c.remove(key)
 	c.mutex.Unlock()
 
 	if evicted {
-		c.onEvicted(key, value)
+		c.evicted(ov)
+	}
+
+	if !found {
+		return nil, time.Time{}, false
 	}
+	if item.Expiration > 0 {
+		return item.Object, time.Unix(0, item.Expiration), true
+	}
+	return item.Object, time.Time{}, true
 }
 
-func (c *cache) delete(key string) (interface{}, bool) {
-	if c.onEvicted != nil {
+// remove deletes the item with the given key, if it exists, on behalf of the
+// user (e.g. by Delete), counting it as evicted in Stats and publishing an
+// EventDelete. It returns the same values as delete. It must be called while
+// holding mutex.
+func (c *cache) remove(key string) (keyAndValue, bool) {
+	if item, found := c.items[key]; found {
+		atomic.AddUint64(&c.evictionCount, 1)
+		c.publish(EventDelete, key, item.Object)
+	}
+	return c.delete(key)
+}
+
+func (c *cache) delete(key string) (keyAndValue, bool) {
+	if c.policy != nil {
+		c.policy.OnRemove(key)
+	}
+	c.expirations.remove(key)
+	if c.accesses != nil {
+		c.accesses.Delete(key)
+	}
+	if c.onEvicted != nil || c.onExpired != nil || c.sizer != nil || c.itemCallbacks {
 		if value, found := c.items[key]; found {
 			delete(c.items, key)
-			return value.Object, true
+			c.size -= value.size
+			kv := keyAndValue{key, value.Object, value.onEvicted, c.callbacks()}
+			return kv, c.onEvicted != nil || c.onExpired != nil || kv.onEvicted != nil
 		}
 	}
 
 	delete(c.items, key)
 
-	return nil, false
+	return keyAndValue{}, false
+}
+
+// makeRoom evicts items until a new item of the given size can be stored
+// under key without exceeding the maximum number of items or bytes, removing
+// expired items first unless they count toward the limit. The existing item
+// with the same key, if any, is not evicted, as it is replaced. An item larger
+// than the maximum number of bytes is stored once all others are evicted.
+// It must be called while holding mutex, and the evicted items' OnEvicted calls
+// are made by unlock.
+func (c *cache) makeRoom(key string, size int64) {
+	old, exists := c.items[key]
+	full := func() bool {
+		if exists {
+			return c.maxBytes > 0 && c.size-old.size+size > c.maxBytes
+		}
+		return (c.maxItems > 0 && len(c.items) >= c.maxItems) ||
+			(c.maxBytes > 0 && c.size+size > c.maxBytes)
+	}
+	if !full() {
+		return
+	}
+	if c.reclaimExpired {
+		c.expiredItems, _ = c.deleteDue(c.clock.Now().UnixNano(), c.expiredItems, nil, 0)
+		old, exists = c.items[key]
+	}
+	remaining := 0
+	if exists {
+		remaining = 1
+		if c.policy != nil {
+			c.policy.OnAccess(key)
+		}
+	}
+	for full() && len(c.items) > remaining {
+		var victim string
+		var ok bool
+		if c.policy != nil {
+			victim, ok = c.policy.Victim()
+			if _, found := c.items[victim]; ok && !found {
+				// The policy returned a key that isn't in the cache,
+				// so fall back to a random victim.
+				c.policy.OnRemove(victim)
+				ok = false
+			}
+			ok = ok && victim != key
+		}
+		if !ok {
+			for k := range c.items {
+				if k != key {
+					victim = k
+					break
+				}
+			}
+		}
+		c.publishRemoval(EventEvicted, victim)
+		ov, evicted := c.delete(victim)
+		if evicted {
+			c.evictedItems = append(c.evictedItems, ov)
+		}
+		atomic.AddUint64(&c.evictionCount, 1)
+	}
+}
+
+// unlock releases mutex, then calls the OnEvicted and OnExpired functions for
+// any items that were removed by makeRoom while it was held.
+func (c *cache) unlock() {
+	evictedItems := c.evictedItems
+	expiredItems := c.expiredItems
+	c.evictedItems = nil
+	c.expiredItems = nil
+	c.mutex.Unlock()
+
+	for _, value := range evictedItems {
+		c.evicted(value)
+	}
+	for _, value := range expiredItems {
+		c.notifyExpired(value)
+	}
+}
+
+// Stats are counters of how a cache has been used since it was created.
+type Stats struct {
+	// Number of Get and GetWithExpiration calls that found an item.
+	Hits uint64
+	// Number of Get and GetWithExpiration calls that didn't find an item, or
+	// found one that had expired.
+	Misses uint64
+	// Number of items removed from the cache other than because they expired,
+	// i.e. evicted to make room for new ones (see WithMaxItems), or deleted by
+	// Delete, Flush and similar methods.
+	Evictions uint64
+	// Number of expired items deleted from the cache, e.g. by the janitor.
+	Expirations uint64
+}
+
+// Returns the cache's usage counters.
+func (c *cache) Stats() Stats {
+	return Stats{
+		Hits:        atomic.LoadUint64(&c.hitCount),
+		Misses:      atomic.LoadUint64(&c.missCount),
+		Evictions:   atomic.LoadUint64(&c.evictionCount),
+		Expirations: atomic.LoadUint64(&c.expirationCount),
+	}
+}
+
+// Returns the maximum number of items the cache holds, as set with WithMaxItems,
+// or 0 if the number of items is unlimited.
+func (c *cache) MaxItems() int {
+	return c.maxItems
 }
 
 type keyAndValue struct {
-	key   string
-	value interface{}
+	key       string
+	value     interface{}
+	onEvicted func(string, interface{})
+	callbacks callbacks
+}
+
+// callbacks are the OnEvicted and OnExpired functions and the eviction pool of
+// a cache when an item was removed from it. They are copied while holding
+// mutex, as they may be replaced concurrently, so that they can be called after
+// releasing it.
+type callbacks struct {
+	onEvicted    func(string, interface{})
+	onExpired    func(string, interface{})
+	evictionPool *evictionPool
+}
+
+// callbacks returns the current callbacks of the cache. It must be called while
+// holding mutex.
+func (c *cache) callbacks() callbacks {
+	return callbacks{c.onEvicted, c.onExpired, c.evictionPool}
 }
 
 // Delete all expired items from the cache.
 func (c *cache) DeleteExpired() {
-	var evictedItems []keyAndValue
-	now := time.Now().UnixNano()
+	c.deleteExpired(nil)
+}
 
-	c.mutex.Lock()
-	for key, value := range c.items {
-		// "Inlining" of expired
-		if value.Expiration > 0 && now > value.Expiration {
-			ov, evicted := c.delete(key)
-			if evicted {
-				evictedItems = append(evictedItems, keyAndValue{key, ov})
-			}
+// Delete all expired items from the cache, like DeleteExpired, and return the
+// number of items deleted.
+func (c *cache) DeleteExpiredN() int {
+	return c.deleteExpired(nil)
+}
+
+// Returns when expired items were last deleted from the cache, by the janitor
+// or by DeleteExpired (or DeleteExpiredN or DrainExpired), or the zero time if
+// they haven't been yet, e.g. to check that the janitor is running.
+func (c *cache) LastCleanup() time.Time {
+	t := atomic.LoadInt64(&c.lastCleanup)
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
+
+// Delete all expired items from the cache, like DeleteExpired, and return a map
+// of their keys to their last values, e.g. to move them to a secondary store in
+// one batch. The OnExpired (or OnEvicted) function is called for each of them,
+// as usual.
+func (c *cache) DrainExpired() map[string]interface{} {
+	drained := make(map[string]interface{})
+	c.deleteExpired(drained)
+	return drained
+}
+
+// deleteExpired deletes all expired items from the cache and returns how many
+// were deleted. If drained isn't nil, their keys and values are added to it.
+func (c *cache) deleteExpired(drained map[string]interface{}) int {
+	start := c.clock.Now()
+	now := start.UnixNano()
+	atomic.StoreInt64(&c.lastCleanup, now)
+
+	removed := 0
+	var onSweep func(int, time.Duration)
+	for batch := 0; ; batch++ {
+		c.mutex.Lock()
+		evictedItems, n := c.deleteDue(now, nil, drained, c.sweepBatchSize)
+		onSweep = c.onSweep
+		if batch == 0 {
+			c.pruneNegatives(now)
+		}
+		c.mutex.Unlock()
+
+		for _, value := range evictedItems {
+			c.notifyExpired(value)
+		}
+		removed += n
+		// Items that expired after now are left for the next sweep, so
+		// this ends even if items keep expiring.
+		if c.sweepBatchSize <= 0 || n < c.sweepBatchSize {
+			break
 		}
 	}
-	c.mutex.Unlock()
+	if onSweep != nil {
+		onSweep(removed, c.clock.Now().Sub(start))
+	}
 
-	for _, value := range evictedItems {
-		c.onEvicted(value.key, value.value)
+	return removed
+}
+
+// deleteDue deletes the items that had expired at now, which only takes time
+// proportional to their number. It appends those whose OnExpired (or
+// OnEvicted) function should be called to expired, and returns it and the
+// number of deleted items. If drained isn't nil, the keys and values of all
+// deleted items are added to it. If max is positive, at most max items are
+// deleted. It must be called while holding mutex.
+func (c *cache) deleteDue(now int64, expired []keyAndValue, drained map[string]interface{}, max int) ([]keyAndValue, int) {
+	removed := 0
+	for max <= 0 || removed < max {
+		key, expiration, ok := c.expirations.peek()
+		if !ok || now <= expiration {
+			break
+		}
+		if drained != nil {
+			drained[key] = c.items[key].Object
+		}
+		c.publishRemoval(EventExpired, key)
+		ov, evicted := c.delete(key)
+		if evicted {
+			expired = append(expired, ov)
+		}
+		removed++
 	}
+	atomic.AddUint64(&c.expirationCount, uint64(removed))
+
+	return expired, removed
 }
 
 // Sets an (optional) function that is called with the key and value when an
 // item is evicted from the cache. (Including when it is deleted manually, but
-// not when it is overwritten.) Set to nil to disable.
+// not when it is overwritten unless WithEvictOnOverwrite is used, and not when
+// it has expired if an OnExpired function is set.) Set to nil to disable.
 func (c *cache) OnEvicted(f func(string, interface{})) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	c.stopEvictionPool()
+	c.onEvicted = f
+}
+
+// Sets an (optional) function that is called with the key and value when an
+// expired item is deleted from the cache, e.g. by DeleteExpired or the janitor.
+// If it is set, the OnEvicted function is only called for items that are
+// deleted manually or evicted, and not for expired items. Set to nil to
+// disable, in which case the OnEvicted function is called for expired items as
+// well.
+func (c *cache) OnExpired(f func(string, interface{})) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.onExpired = f
+}
+
+// Sets an (optional) function that is called once after each Flush, with a map
+// of the keys of all items that were deleted to their values, e.g. to record
+// them in one batch rather than one at a time with OnEvicted. It is called
+// without holding the cache's lock. Set to nil to disable.
+func (c *cache) OnFlush(f func(items map[string]interface{})) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.onFlush = f
+}
+
+// Sets an (optional) function that is called after each sweep for expired
+// items, by the janitor or DeleteExpired (or DrainExpired), with the number of
+// items that were deleted and how long the sweep took, according to the cache's
+// Clock. It is called without holding the cache's lock. Set to nil to disable.
+func (c *cache) OnSweep(f func(removed int, duration time.Duration)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.onSweep = f
+}
+
+// notifyExpired calls the item's own callback (see SetWithCallback) and the
+// OnExpired function for an expired item that was deleted from the cache, or
+// the OnEvicted function if there is none. It must not be called while holding
+// mutex.
+func (c *cache) notifyExpired(kv keyAndValue) {
+	if kv.onEvicted != nil {
+		kv.onEvicted(kv.key, kv.value)
+	}
+	if f := kv.callbacks.onExpired; f != nil {
+		f(kv.key, kv.value)
+		return
+	}
+	c.evictedGlobal(kv)
+}
+
+// EvictionOverflowPolicy determines what happens when an item is evicted while
+// the queue of an asynchronous OnEvicted function (see OnEvictedAsync) is full.
+type EvictionOverflowPolicy int
+
+const (
+	// Block the evicting caller until there is room in the queue.
+	OverflowBlock EvictionOverflowPolicy = iota
+	// Drop the eviction event without calling the OnEvicted function. The
+	// number of dropped events is reported by DroppedEvictions.
+	OverflowDrop
+	// Call the OnEvicted function synchronously in the evicting goroutine.
+	OverflowRunInline
+)
+
+// Like OnEvicted, but the function is called asynchronously by a pool of the
+// given number of worker goroutines, which receive evicted items through a
+// queue of the given size. The policy determines what happens when an item is
+// evicted while the queue is full. Calling OnEvicted or OnEvictedAsync again
+// stops the workers; any events still queued at that point are discarded.
+//
+// If f is nil or workers is less than one, this is equivalent to OnEvicted(f).
+func (c *cache) OnEvictedAsync(f func(string, interface{}), workers, queueSize int, policy EvictionOverflowPolicy) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stopEvictionPool()
 	c.onEvicted = f
+	if f == nil || workers < 1 {
+		return
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	p := &evictionPool{
+		onEvicted: f,
+		policy:    policy,
+		queue:     make(chan keyAndValue, queueSize),
+		stop:      make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+	c.evictionPool = p
+}
+
+// Returns the number of eviction events that were dropped because the queue of
+// an asynchronous OnEvicted function was full and its policy was OverflowDrop.
+func (c *cache) DroppedEvictions() uint64 {
+	return atomic.LoadUint64(&c.droppedEvictions)
+}
+
+// evicted calls the item's own callback (see SetWithCallback) and the
+// OnEvicted function for an item that was removed from the cache, or hands it
+// to the eviction pool if there is one. It must not be called while holding
+// mutex.
+func (c *cache) evicted(kv keyAndValue) {
+	if kv.onEvicted != nil {
+		kv.onEvicted(kv.key, kv.value)
+	}
+	c.evictedGlobal(kv)
+}
+
+// evictedGlobal calls the OnEvicted function the cache had when an item was
+// removed from it, or hands the item to the eviction pool it had.
+func (c *cache) evictedGlobal(removed keyAndValue) {
+	key, value := removed.key, removed.value
+	p := removed.callbacks.evictionPool
+	if p == nil {
+		if f := removed.callbacks.onEvicted; f != nil {
+			f(key, value)
+		}
+		return
+	}
+
+	kv := keyAndValue{key: key, value: value}
+	switch p.policy {
+	case OverflowDrop:
+		select {
+		case p.queue <- kv:
+		default:
+			atomic.AddUint64(&c.droppedEvictions, 1)
+		}
+	case OverflowRunInline:
+		select {
+		case p.queue <- kv:
+		default:
+			p.onEvicted(key, value)
+		}
+	default:
+		select {
+		case p.queue <- kv:
+		case <-p.stop:
+		}
+	}
+}
+
+func (c *cache) stopEvictionPool() {
+	if c.evictionPool != nil {
+		close(c.evictionPool.stop)
+		c.evictionPool = nil
+	}
+}
+
+type evictionPool struct {
+	onEvicted func(string, interface{})
+	policy    EvictionOverflowPolicy
+	queue     chan keyAndValue
+	stop      chan struct{}
+}
+
+func (p *evictionPool) run() {
+	for {
+		select {
+		case kv := <-p.queue:
+			p.onEvicted(kv.key, kv.value)
+		case <-p.stop:
+			return
+		}
+	}
 }
 
 // Write the cache's items (using Gob) to an io.Writer.
 //
 // NOTE: This method is deprecated in favor of c.Items() and NewFrom() (see the
 // documentation for NewFrom().)
-func (c *cache) Save(w io.Writer) (err error) {
+func (c *cache) Save(w io.Writer) error {
 	enc := gob.NewEncoder(w)
-	defer func() {
-		if x := recover(); x != nil {
-			err = fmt.Errorf("error registering item types with Gob library")
-		}
-	}()
 
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
-	for _, value := range c.items {
-		gob.Register(value.Object)
+	registered := make(map[reflect.Type]bool)
+	for key, value := range c.items {
+		if value.Object == nil {
+			continue
+		}
+		t := reflect.TypeOf(value.Object)
+		if registered[t] {
+			continue
+		}
+		if err := gobRegister(value.Object); err != nil {
+			return fmt.Errorf("error registering type %s of item %s with Gob library: %v", t, key, err)
+		}
+		registered[t] = true
+	}
+	if err := enc.Encode(&c.items); err != nil {
+		// Find out which item couldn't be encoded.
+		for key, value := range c.items {
+			if ierr := gob.NewEncoder(io.Discard).Encode(&value); ierr != nil {
+				return fmt.Errorf("error encoding item %s of type %T: %v", key, value.Object, ierr)
+			}
+		}
+		return err
 	}
-	err = enc.Encode(&c.items)
 
-	return
+	return nil
+}
+
+// gobRegister calls gob.Register, turning a panic into an error.
+func gobRegister(value interface{}) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("%v", x)
+		}
+	}()
+	gob.Register(value)
+
+	return nil
 }
 
 // Save the cache's items to the given filename, creating the file if it
@@ -1000,14 +3236,48 @@ func (c *cache) SaveFile(fname string) error {
 	if err != nil {
 		return err
 	}
-
-	err = c.Save(fp)
-	defer fp.Close()
+
+	err = c.Save(fp)
+	defer fp.Close()
+	if err != nil {
+		return err
+	}
+
+	return fp.Close()
+}
+
+// Save the cache's items to the given filename, like SaveFile, but by writing
+// them to a temporary file in the same directory, syncing it to disk and
+// renaming it to fname, so that the file is always either the complete previous
+// or the complete new version, even if saving fails or the process crashes.
+func (c *cache) SaveFileAtomic(fname string) error {
+	return writeFileAtomic(fname, c.Save)
+}
+
+// writeFileAtomic replaces the file at path with the output of write, as
+// described for SaveFileAtomic.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	fp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := fp.Name()
+
+	err = write(fp)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
 	if err != nil {
-		return err
+		os.Remove(tmp)
 	}
 
-	return fp.Close()
+	return err
 }
 
 // Add (Gob-serialized) cache items from an io.Reader, excluding any items with
@@ -1022,13 +3292,120 @@ func (c *cache) Load(r io.Reader) error {
 	err := dec.Decode(&items)
 	if err == nil {
 		c.mutex.Lock()
-		defer c.mutex.Unlock()
-		for key, value := range items {
-			ov, found := c.items[key]
-			if !found || ov.Expired() {
-				c.items[key] = value
+		defer c.unlock()
+		c.load(items)
+	}
+
+	return err
+}
+
+// load adds the given items to the cache, excluding any items with keys that
+// already exist (and haven't expired.) It must be called while holding mutex.
+func (c *cache) load(items map[string]Item) {
+	for key, value := range items {
+		ov, found := c.items[key]
+		if !found || c.expired(ov) {
+			c.insert(key, value)
+		}
+	}
+}
+
+// insert stores item under key as is, replacing any existing item. It must be
+// called while holding mutex.
+func (c *cache) insert(key string, item Item) {
+	item.size = 0
+	if c.sizer != nil {
+		item.size = c.sizer(item.Object)
+	}
+	if c.maxItems > 0 || c.maxBytes > 0 {
+		c.makeRoom(key, item.size)
+	}
+	if c.evictOnOverwrite {
+		c.overwritten(key)
+	}
+	if c.sizer != nil {
+		c.size += item.size - c.items[key].size
+	}
+	if item.onEvicted != nil {
+		// The item may come from another cache (see Merge.)
+		c.itemCallbacks = true
+	}
+	item.version = c.stamp()
+	c.items[key] = item
+	c.expirations.update(key, item.Expiration)
+	c.publish(EventSet, key, item.Object)
+	if c.policy != nil {
+		c.policy.OnAdd(key)
+	}
+	if c.waiters != nil {
+		c.wake(key)
+	}
+	if c.negatives != nil {
+		delete(c.negatives, key)
+	}
+}
+
+// mergeMu is held by Merge while it locks the two caches, so that no other
+// Merge can lock one of them in the opposite order in the meantime.
+var mergeMu sync.Mutex
+
+// Copy all unexpired items from other into the cache, keeping their expiration
+// times. If overwrite is false, items with keys that already exist (and haven't
+// expired) in the cache are skipped, as with Load; otherwise they are replaced.
+//
+// Both caches are locked while merging. Only one Merge at a time takes the locks
+// (see mergeMu), so that concurrent merges in both directions can't deadlock.
+func (c *cache) Merge(other *Cache, overwrite bool) {
+	if other == nil || other.cache == c {
+		return
+	}
+	o := other.cache
+	mergeMu.Lock()
+	c.mutex.Lock()
+	o.mutex.RLock()
+	mergeMu.Unlock()
+	defer c.unlock()
+	defer o.mutex.RUnlock()
+
+	now := o.clock.Now().UnixNano()
+	for key, value := range o.items {
+		// "Inlining" of expired
+		if value.Expiration > 0 && now > value.Expiration {
+			continue
+		}
+		if !overwrite {
+			if _, found := c.get(key); found {
+				continue
 			}
 		}
+		c.insert(key, value)
+	}
+}
+
+// Write the cache's items to an io.Writer as a JSON object mapping the keys to
+// objects with "object" and "expiration" fields (see Item.)
+func (c *cache) SaveJSON(w io.Writer) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return json.NewEncoder(w).Encode(c.items)
+}
+
+// Add JSON-serialized cache items (see SaveJSON) from an io.Reader, excluding
+// any items with keys that already exist (and haven't expired) in the current
+// cache.
+//
+// Note that the values of the items are decoded as if into an interface{}, so
+// they don't keep their original types: numbers become float64s, objects become
+// map[string]interface{}s, arrays become []interface{}s, etc. Callers that need
+// the original types must convert the values themselves.
+func (c *cache) LoadJSON(r io.Reader) error {
+	items := map[string]Item{}
+	err := json.NewDecoder(r).Decode(&items)
+	if err == nil {
+		c.mutex.Lock()
+		defer c.unlock()
+		c.load(items)
 	}
 
 	return err
@@ -1060,7 +3437,7 @@ func (c *cache) Items() map[string]Item {
 	defer c.mutex.RUnlock()
 
 	m := make(map[string]Item, len(c.items))
-	now := time.Now().UnixNano()
+	now := c.clock.Now().UnixNano()
 	for key, value := range c.items {
 		// "Inlining" of Expired
 		if value.Expiration > 0 {
@@ -1074,6 +3451,193 @@ func (c *cache) Items() map[string]Item {
 	return m
 }
 
+// Returns the keys of all unexpired items in the cache. The order of the keys
+// is not deterministic.
+func (c *cache) Keys() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	keys := make([]string, 0, len(c.items))
+	now := c.clock.Now().UnixNano()
+	for key, value := range c.items {
+		// "Inlining" of Expired
+		if value.Expiration > 0 {
+			if now > value.Expiration {
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// KeyExpiration is a key and the expiration time of its item (see
+// ItemsByExpiration.)
+type KeyExpiration struct {
+	Key        string
+	Expiration time.Time
+}
+
+// Returns the keys and expiration times of all unexpired items in the cache,
+// sorted by expiration time, soonest first. Items that never expire come last,
+// with a zero Expiration. Items with the same expiration time are sorted by key.
+func (c *cache) ItemsByExpiration() []KeyExpiration {
+	type keyAndExpiration struct {
+		key        string
+		expiration int64
+	}
+
+	c.mutex.RLock()
+	entries := make([]keyAndExpiration, 0, len(c.items))
+	now := c.clock.Now().UnixNano()
+	for key, value := range c.items {
+		// "Inlining" of Expired
+		if value.Expiration > 0 && now > value.Expiration {
+			continue
+		}
+		entries = append(entries, keyAndExpiration{key, value.Expiration})
+	}
+	c.mutex.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.expiration != b.expiration {
+			if a.expiration == 0 || b.expiration == 0 {
+				return b.expiration == 0
+			}
+			return a.expiration < b.expiration
+		}
+		return a.key < b.key
+	})
+	res := make([]KeyExpiration, len(entries))
+	for i, e := range entries {
+		res[i].Key = e.key
+		if e.expiration > 0 {
+			res[i].Expiration = time.Unix(0, e.expiration)
+		}
+	}
+
+	return res
+}
+
+// An ItemView is a copy of a cache item with its expiration time as a
+// time.Time, as returned by ItemsWithExpiration.
+type ItemView struct {
+	Object     interface{}
+	Expiration time.Time // The zero time if the item never expires
+}
+
+// Copies all unexpired items in the cache into a new map and returns it, like
+// Items, but with their expiration times converted to time.Time values.
+func (c *cache) ItemsWithExpiration() map[string]ItemView {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	m := make(map[string]ItemView, len(c.items))
+	now := c.clock.Now().UnixNano()
+	for key, value := range c.items {
+		// "Inlining" of Expired
+		if value.Expiration > 0 && now > value.Expiration {
+			continue
+		}
+		v := ItemView{Object: value.Object}
+		if value.Expiration > 0 {
+			v.Expiration = time.Unix(0, value.Expiration)
+		}
+		m[key] = v
+	}
+
+	return m
+}
+
+// Returns a histogram of the remaining lifetimes of the unexpired items in the
+// cache, with the given bucket boundaries, which must be in ascending order.
+// The returned slice has len(buckets)+2 counts: element i is the number of
+// items whose remaining lifetime is at most buckets[i] (and more than
+// buckets[i-1]), element len(buckets) the number of items that expire later
+// than the last boundary, and the last element the number of items that never
+// expire.
+func (c *cache) TTLHistogram(buckets []time.Duration) []int {
+	counts := make([]int, len(buckets)+2)
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	now := c.clock.Now().UnixNano()
+	for _, item := range c.items {
+		if item.Expiration <= 0 {
+			counts[len(buckets)+1]++
+			continue
+		}
+		// "Inlining" of Expired
+		if now > item.Expiration {
+			continue
+		}
+		ttl := time.Duration(item.Expiration - now)
+		counts[sort.Search(len(buckets), func(i int) bool { return ttl <= buckets[i] })]++
+	}
+
+	return counts
+}
+
+// Calls fn with the key and value of each unexpired item in the cache, in no
+// particular order, until fn returns false. Unlike Items, this doesn't copy the
+// items. The cache is read-locked while iterating, so fn must not modify the
+// cache (which would deadlock), and should return quickly, as it blocks
+// writers.
+func (c *cache) ForEach(fn func(key string, value interface{}) bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	now := c.clock.Now().UnixNano()
+	for key, value := range c.items {
+		// "Inlining" of Expired
+		if value.Expiration > 0 {
+			if now > value.Expiration {
+				continue
+			}
+		}
+		if !fn(key, value.Object) {
+			return
+		}
+	}
+}
+
+// Atomically update all unexpired items in the cache, in no particular order:
+// fn is called with the key and value of each item, and returns the new value
+// and whether to keep the item, as with Update. If it returns true, the new
+// value is stored, keeping the item's expiration time; otherwise the item is
+// deleted, calling the OnEvicted function (if one is set) once the cache is
+// unlocked. Returns the number of deleted items. The cache is locked while
+// iterating, so fn must not use the cache, and should return quickly.
+func (c *cache) RangeUpdate(fn func(key string, value interface{}) (newValue interface{}, keep bool)) int {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	removed := 0
+	now := c.clock.Now().UnixNano()
+	for key, item := range c.items {
+		// "Inlining" of Expired
+		if item.Expiration > 0 && now > item.Expiration {
+			continue
+		}
+		value, keep := fn(key, item.Object)
+		if keep {
+			item.Object = value
+			c.insert(key, item)
+			continue
+		}
+		ov, evicted := c.remove(key)
+		if evicted {
+			c.evictedItems = append(c.evictedItems, ov)
+		}
+		removed++
+	}
+
+	return removed
+}
+
 // Returns the number of items in the cache. This may include items that have
 // expired, but have not yet been cleaned up.
 func (c *cache) ItemCount() int {
@@ -1083,17 +3647,214 @@ func (c *cache) ItemCount() int {
 	return len(c.items)
 }
 
-// Delete all items from the cache.
+// Delete all items from the cache, calling the OnEvicted function (if one is
+// set) for each of them.
 func (c *cache) Flush() {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	var evictedItems []keyAndValue
+	var flushed map[string]interface{}
 
+	c.mutex.Lock()
+	if c.onEvicted != nil || c.itemCallbacks {
+		evictedItems = make([]keyAndValue, 0, len(c.items))
+		for key, value := range c.items {
+			evictedItems = append(evictedItems, keyAndValue{key, value.Object, value.onEvicted, c.callbacks()})
+		}
+	}
+	onFlush := c.onFlush
+	if onFlush != nil {
+		flushed = make(map[string]interface{}, len(c.items))
+		for key, value := range c.items {
+			flushed[key] = value.Object
+		}
+	}
+	atomic.AddUint64(&c.evictionCount, uint64(len(c.items)))
+	c.size = 0
+	if len(c.subscribers) > 0 {
+		for key, value := range c.items {
+			c.publish(EventDelete, key, value.Object)
+		}
+	}
+	c.resetPolicy()
 	c.items = map[string]Item{}
+	c.negatives = nil
+	c.expirations.reset()
+	if c.accesses != nil {
+		c.accesses = new(sync.Map)
+	}
+	c.mutex.Unlock()
+
+	for _, value := range evictedItems {
+		c.evicted(value)
+	}
+	if onFlush != nil {
+		onFlush(flushed)
+	}
+}
+
+// Replace all items in the cache with the given items at once, so that readers
+// see either the old or the new items, never a mix of both. The cache takes
+// ownership of the map, which must not be modified afterwards. The OnEvicted
+// function (if one is set) is called for each item whose key is not in items,
+// as if it was deleted; items that are replaced by one with the same key are
+// treated as overwritten. The maximum number of items and bytes of the cache
+// are not enforced for the new items.
+func (c *cache) ReplaceAll(items map[string]Item) {
+	var evictedItems []keyAndValue
+	if items == nil {
+		items = make(map[string]Item)
+	}
+
+	c.mutex.Lock()
+	for key, value := range c.items {
+		_, kept := items[key]
+		if !kept {
+			atomic.AddUint64(&c.evictionCount, 1)
+			c.publish(EventDelete, key, value.Object)
+		}
+		if (!kept || c.evictOnOverwrite) && (c.onEvicted != nil || value.onEvicted != nil) {
+			evictedItems = append(evictedItems, keyAndValue{key, value.Object, value.onEvicted, c.callbacks()})
+		}
+	}
+	c.resetPolicy()
+	c.items = items
+	c.size = 0
+	for key, value := range items {
+		if c.sizer != nil {
+			value.size = c.sizer(value.Object)
+			c.size += value.size
+		}
+		value.version = c.stamp()
+		items[key] = value
+		if c.policy != nil {
+			c.policy.OnAdd(key)
+		}
+		c.publish(EventSet, key, value.Object)
+	}
+	c.expirations.init(items)
+	if c.accesses != nil {
+		c.accesses = new(sync.Map)
+	}
+	c.negatives = nil
+	for key := range c.waiters {
+		if _, found := items[key]; found {
+			c.wake(key)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, value := range evictedItems {
+		c.evicted(value)
+	}
+}
+
+// Rebuild the cache's underlying map with room for hint items, to release the
+// memory held by a map that has grown much larger than the number of items in
+// it, e.g. after most of them were deleted. Expired items are deleted first, as
+// by DeleteExpired. If hint is less than the number of remaining items, room is
+// made for exactly those.
+func (c *cache) Resize(hint int) {
+	c.resize(hint)
+}
+
+// Delete all expired items from the cache and rebuild its underlying map and
+// the structures used to track its items with room for exactly the remaining
+// items, as Resize(0) does. This can be used to release memory after a lot of
+// churn, e.g. during a period of low traffic. Returns the number of expired
+// items that were deleted.
+func (c *cache) Compact() int {
+	return c.resize(0)
+}
+
+// resize implements Resize, and returns the number of expired items that were
+// deleted.
+func (c *cache) resize(hint int) int {
+	now := c.clock.Now().UnixNano()
+
+	c.mutex.Lock()
+	evictedItems, removed := c.deleteDue(now, nil, nil, 0)
+	if hint < len(c.items) {
+		hint = len(c.items)
+	}
+	items := make(map[string]Item, hint)
+	for k, v := range c.items {
+		items[k] = v
+	}
+	c.items = items
+	c.expirations.init(c.items)
+	if p, ok := c.policy.(interface{ compact() }); ok {
+		p.compact()
+	}
+	c.mutex.Unlock()
+
+	for _, value := range evictedItems {
+		c.notifyExpired(value)
+	}
+
+	return removed
+}
+
+// Returns the number of items in the cache that have expired, but have not yet
+// been deleted, e.g. by the janitor or DeleteExpired.
+func (c *cache) StaleCount() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	n := 0
+	now := c.clock.Now().UnixNano()
+	for _, e := range c.expirations.entries {
+		if now > e.expiration {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Delete all unexpired items from the cache except those for which keep returns
+// true, calling the OnEvicted function (if one is set) for each deleted item.
+// Returns the number of deleted items. keep is called while the cache is
+// locked, so it must not use the cache.
+func (c *cache) FlushExcept(keep func(key string, item Item) bool) int {
+	var evictedItems []keyAndValue
+	now := c.clock.Now().UnixNano()
+	removed := 0
+
+	c.mutex.Lock()
+	for key, value := range c.items {
+		// "Inlining" of expired
+		if value.Expiration > 0 && now > value.Expiration {
+			continue
+		}
+		if keep(key, value) {
+			continue
+		}
+		c.publish(EventDelete, key, value.Object)
+		ov, evicted := c.delete(key)
+		if evicted {
+			evictedItems = append(evictedItems, ov)
+		}
+		removed++
+	}
+	atomic.AddUint64(&c.evictionCount, uint64(removed))
+	c.mutex.Unlock()
+
+	for _, value := range evictedItems {
+		c.evicted(value)
+	}
+
+	return removed
 }
 
 type janitor struct {
 	Interval time.Duration
 	stop     chan bool
+	stopOnce sync.Once
+	paused   int32
+
+	// guards lastRun and lastRemoved
+	mu          sync.Mutex
+	lastRun     time.Time
+	lastRemoved int
 }
 
 func (j *janitor) Run(c *cache) {
@@ -1101,7 +3862,14 @@ func (j *janitor) Run(c *cache) {
 	for {
 		select {
 		case <-ticker.C:
-			c.DeleteExpired()
+			if atomic.LoadInt32(&j.paused) != 0 {
+				continue
+			}
+			removed := c.deleteExpired(nil)
+			j.mu.Lock()
+			j.lastRun = c.clock.Now()
+			j.lastRemoved = removed
+			j.mu.Unlock()
 		case <-j.stop:
 			ticker.Stop()
 			return
@@ -1109,8 +3877,105 @@ func (j *janitor) Run(c *cache) {
 	}
 }
 
+// Stop stops the janitor. It is safe to call Stop more than once.
+func (j *janitor) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+	})
+}
+
+// JanitorStatus describes the state of a cache's janitor, which periodically
+// deletes expired items from the cache.
+type JanitorStatus struct {
+	// Whether the janitor is running, i.e. the cache was created with a
+	// cleanup interval greater than zero.
+	Running bool
+	// The cleanup interval.
+	Interval time.Duration
+	// When the janitor last deleted expired items, or the zero time if it
+	// hasn't yet.
+	LastRun time.Time
+	// How many expired items the janitor deleted in its last run.
+	LastRemoved int
+	// Whether the janitor is paused (see PauseJanitor.)
+	Paused bool
+}
+
+// Returns the current state of the cache's janitor. Manual calls to
+// DeleteExpired are not reflected in LastRun and LastRemoved (see LastCleanup.)
+func (c *cache) JanitorStatus() JanitorStatus {
+	j := c.currentJanitor()
+	if j == nil {
+		return JanitorStatus{}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return JanitorStatus{
+		Running:     true,
+		Interval:    j.Interval,
+		LastRun:     j.lastRun,
+		LastRemoved: j.lastRemoved,
+		Paused:      atomic.LoadInt32(&j.paused) != 0,
+	}
+}
+
+// Pause the cache's janitor, if it has one, so that it doesn't delete expired
+// items until ResumeJanitor is called.
+func (c *cache) PauseJanitor() {
+	if j := c.currentJanitor(); j != nil {
+		atomic.StoreInt32(&j.paused, 1)
+	}
+}
+
+// Resume the cache's janitor after it was paused with PauseJanitor.
+func (c *cache) ResumeJanitor() {
+	if j := c.currentJanitor(); j != nil {
+		atomic.StoreInt32(&j.paused, 0)
+	}
+}
+
+// Change the cleanup interval of the cache, replacing its janitor with one that
+// deletes expired items at the new interval. If the interval is less than one,
+// the janitor is stopped, and expired items are not deleted from the cache
+// before calling c.DeleteExpired(). A paused janitor stays paused.
+func (c *cache) SetCleanupInterval(ci time.Duration) {
+	c.janitorMu.Lock()
+	defer c.janitorMu.Unlock()
+
+	var paused int32
+	if j := c.janitor; j != nil {
+		paused = atomic.LoadInt32(&j.paused)
+		j.Stop()
+		c.janitor = nil
+	}
+	if ci > 0 {
+		runJanitor(c, ci)
+		atomic.StoreInt32(&c.janitor.paused, paused)
+	}
+}
+
+// Stop the cache's janitor, if it has one, instead of waiting for the cache to
+// be garbage collected. Expired items are then only deleted by calling
+// c.DeleteExpired(). It is safe to call StopJanitor more than once. If the
+// cache saves its items to a file (see WithAutoSave), it also stops saving them
+// periodically and saves them one last time, like Close, but ignores any error;
+// use Close to find out whether they were saved.
+func (c *cache) StopJanitor() {
+	c.Close()
+}
+
+// currentJanitor returns the janitor of the cache, or nil if it has none.
+func (c *cache) currentJanitor() *janitor {
+	c.janitorMu.Lock()
+	defer c.janitorMu.Unlock()
+
+	return c.janitor
+}
+
 func stopJanitor(c *Cache) {
-	c.janitor.stop <- true
+	c.SetCleanupInterval(0)
+	c.stopAutoSaver()
 }
 
 func runJanitor(c *cache, ci time.Duration) {
@@ -1123,21 +3988,40 @@ func runJanitor(c *cache, ci time.Duration) {
 	go j.Run(c)
 }
 
-func newCache(duration time.Duration, items map[string]Item) *cache {
-	if duration == 0 {
-		duration = -1
-	}
-
+// Return a new cache configured by the given Options. Without any Options, the
+// items in the cache never expire (by default), and expired items are not
+// deleted from the cache before calling c.DeleteExpired(), as with
+// New(NoExpiration, 0).
+func NewWithOptions(opts ...Option) *Cache {
 	c := &cache{
-		expiration: duration,
-		items:      items,
+		expiration: NoExpiration,
+		clock:      realClock{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.items == nil {
+		c.items = make(map[string]Item)
+	}
+	c.expirations.init(c.items)
+	if c.policy != nil {
+		for key := range c.items {
+			c.policy.OnAdd(key)
+		}
+	}
+	if c.maxBytes > 0 && c.sizer == nil {
+		c.sizer = DefaultSizer
+	}
+	if c.jitter > 0 && c.rand == nil {
+		c.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if c.sizer != nil {
+		for k, v := range c.items {
+			v.size = c.sizer(v.Object)
+			c.items[k] = v
+			c.size += v.size
+		}
 	}
-
-	return c
-}
-
-func newCacheWithJanitor(de time.Duration, ci time.Duration, m map[string]Item) *Cache {
-	c := newCache(de, m)
 	// This trick ensures that the janitor goroutine (which--granted it
 	// was enabled--is running DeleteExpired on c forever) does not keep
 	// the returned C object from being garbage collected. When it is
@@ -1145,10 +4029,15 @@ func newCacheWithJanitor(de time.Duration, ci time.Duration, m map[string]Item)
 	// which c can be collected.
 	C := &Cache{c}
 
-	if ci > 0 {
-		runJanitor(c, ci)
-		runtime.SetFinalizer(C, stopJanitor)
+	if c.cleanupInterval > 0 {
+		runJanitor(c, c.cleanupInterval)
 	}
+	if c.autoSavePath != "" {
+		runAutoSaver(c, c.autoSavePath, c.autoSaveInterval)
+	}
+	// The finalizer is set even without a janitor, as one may be started
+	// later by SetCleanupInterval. It also stops the autoSaver.
+	runtime.SetFinalizer(C, stopJanitor)
 
 	return C
 }
@@ -1157,10 +4046,13 @@ func newCacheWithJanitor(de time.Duration, ci time.Duration, m map[string]Item)
 // interval. If the expiration duration is less than one (or NoExpiration),
 // the items in the cache never expire (by default), and must be deleted
 // manually. If the cleanup interval is less than one, expired items are not
-// deleted from the cache before calling c.DeleteExpired().
-func New(defaultExpiration, cleanupInterval time.Duration) *Cache {
-	items := make(map[string]Item)
-	return newCacheWithJanitor(defaultExpiration, cleanupInterval, items)
+// deleted from the cache before calling c.DeleteExpired(). Further settings can
+// be configured by passing Options, e.g. WithMaxItems.
+func New(defaultExpiration, cleanupInterval time.Duration, opts ...Option) *Cache {
+	return NewWithOptions(append([]Option{
+		WithDefaultExpiration(defaultExpiration),
+		WithCleanupInterval(cleanupInterval),
+	}, opts...)...)
 }
 
 // Return a new cache with a given default expiration duration and cleanup
@@ -1184,6 +4076,10 @@ func New(defaultExpiration, cleanupInterval time.Duration) *Cache {
 // gob.Register() the individual types stored in the cache before encoding a
 // map retrieved with c.Items(), and to register those same types before
 // decoding a blob containing an items map.
-func NewFrom(defaultExpiration, cleanupInterval time.Duration, items map[string]Item) *Cache {
-	return newCacheWithJanitor(defaultExpiration, cleanupInterval, items)
+func NewFrom(defaultExpiration, cleanupInterval time.Duration, items map[string]Item, opts ...Option) *Cache {
+	return NewWithOptions(append([]Option{
+		WithDefaultExpiration(defaultExpiration),
+		WithCleanupInterval(cleanupInterval),
+		WithInitialItems(items),
+	}, opts...)...)
 }
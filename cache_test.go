@@ -2,10 +2,21 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -1112,6 +1123,175 @@ func TestDecrementFloat64(t *testing.T) {
 	}
 }
 
+func TestIncrementDuration(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("duration", time.Second, DefaultExpiration)
+	n, err := tc.IncrementDuration("duration", 2*time.Second)
+	if err != nil {
+		t.Error("Error incrementing:", err)
+	}
+	if n != 3*time.Second {
+		t.Error("Returned duration is not 3s:", n)
+	}
+	x, found := tc.Get("duration")
+	if !found {
+		t.Error("duration was not found")
+	}
+	if x.(time.Duration) != 3*time.Second {
+		t.Error("duration is not 3s:", x)
+	}
+}
+
+func TestDecrementDuration(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("duration", 5*time.Second, DefaultExpiration)
+	n, err := tc.DecrementDuration("duration", 2*time.Second)
+	if err != nil {
+		t.Error("Error decrementing:", err)
+	}
+	if n != 3*time.Second {
+		t.Error("Returned duration is not 3s:", n)
+	}
+	x, found := tc.Get("duration")
+	if !found {
+		t.Error("duration was not found")
+	}
+	if x.(time.Duration) != 3*time.Second {
+		t.Error("duration is not 3s:", x)
+	}
+}
+
+func TestIncrementDurationErrors(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if _, err := tc.IncrementDuration("missing", time.Second); err == nil {
+		t.Error("No error incrementing a missing item")
+	}
+	tc.Set("int64", int64(1), DefaultExpiration)
+	if _, err := tc.IncrementDuration("int64", time.Second); err == nil {
+		t.Error("No error incrementing an int64 as a duration")
+	}
+	if _, err := tc.DecrementDuration("int64", time.Second); err == nil {
+		t.Error("No error decrementing an int64 as a duration")
+	}
+	if x, _ := tc.Get("int64"); x.(int64) != 1 {
+		t.Error("int64 was changed:", x)
+	}
+}
+
+func TestIncrementBigInt(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	start := big.NewInt(math.MaxInt64)
+	tc.Set("bigint", start, DefaultExpiration)
+	n, err := tc.IncrementBigInt("bigint", big.NewInt(2))
+	if err != nil {
+		t.Error("Error incrementing:", err)
+	}
+	want, _ := new(big.Int).SetString("9223372036854775809", 10)
+	if n.Cmp(want) != 0 {
+		t.Error("Returned number is not MaxInt64+2:", n)
+	}
+	if start.Int64() != math.MaxInt64 {
+		t.Error("The stored *big.Int was modified in place:", start)
+	}
+	n.SetInt64(0)
+	x, found := tc.Get("bigint")
+	if !found {
+		t.Error("bigint was not found")
+	}
+	if x.(*big.Int).Cmp(want) != 0 {
+		t.Error("bigint is not MaxInt64+2:", x)
+	}
+
+	n, err = tc.DecrementBigInt("bigint", big.NewInt(3))
+	if err != nil {
+		t.Error("Error decrementing:", err)
+	}
+	if n.Cmp(big.NewInt(math.MaxInt64-1)) != 0 {
+		t.Error("Returned number is not MaxInt64-1:", n)
+	}
+}
+
+func TestIncrementBigIntErrors(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if _, err := tc.IncrementBigInt("missing", big.NewInt(1)); err == nil {
+		t.Error("No error incrementing a missing item")
+	}
+	tc.Set("int64", int64(1), DefaultExpiration)
+	if _, err := tc.IncrementBigInt("int64", big.NewInt(1)); err == nil {
+		t.Error("No error incrementing an int64 as a *big.Int")
+	}
+	if _, err := tc.DecrementBigInt("int64", big.NewInt(1)); err == nil {
+		t.Error("No error decrementing an int64 as a *big.Int")
+	}
+}
+
+func TestIncrementIntChecked(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("max", math.MaxInt-1, DefaultExpiration)
+	n, err := tc.IncrementIntChecked("max", 1)
+	if err != nil || n != math.MaxInt {
+		t.Errorf("IncrementIntChecked returned (%d, %v), want (%d, nil)", n, err, math.MaxInt)
+	}
+	n, err = tc.IncrementIntChecked("max", 1)
+	if !errors.Is(err, ErrOverflow) {
+		t.Errorf("IncrementIntChecked returned %v on overflow, want %v", err, ErrOverflow)
+	}
+	if n != math.MaxInt {
+		t.Errorf("IncrementIntChecked returned %d on overflow, want the current value", n)
+	}
+	if x, _ := tc.Get("max"); x.(int) != math.MaxInt {
+		t.Error("max was changed by an overflowing increment:", x)
+	}
+
+	tc.Set("min", math.MinInt+1, DefaultExpiration)
+	if _, err := tc.IncrementIntChecked("min", -2); !errors.Is(err, ErrOverflow) {
+		t.Errorf("IncrementIntChecked returned %v on underflow, want %v", err, ErrOverflow)
+	}
+	if x, _ := tc.Get("min"); x.(int) != math.MinInt+1 {
+		t.Error("min was changed by an underflowing increment:", x)
+	}
+
+	if _, err := tc.IncrementIntChecked("missing", 1); err == nil || errors.Is(err, ErrOverflow) {
+		t.Error("IncrementIntChecked didn't return a not found error:", err)
+	}
+	tc.Set("int64", int64(1), DefaultExpiration)
+	if _, err := tc.IncrementIntChecked("int64", 1); err == nil {
+		t.Error("IncrementIntChecked didn't return an error for an int64")
+	}
+}
+
+func TestIncrementUintChecked(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("uint8", uint8(250), DefaultExpiration)
+	if n, err := tc.IncrementUint8Checked("uint8", 5); err != nil || n != 255 {
+		t.Errorf("IncrementUint8Checked returned (%d, %v), want (255, nil)", n, err)
+	}
+	if _, err := tc.IncrementUint8Checked("uint8", 1); !errors.Is(err, ErrOverflow) {
+		t.Errorf("IncrementUint8Checked returned %v on overflow, want %v", err, ErrOverflow)
+	}
+	tc.Set("uint64", uint64(math.MaxUint64-1), DefaultExpiration)
+	if _, err := tc.IncrementUint64Checked("uint64", 2); !errors.Is(err, ErrOverflow) {
+		t.Errorf("IncrementUint64Checked returned %v on overflow, want %v", err, ErrOverflow)
+	}
+	if x, _ := tc.Get("uint64"); x.(uint64) != math.MaxUint64-1 {
+		t.Error("uint64 was changed by an overflowing increment:", x)
+	}
+	tc.Set("uintptr", ^uintptr(0), DefaultExpiration)
+	if _, err := tc.IncrementUintptrChecked("uintptr", 1); !errors.Is(err, ErrOverflow) {
+		t.Errorf("IncrementUintptrChecked returned %v on overflow, want %v", err, ErrOverflow)
+	}
+	if _, err := tc.IncrementUint8Checked("uintptr", 1); err == nil || !strings.Contains(err.Error(), "does not have type uint8") {
+		t.Error("IncrementUint8Checked didn't return a type error for a uintptr:", err)
+	}
+	tc.Set("int8", int8(-100), DefaultExpiration)
+	if _, err := tc.IncrementInt8Checked("int8", -29); !errors.Is(err, ErrOverflow) {
+		t.Errorf("IncrementInt8Checked returned %v on underflow, want %v", err, ErrOverflow)
+	}
+	if n, err := tc.IncrementInt8Checked("int8", -28); err != nil || n != math.MinInt8 {
+		t.Errorf("IncrementInt8Checked returned (%d, %v), want (%d, nil)", n, err, math.MinInt8)
+	}
+}
+
 func TestAdd(t *testing.T) {
 	tc := New(DefaultExpiration, 0)
 	err := tc.Add("foo", "bar", DefaultExpiration)
@@ -1124,6 +1304,61 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestSetNX(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if !tc.SetNX("foo", "bar", DefaultExpiration) {
+		t.Error("Couldn't set foo even though it shouldn't exist")
+	}
+	if tc.SetNX("foo", "baz", DefaultExpiration) {
+		t.Error("Set foo again even though it exists")
+	}
+	if x, _ := tc.Get("foo"); x.(string) != "bar" {
+		t.Error("foo is not bar:", x)
+	}
+	tc.Set("expired", "old", time.Millisecond)
+	<-time.After(5 * time.Millisecond)
+	if !tc.SetNX("expired", "new", DefaultExpiration) {
+		t.Error("Couldn't set expired even though it has expired")
+	}
+	if x, _ := tc.Get("expired"); x.(string) != "new" {
+		t.Error("expired is not new:", x)
+	}
+}
+
+func TestSetIfExpiringWithin(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	tc.Set("foo", "old", 10*time.Second)
+	tc.Set("forever", "old", NoExpiration)
+
+	clock.Advance(5 * time.Second)
+	if tc.SetIfExpiringWithin("foo", "new", 3*time.Second, 10*time.Second) {
+		t.Error("foo was replaced 5s before it expires, outside the window of 3s")
+	}
+	if x, _ := tc.Get("foo"); x.(string) != "old" {
+		t.Error("foo is not old:", x)
+	}
+
+	clock.Advance(3 * time.Second)
+	if !tc.SetIfExpiringWithin("foo", "new", 3*time.Second, 10*time.Second) {
+		t.Error("foo was not replaced 2s before it expires, within the window of 3s")
+	}
+	if x, ttl, _ := tc.GetWithTTL("foo"); x.(string) != "new" || ttl != 10*time.Second {
+		t.Errorf("foo is %v with a TTL of %v, want new with a TTL of 10s", x, ttl)
+	}
+
+	if tc.SetIfExpiringWithin("forever", "new", time.Hour, DefaultExpiration) {
+		t.Error("forever was replaced although it never expires")
+	}
+
+	if !tc.SetIfExpiringWithin("missing", "new", time.Second, time.Minute) {
+		t.Error("missing was not stored")
+	}
+	if x, found := tc.Get("missing"); !found || x.(string) != "new" {
+		t.Error("missing is not new:", x)
+	}
+}
+
 func TestReplace(t *testing.T) {
 	tc := New(DefaultExpiration, 0)
 	err := tc.Replace("foo", "bar", DefaultExpiration)
@@ -1181,6 +1416,65 @@ func TestFlush(t *testing.T) {
 	}
 }
 
+func TestIncrementAny(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	for _, tt := range []struct {
+		value, want interface{}
+	}{
+		{int(1), int(3)},
+		{int8(1), int8(3)},
+		{uint16(1), uint16(3)},
+		{int64(1), int64(3)},
+		{float32(1.5), float32(3.5)},
+		{float64(1.5), float64(3.5)},
+	} {
+		tc.Set("n", tt.value, DefaultExpiration)
+		x, err := tc.IncrementAny("n", 2)
+		if err != nil {
+			t.Errorf("Error incrementing %T: %v", tt.value, err)
+		}
+		if x != tt.want {
+			t.Errorf("IncrementAny returned %v (%T), want %v (%T)", x, x, tt.want, tt.want)
+		}
+		if y, _ := tc.Get("n"); y != tt.want {
+			t.Errorf("n is %v (%T), want %v (%T)", y, y, tt.want, tt.want)
+		}
+	}
+	tc.Set("string", "a", DefaultExpiration)
+	if _, err := tc.IncrementAny("string", 1); err == nil {
+		t.Error("No error incrementing a string")
+	}
+	if _, err := tc.IncrementAny("missing", 1); err == nil {
+		t.Error("No error incrementing a missing item")
+	}
+}
+
+func TestDecrementAny(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	for _, tt := range []struct {
+		value, want interface{}
+	}{
+		{int(5), int(3)},
+		{int32(5), int32(3)},
+		{uint(5), uint(3)},
+		{uint64(5), uint64(3)},
+		{float64(5.5), float64(3.5)},
+	} {
+		tc.Set("n", tt.value, DefaultExpiration)
+		x, err := tc.DecrementAny("n", 2)
+		if err != nil {
+			t.Errorf("Error decrementing %T: %v", tt.value, err)
+		}
+		if x != tt.want {
+			t.Errorf("DecrementAny returned %v (%T), want %v (%T)", x, x, tt.want, tt.want)
+		}
+	}
+	tc.Set("string", "a", DefaultExpiration)
+	if _, err := tc.DecrementAny("string", 1); err == nil {
+		t.Error("No error decrementing a string")
+	}
+}
+
 func TestIncrementOverflowInt(t *testing.T) {
 	tc := New(DefaultExpiration, 0)
 	tc.Set("int8", int8(127), DefaultExpiration)
@@ -1247,6 +1541,135 @@ func TestOnEvicted(t *testing.T) {
 	}
 }
 
+func TestSetWithCallback(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	var itemEvicted, globalEvicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		globalEvicted = append(globalEvicted, k)
+	})
+	onEvict := func(k string, v interface{}) {
+		if v.(int) != 1 {
+			t.Errorf("callback for %s got value %v, want 1", k, v)
+		}
+		itemEvicted = append(itemEvicted, k)
+	}
+	tc.SetWithCallback("deleted", 1, NoExpiration, onEvict)
+	tc.SetWithCallback("expired", 1, time.Second, onEvict)
+	tc.Set("plain", 2, NoExpiration)
+
+	tc.Delete("deleted")
+	clock.Advance(2 * time.Second)
+	tc.DeleteExpired()
+	tc.Delete("plain")
+
+	if len(itemEvicted) != 2 || itemEvicted[0] != "deleted" || itemEvicted[1] != "expired" {
+		t.Errorf("item callback called for %v, want [deleted expired]", itemEvicted)
+	}
+	if len(globalEvicted) != 3 {
+		t.Errorf("OnEvicted called for %v, want all 3 items", globalEvicted)
+	}
+}
+
+func TestSetWithCallbackWithoutGlobal(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	called := 0
+	tc.SetWithCallback("foo", 1, DefaultExpiration, func(k string, v interface{}) {
+		called++
+	})
+	tc.Set("bar", 2, DefaultExpiration)
+	x, found := tc.Get("foo")
+	if !found || x.(int) != 1 {
+		t.Errorf("foo is %v, %v, want 1, true", x, found)
+	}
+	tc.Delete("bar")
+	if called != 0 {
+		t.Error("callback was called when another item was deleted")
+	}
+	tc.Set("foo", 3, DefaultExpiration)
+	tc.Delete("foo")
+	if called != 0 {
+		t.Error("callback was called after the item was overwritten")
+	}
+}
+
+func TestOnFlush(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var calls int
+	var flushed map[string]interface{}
+	tc.OnFlush(func(items map[string]interface{}) {
+		calls++
+		flushed = items
+		// The function must be called without holding the lock.
+		tc.Set("after", true, DefaultExpiration)
+	})
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", "two", DefaultExpiration)
+	tc.Flush()
+
+	if calls != 1 {
+		t.Errorf("OnFlush function was called %d times, want 1", calls)
+	}
+	want := map[string]interface{}{"a": 1, "b": "two"}
+	if !reflect.DeepEqual(flushed, want) {
+		t.Errorf("OnFlush function was called with %v, want %v", flushed, want)
+	}
+	if _, found := tc.Get("after"); !found {
+		t.Error("after was not found")
+	}
+}
+
+func TestNilValue(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("nil", nil, DefaultExpiration)
+
+	if x, found := tc.Get("nil"); !found || x != nil {
+		t.Errorf("Get(nil) returned (%v, %v), want (nil, true)", x, found)
+	}
+	if x, found := tc.Get("missing"); found || x != nil {
+		t.Errorf("Get(missing) returned (%v, %v), want (nil, false)", x, found)
+	}
+	if x, _, found := tc.GetWithExpiration("nil"); !found || x != nil {
+		t.Errorf("GetWithExpiration(nil) returned (%v, %v), want (nil, true)", x, found)
+	}
+	if m := tc.GetMany([]string{"nil", "missing"}); len(m) != 1 || m["nil"] != nil {
+		t.Errorf("GetMany returned %v, want map[nil:<nil>]", m)
+	}
+	if !tc.Has("nil") {
+		t.Error("Has(nil) returned false")
+	}
+	if err := tc.Add("nil", 1, DefaultExpiration); err == nil {
+		t.Error("Add of a key holding nil succeeded")
+	}
+	if x, found := tc.GetOrSet("nil", 1, DefaultExpiration); !found || x != nil {
+		t.Errorf("GetOrSet(nil) returned (%v, %v), want (nil, true)", x, found)
+	}
+	if !tc.CompareAndSwap("nil", nil, nil, DefaultExpiration) {
+		t.Error("CompareAndSwap of nil with nil failed")
+	}
+	if tc.CompareAndSwap("missing", nil, 1, DefaultExpiration) {
+		t.Error("CompareAndSwap of a missing key with nil succeeded")
+	}
+	if items := tc.Items(); len(items) != 1 || items["nil"].Object != nil {
+		t.Errorf("Items returned %v", items)
+	}
+	if x, ok := GetAs[interface{}](tc, "nil"); !ok || x != nil {
+		t.Errorf("GetAs[interface{}](nil) returned (%v, %v), want (nil, true)", x, ok)
+	}
+	if _, ok := GetAs[interface{}](tc, "missing"); ok {
+		t.Error("GetAs[interface{}](missing) returned true")
+	}
+	if m := ItemsAs[error](tc); len(m) != 1 {
+		t.Errorf("ItemsAs[error] returned %v, want map[nil:<nil>]", m)
+	}
+	if x, found := tc.GetAndDelete("nil"); !found || x != nil {
+		t.Errorf("GetAndDelete(nil) returned (%v, %v), want (nil, true)", x, found)
+	}
+	if _, found := tc.Get("nil"); found {
+		t.Error("nil was found after GetAndDelete")
+	}
+}
+
 func TestCacheSerialization(t *testing.T) {
 	tc := New(DefaultExpiration, 0)
 	testFillAndSerialize(t, tc)
@@ -1413,16 +1836,104 @@ func TestFileSerialization(t *testing.T) {
 	}
 }
 
+func TestSaveFileAtomic(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "cache.dat")
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", "a", DefaultExpiration)
+	if err := tc.SaveFileAtomic(fname); err != nil {
+		t.Fatal("Couldn't save cache file:", err)
+	}
+	tc.Set("b", "b", DefaultExpiration)
+	if err := tc.SaveFileAtomic(fname); err != nil {
+		t.Fatal("Couldn't save cache file again:", err)
+	}
+
+	oc := New(DefaultExpiration, 0)
+	if err := oc.LoadFile(fname); err != nil {
+		t.Fatal(err)
+	}
+	if n := oc.ItemCount(); n != 2 {
+		t.Errorf("ItemCount is %d, want 2", n)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(fname)); len(entries) != 1 {
+		t.Errorf("%d files were left in the directory, want 1", len(entries))
+	}
+}
+
+// failingWriter accepts n bytes and then fails.
+type failingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		n, _ := f.w.Write(p[:f.n])
+		f.n = 0
+		return n, errors.New("write failed")
+	}
+	f.n -= len(p)
+	return f.w.Write(p)
+}
+
+func TestSaveFileAtomicFailure(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "cache.dat")
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", "a", DefaultExpiration)
+	if err := tc.SaveFileAtomic(fname); err != nil {
+		t.Fatal("Couldn't save cache file:", err)
+	}
+	before, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		tc.Set("item"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	err = writeFileAtomic(fname, func(w io.Writer) error {
+		return tc.Save(&failingWriter{w: w, n: 64})
+	})
+	if err == nil {
+		t.Fatal("No error from a failed write")
+	}
+	after, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("The file was modified by a failed write")
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(fname)); len(entries) != 1 {
+		t.Errorf("%d files were left in the directory, want 1", len(entries))
+	}
+
+	tc.Set("chan", make(chan int), DefaultExpiration)
+	if err := tc.SaveFileAtomic(fname); err == nil {
+		t.Fatal("No error saving an unserializable item")
+	}
+	if after, _ := os.ReadFile(fname); !bytes.Equal(before, after) {
+		t.Error("The file was modified by a failed save")
+	}
+}
+
 func TestSerializeUnserializable(t *testing.T) {
 	tc := New(DefaultExpiration, 0)
 	ch := make(chan bool, 1)
 	ch <- true
 	tc.Set("chan", ch, DefaultExpiration)
 	fp := &bytes.Buffer{}
+	tc.Set("int", 1, DefaultExpiration)
 	err := tc.Save(fp) // this should fail gracefully
-	if err.Error() != "gob NewTypeObject can't handle type: chan bool" {
+	if err == nil {
+		t.Fatal("Save did not return an error")
+	}
+	if !strings.Contains(err.Error(), "gob NewTypeObject can't handle type: chan bool") {
 		t.Error("Error from Save was not gob NewTypeObject can't handle type chan bool:", err)
 	}
+	if !strings.Contains(err.Error(), "item chan of type chan bool") {
+		t.Error("Error from Save does not name the key and type of the item:", err)
+	}
 }
 
 func BenchmarkCacheGetExpiring(b *testing.B) {
@@ -1769,3 +2280,2278 @@ func TestGetWithExpiration(t *testing.T) {
 		t.Error("expiration for e is in the past")
 	}
 }
+
+func TestKeys(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, NoExpiration)
+	tc.Set("c", 3, 20*time.Millisecond)
+	tc.Set("d", 4, 50*time.Millisecond)
+	tc.Set("e", 5, time.Hour)
+
+	<-time.After(25 * time.Millisecond)
+
+	keys := tc.Keys()
+	sort.Strings(keys)
+	want := []string{"a", "b", "d", "e"}
+	if len(keys) != len(want) {
+		t.Fatalf("Keys returned %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Errorf("Keys returned %v, want %v", keys, want)
+			break
+		}
+	}
+}
+
+func TestSetWithSource(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetWithSource("a", 1, DefaultExpiration, "db")
+	tc.SetWithSource("b", 2, DefaultExpiration, "computed")
+	tc.Set("c", 3, DefaultExpiration)
+
+	for key, want := range map[string]string{"a": "db", "b": "computed", "c": ""} {
+		source, found := tc.GetSource(key)
+		if !found {
+			t.Errorf("%s was not found", key)
+		}
+		if source != want {
+			t.Errorf("source for %s is %q, want %q", key, source, want)
+		}
+	}
+
+	x, found := tc.Get("a")
+	if !found || x.(int) != 1 {
+		t.Error("a was not 1:", x)
+	}
+
+	tc.Set("a", 10, DefaultExpiration)
+	if source, _ := tc.GetSource("a"); source != "" {
+		t.Error("source for a was not cleared by Set:", source)
+	}
+
+	if _, found := tc.GetSource("d"); found {
+		t.Error("found source for d, which doesn't exist")
+	}
+}
+
+func TestSetWithMeta(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	meta := map[string]string{"source": "db", "version": "3"}
+	tc.SetWithMeta("a", 1, meta, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	meta["version"] = "4"
+
+	x, m, found := tc.GetWithMeta("a")
+	if !found || x.(int) != 1 {
+		t.Errorf("GetWithMeta(a) is %v, %v; want 1, true", x, found)
+	}
+	if len(m) != 2 || m["source"] != "db" || m["version"] != "3" {
+		t.Errorf("metadata for a is %v, want source db and version 3", m)
+	}
+	m["source"] = "changed"
+	if _, m, _ := tc.GetWithMeta("a"); m["source"] != "db" {
+		t.Error("metadata was changed through the returned map:", m)
+	}
+	if x, found := tc.Get("a"); !found || x.(int) != 1 {
+		t.Error("a was not 1:", x)
+	}
+
+	x, m, found = tc.GetWithMeta("b")
+	if !found || x.(int) != 2 || m != nil {
+		t.Errorf("GetWithMeta(b) is %v, %v, %v; want 2, nil, true", x, m, found)
+	}
+
+	tc.Set("a", 10, DefaultExpiration)
+	if _, m, _ := tc.GetWithMeta("a"); m != nil {
+		t.Error("metadata for a was not cleared by Set:", m)
+	}
+	if _, _, found := tc.GetWithMeta("c"); found {
+		t.Error("found c, which doesn't exist")
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	x, found := tc.GetOrSet("foo", "bar", DefaultExpiration)
+	if found {
+		t.Error("foo was found before it was set")
+	}
+	if x.(string) != "bar" {
+		t.Error("foo is not bar:", x)
+	}
+	x, found = tc.GetOrSet("foo", "baz", DefaultExpiration)
+	if !found {
+		t.Error("foo was not found after it was set")
+	}
+	if x.(string) != "bar" {
+		t.Error("foo was overwritten:", x)
+	}
+
+	tc.Set("exp", "old", 10*time.Millisecond)
+	<-time.After(15 * time.Millisecond)
+	x, found = tc.GetOrSet("exp", "new", DefaultExpiration)
+	if found || x.(string) != "new" {
+		t.Error("expired item was not replaced:", x)
+	}
+}
+
+func TestLoadOrStore(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	actual, loaded := tc.LoadOrStore("foo", "bar", DefaultExpiration)
+	if loaded || actual.(string) != "bar" {
+		t.Errorf("LoadOrStore of a new key returned (%v, %v), want (bar, false)", actual, loaded)
+	}
+	actual, loaded = tc.LoadOrStore("foo", "baz", DefaultExpiration)
+	if !loaded || actual.(string) != "bar" {
+		t.Errorf("LoadOrStore of an existing key returned (%v, %v), want (bar, true)", actual, loaded)
+	}
+	if x, _ := tc.Get("foo"); x.(string) != "bar" {
+		t.Error("foo is not bar:", x)
+	}
+
+	tc.Set("expired", "old", time.Millisecond)
+	<-time.After(5 * time.Millisecond)
+	actual, loaded = tc.LoadOrStore("expired", "new", DefaultExpiration)
+	if loaded || actual.(string) != "new" {
+		t.Errorf("LoadOrStore of an expired key returned (%v, %v), want (new, false)", actual, loaded)
+	}
+	if x, _ := tc.Get("expired"); x.(string) != "new" {
+		t.Error("expired is not new:", x)
+	}
+}
+
+func TestGetOrSetConcurrent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	n := 100
+	results := make([]interface{}, n)
+	stored := make([]bool, n)
+	wg := new(sync.WaitGroup)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			v, found := tc.GetOrSet("foo", i, DefaultExpiration)
+			results[i] = v
+			stored[i] = !found
+		}(i)
+	}
+	wg.Wait()
+
+	winners := 0
+	for i := 0; i < n; i++ {
+		if stored[i] {
+			winners++
+		}
+		if results[i] != results[0] {
+			t.Fatalf("caller %d observed %v, caller 0 observed %v", i, results[i], results[0])
+		}
+	}
+	if winners != 1 {
+		t.Errorf("%d callers stored a value, want 1", winners)
+	}
+	x, _ := tc.Get("foo")
+	if x != results[0] {
+		t.Error("stored value is not the one all callers observed:", x)
+	}
+}
+
+func TestDecrementAndDeleteAtZero(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Set("zero", int64(2), DefaultExpiration)
+	tc.Set("below", int64(1), DefaultExpiration)
+	tc.Set("above", int64(5), DefaultExpiration)
+
+	n, deleted, err := tc.DecrementAndDeleteAtZero("zero", 2)
+	if err != nil {
+		t.Error("Error decrementing zero:", err)
+	}
+	if n != 0 || !deleted {
+		t.Errorf("zero: got (%d, %v), want (0, true)", n, deleted)
+	}
+	if _, found := tc.Get("zero"); found {
+		t.Error("zero was found after being decremented to 0")
+	}
+
+	n, deleted, err = tc.DecrementAndDeleteAtZero("below", 3)
+	if err != nil {
+		t.Error("Error decrementing below:", err)
+	}
+	if n != -2 || !deleted {
+		t.Errorf("below: got (%d, %v), want (-2, true)", n, deleted)
+	}
+	if _, found := tc.Get("below"); found {
+		t.Error("below was found after being decremented below 0")
+	}
+
+	n, deleted, err = tc.DecrementAndDeleteAtZero("above", 1)
+	if err != nil {
+		t.Error("Error decrementing above:", err)
+	}
+	if n != 4 || deleted {
+		t.Errorf("above: got (%d, %v), want (4, false)", n, deleted)
+	}
+	if x, found := tc.Get("above"); !found || x.(int64) != 4 {
+		t.Error("above is not 4:", x)
+	}
+
+	if len(evicted) != 2 || evicted[0] != "zero" || evicted[1] != "below" {
+		t.Error("OnEvicted was not called for the deleted keys:", evicted)
+	}
+
+	if _, _, err = tc.DecrementAndDeleteAtZero("missing", 1); err == nil {
+		t.Error("Decrementing a missing key did not return an error")
+	}
+	tc.Set("int", 1, DefaultExpiration)
+	if _, _, err = tc.DecrementAndDeleteAtZero("int", 1); err == nil {
+		t.Error("Decrementing an int did not return an error")
+	}
+}
+
+func TestGetOrCompute(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("foo", "bar", DefaultExpiration)
+	x, err := tc.GetOrCompute("foo", DefaultExpiration, func() (interface{}, error) {
+		t.Error("fn was called for an existing key")
+		return nil, nil
+	})
+	if err != nil || x.(string) != "bar" {
+		t.Errorf("GetOrCompute returned (%v, %v), want (bar, nil)", x, err)
+	}
+
+	x, err = tc.GetOrCompute("baz", DefaultExpiration, func() (interface{}, error) {
+		return "qux", nil
+	})
+	if err != nil || x.(string) != "qux" {
+		t.Errorf("GetOrCompute returned (%v, %v), want (qux, nil)", x, err)
+	}
+	if x, found := tc.Get("baz"); !found || x.(string) != "qux" {
+		t.Error("computed value was not stored:", x)
+	}
+}
+
+func TestGetOrComputeError(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	computeErr := errors.New("compute failed")
+	_, err := tc.GetOrCompute("foo", DefaultExpiration, func() (interface{}, error) {
+		return nil, computeErr
+	})
+	if err != computeErr {
+		t.Error("GetOrCompute did not return the error from fn:", err)
+	}
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo was stored even though fn returned an error")
+	}
+}
+
+func TestGetOrComputePanic(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	recovered := make(chan interface{})
+	go func() {
+		defer func() {
+			recovered <- recover()
+		}()
+		tc.GetOrCompute("foo", DefaultExpiration, func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waited := make(chan error)
+	go func() {
+		v, err := tc.GetOrCompute("foo", DefaultExpiration, func() (interface{}, error) {
+			return "bar", nil
+		})
+		if v != nil {
+			t.Errorf("waiting caller received %v, want nil", v)
+		}
+		waited <- err
+	}()
+	<-time.After(20 * time.Millisecond)
+	close(release)
+
+	if r := <-recovered; r != "boom" {
+		t.Errorf("computing caller recovered %v, want boom", r)
+	}
+	if err := <-waited; !errors.Is(err, ErrComputePanicked) {
+		t.Errorf("waiting caller received error %v, want ErrComputePanicked", err)
+	}
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo was stored even though fn panicked")
+	}
+	v, err := tc.GetOrCompute("foo", DefaultExpiration, func() (interface{}, error) {
+		return "bar", nil
+	})
+	if err != nil || v != "bar" {
+		t.Errorf("GetOrCompute after the panic returned (%v, %v), want (bar, nil)", v, err)
+	}
+}
+
+func TestGetOrComputeConcurrent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var calls int32
+	release := make(chan struct{})
+	n := 50
+	results := make([]interface{}, n)
+	wg := new(sync.WaitGroup)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			v, err := tc.GetOrCompute("foo", DefaultExpiration, func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "bar", nil
+			})
+			if err != nil {
+				t.Error("GetOrCompute returned an error:", err)
+			}
+			results[i] = v
+		}(i)
+	}
+	<-time.After(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("fn was called %d times, want 1", n)
+	}
+	for i, v := range results {
+		if v != "bar" {
+			t.Errorf("caller %d received %v, want bar", i, v)
+		}
+	}
+}
+
+func TestGetOrComputeCtx(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return "bar", nil
+	}
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+	first := make(chan result, 1)
+	go func() {
+		v, err := tc.GetOrComputeCtx(context.Background(), "foo", DefaultExpiration, fn)
+		first <- result{v, err}
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan result, 1)
+	go func() {
+		v, err := tc.GetOrComputeCtx(ctx, "foo", DefaultExpiration, fn)
+		canceled <- result{v, err}
+	}()
+	cancel()
+	if r := <-canceled; r.err != context.Canceled || r.v != nil {
+		t.Errorf("canceled waiter received (%v, %v), want (nil, %v)", r.v, r.err, context.Canceled)
+	}
+
+	close(release)
+	if r := <-first; r.err != nil || r.v != "bar" {
+		t.Errorf("waiter received (%v, %v), want (bar, nil)", r.v, r.err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("fn was called %d times, want 1", n)
+	}
+	if x, found := tc.Get("foo"); !found || x != "bar" {
+		t.Error("computed value was not stored:", x)
+	}
+}
+
+func TestGetOrComputeCtxPanic(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	v, err := tc.GetOrComputeCtx(ctx, "foo", DefaultExpiration, func(ctx context.Context) (interface{}, error) {
+		panic("boom")
+	})
+	if v != nil || !errors.Is(err, ErrComputePanicked) {
+		t.Errorf("GetOrComputeCtx returned (%v, %v), want (nil, ErrComputePanicked)", v, err)
+	}
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo was stored even though fn panicked")
+	}
+}
+
+func TestGetOrComputeCtxCanceledCaller(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := tc.GetOrComputeCtx(ctx, "foo", DefaultExpiration, func(ctx context.Context) (interface{}, error) {
+		<-release
+		return "bar", ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("GetOrComputeCtx returned %v, want %v", err, context.Canceled)
+	}
+
+	// The computation started by the canceled caller is shared with the next.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v, err := tc.GetOrComputeCtx(context.Background(), "foo", DefaultExpiration, func(context.Context) (interface{}, error) {
+			t.Error("fn was called again while a computation was in flight")
+			return nil, nil
+		})
+		if err != nil || v != "bar" {
+			t.Errorf("GetOrComputeCtx returned (%v, %v), want (bar, nil)", v, err)
+		}
+	}()
+	close(release)
+	<-done
+}
+
+// fillEvictionQueue sets up tc so that its single eviction worker is blocked
+// handling "a" and its queue of size one is full with "b". The worker is
+// released by closing the returned channel.
+func fillEvictionQueue(tc *Cache, policy EvictionOverflowPolicy, evicted chan<- string) chan struct{} {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	tc.OnEvictedAsync(func(k string, v interface{}) {
+		if k == "a" {
+			close(started)
+			<-release
+		}
+		evicted <- k
+	}, 1, 1, policy)
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+	tc.Delete("a")
+	<-started
+	tc.Delete("b")
+	return release
+}
+
+func TestOnEvictedConcurrentReplace(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	f := func(k string, v interface{}) {}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			switch i % 3 {
+			case 0:
+				tc.OnEvicted(f)
+			case 1:
+				tc.OnEvictedAsync(f, 1, 1, OverflowDrop)
+			case 2:
+				tc.OnExpired(f)
+			}
+		}
+	}()
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa(g) + "-" + strconv.Itoa(i)
+				tc.Set(key, i, DefaultExpiration)
+				tc.Delete(key)
+				tc.Set(key, i, time.Nanosecond)
+				tc.DeleteExpired()
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(stop)
+	<-done
+	tc.OnEvicted(nil)
+}
+
+func TestOnEvictedAsyncBlock(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	evicted := make(chan string, 3)
+	release := fillEvictionQueue(tc, OverflowBlock, evicted)
+	deleted := make(chan struct{})
+	go func() {
+		tc.Delete("c")
+		close(deleted)
+	}()
+	select {
+	case <-deleted:
+		t.Fatal("Delete returned while the eviction queue was full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-deleted
+	for _, want := range []string{"a", "b", "c"} {
+		if k := <-evicted; k != want {
+			t.Errorf("evicted %s, want %s", k, want)
+		}
+	}
+	if n := tc.DroppedEvictions(); n != 0 {
+		t.Errorf("DroppedEvictions is %d, want 0", n)
+	}
+	tc.OnEvicted(nil)
+}
+
+func TestOnEvictedAsyncDrop(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	evicted := make(chan string, 3)
+	release := fillEvictionQueue(tc, OverflowDrop, evicted)
+	tc.Delete("c")
+	if n := tc.DroppedEvictions(); n != 1 {
+		t.Errorf("DroppedEvictions is %d, want 1", n)
+	}
+	close(release)
+	for _, want := range []string{"a", "b"} {
+		if k := <-evicted; k != want {
+			t.Errorf("evicted %s, want %s", k, want)
+		}
+	}
+	select {
+	case k := <-evicted:
+		t.Error("dropped event was delivered:", k)
+	case <-time.After(10 * time.Millisecond):
+	}
+	tc.OnEvicted(nil)
+}
+
+func TestOnEvictedAsyncRunInline(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	evicted := make(chan string, 3)
+	release := fillEvictionQueue(tc, OverflowRunInline, evicted)
+	tc.Delete("c")
+	select {
+	case k := <-evicted:
+		if k != "c" {
+			t.Errorf("evicted %s inline, want c", k)
+		}
+	default:
+		t.Error("OnEvicted was not run inline when the queue was full")
+	}
+	close(release)
+	for _, want := range []string{"a", "b"} {
+		if k := <-evicted; k != want {
+			t.Errorf("evicted %s, want %s", k, want)
+		}
+	}
+	if n := tc.DroppedEvictions(); n != 0 {
+		t.Errorf("DroppedEvictions is %d, want 0", n)
+	}
+	tc.OnEvicted(nil)
+}
+
+func TestGetAndDelete(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Set("foo", "bar", DefaultExpiration)
+	x, found := tc.GetAndDelete("foo")
+	if !found || x.(string) != "bar" {
+		t.Errorf("GetAndDelete returned (%v, %v), want (bar, true)", x, found)
+	}
+	if _, found = tc.Get("foo"); found {
+		t.Error("foo was found after GetAndDelete")
+	}
+	x, found = tc.GetAndDelete("foo")
+	if found || x != nil {
+		t.Errorf("second GetAndDelete returned (%v, %v), want (nil, false)", x, found)
+	}
+	if len(evicted) != 1 || evicted[0] != "foo" {
+		t.Error("OnEvicted was not called once for foo:", evicted)
+	}
+}
+
+func TestPop(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("foo", "bar", time.Hour)
+	_, want, _ := tc.GetWithExpiration("foo")
+	x, exp, found := tc.Pop("foo")
+	if !found || x.(string) != "bar" {
+		t.Errorf("Pop returned (%v, %v), want (bar, true)", x, found)
+	}
+	if !exp.Equal(want) {
+		t.Errorf("Pop returned expiration %v, want %v", exp, want)
+	}
+	x, exp, found = tc.Pop("foo")
+	if found || x != nil || !exp.IsZero() {
+		t.Errorf("second Pop returned (%v, %v, %v), want (nil, zero, false)", x, exp, found)
+	}
+
+	tc.Set("forever", 1, NoExpiration)
+	if _, exp, found := tc.Pop("forever"); !found || !exp.IsZero() {
+		t.Errorf("Pop of forever returned (%v, %v), want (zero, true)", exp, found)
+	}
+	tc.Set("expired", 1, time.Millisecond)
+	<-time.After(5 * time.Millisecond)
+	if _, _, found := tc.Pop("expired"); found {
+		t.Error("Pop found an expired item")
+	}
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("ItemCount is %d, want 0", n)
+	}
+}
+
+func TestGetAndDeleteConcurrent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("token", "secret", DefaultExpiration)
+	var winners int32
+	n := 50
+	wg := new(sync.WaitGroup)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			if _, found := tc.GetAndDelete("token"); found {
+				atomic.AddInt32(&winners, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Errorf("%d goroutines received the value, want 1", winners)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	tc := New(50*time.Millisecond, 0)
+	tc.Set("foo", "bar", 30*time.Millisecond)
+	tc.Set("baz", "qux", 30*time.Millisecond)
+
+	<-time.After(20 * time.Millisecond)
+	if !tc.Touch("foo", 30*time.Millisecond) {
+		t.Error("Touch did not find foo")
+	}
+	if !tc.Touch("baz", NoExpiration) {
+		t.Error("Touch did not find baz")
+	}
+
+	<-time.After(20 * time.Millisecond)
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Error("foo did not survive past its original expiration:", x)
+	}
+	if _, found := tc.Get("baz"); !found {
+		t.Error("baz did not survive after being touched with NoExpiration")
+	}
+
+	<-time.After(20 * time.Millisecond)
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo was found after its extended expiration")
+	}
+	if tc.Touch("foo", DefaultExpiration) {
+		t.Error("Touch succeeded for expired item foo")
+	}
+	if tc.Touch("missing", DefaultExpiration) {
+		t.Error("Touch succeeded for missing key")
+	}
+}
+
+func TestGetAndTouch(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("foo", "bar", 30*time.Millisecond)
+	tc.Set("exp", "old", 10*time.Millisecond)
+
+	<-time.After(20 * time.Millisecond)
+	x, found := tc.GetAndTouch("foo", 30*time.Millisecond)
+	if !found || x.(string) != "bar" {
+		t.Errorf("GetAndTouch returned (%v, %v), want (bar, true)", x, found)
+	}
+	x, found = tc.GetAndTouch("exp", time.Hour)
+	if found || x != nil {
+		t.Errorf("GetAndTouch of an expired item returned (%v, %v), want (nil, false)", x, found)
+	}
+	x, found = tc.GetAndTouch("missing", time.Hour)
+	if found || x != nil {
+		t.Errorf("GetAndTouch of a missing key returned (%v, %v), want (nil, false)", x, found)
+	}
+
+	<-time.After(20 * time.Millisecond)
+	if _, found := tc.Get("foo"); !found {
+		t.Error("foo did not survive past its original expiration")
+	}
+	if _, found := tc.Get("exp"); found {
+		t.Error("expired item was resurrected by GetAndTouch")
+	}
+}
+
+func TestMaxItems(t *testing.T) {
+	tc := New(DefaultExpiration, 0, WithMaxItems(10))
+	if n := tc.MaxItems(); n != 10 {
+		t.Errorf("MaxItems is %d, want 10", n)
+	}
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	for i := 0; i < 25; i++ {
+		tc.Set("key"+strconv.Itoa(i), i, DefaultExpiration)
+		if n := tc.ItemCount(); n > 10 {
+			t.Fatalf("ItemCount is %d after %d sets, want at most 10", n, i+1)
+		}
+	}
+	if n := tc.ItemCount(); n != 10 {
+		t.Errorf("ItemCount is %d, want 10", n)
+	}
+	if len(evicted) != 15 {
+		t.Errorf("OnEvicted was called %d times, want 15", len(evicted))
+	}
+	for _, k := range evicted {
+		if _, found := tc.Get(k); found {
+			t.Errorf("evicted key %s was found", k)
+		}
+	}
+
+	// Overwriting an existing key doesn't evict anything.
+	key := tc.Keys()[0]
+	tc.Set(key, "new", DefaultExpiration)
+	if len(evicted) != 15 {
+		t.Error("overwriting an existing key evicted an item")
+	}
+	if x, _ := tc.Get(key); x != "new" {
+		t.Errorf("%s was not overwritten: %v", key, x)
+	}
+
+	if err := tc.Add("added", 1, DefaultExpiration); err != nil {
+		t.Error("Couldn't add to a full cache:", err)
+	}
+	if n := tc.ItemCount(); n != 10 {
+		t.Errorf("ItemCount is %d after Add, want 10", n)
+	}
+}
+
+func TestMaxItemsUnlimited(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if n := tc.MaxItems(); n != 0 {
+		t.Errorf("MaxItems is %d, want 0", n)
+	}
+	for i := 0; i < 100; i++ {
+		tc.Set("key"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if n := tc.ItemCount(); n != 100 {
+		t.Errorf("ItemCount is %d, want 100", n)
+	}
+}
+
+func TestRotateValue(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if tc.RotateValue("foo", "v1", DefaultExpiration, "foo.prev", time.Hour) {
+		t.Error("RotateValue archived a value for a missing key")
+	}
+	if _, found := tc.Get("foo.prev"); found {
+		t.Error("foo.prev was set for a missing key")
+	}
+
+	if !tc.RotateValue("foo", "v2", DefaultExpiration, "foo.prev", 50*time.Millisecond) {
+		t.Error("RotateValue did not archive the previous value")
+	}
+	x, found := tc.Get("foo")
+	if !found || x.(string) != "v2" {
+		t.Error("foo is not v2:", x)
+	}
+	x, exp, found := tc.GetWithExpiration("foo.prev")
+	if !found || x.(string) != "v1" {
+		t.Error("foo.prev is not v1:", x)
+	}
+	if d := time.Until(exp); d <= 0 || d > 50*time.Millisecond {
+		t.Error("foo.prev does not have the archive expiration:", exp)
+	}
+
+	<-time.After(60 * time.Millisecond)
+	if _, found := tc.Get("foo.prev"); found {
+		t.Error("foo.prev was found after its archive expiration")
+	}
+	if _, found := tc.Get("foo"); !found {
+		t.Error("foo was not found")
+	}
+}
+
+func TestSetIf(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	greater := func(n int) func(interface{}, bool) bool {
+		return func(current interface{}, found bool) bool {
+			if !found {
+				return true
+			}
+			v, ok := current.(int)
+			return ok && n > v
+		}
+	}
+
+	if !tc.SetIf("max", 5, DefaultExpiration, greater(5)) {
+		t.Error("SetIf did not set a missing key")
+	}
+	if tc.SetIf("max", 3, DefaultExpiration, greater(3)) {
+		t.Error("SetIf set a lower value")
+	}
+	if !tc.SetIf("max", 8, DefaultExpiration, greater(8)) {
+		t.Error("SetIf did not set a higher value")
+	}
+	if x, _ := tc.Get("max"); x.(int) != 8 {
+		t.Error("max is not 8:", x)
+	}
+
+	present := func(current interface{}, found bool) bool {
+		return found
+	}
+	if tc.SetIf("missing", 1, DefaultExpiration, present) {
+		t.Error("SetIf set a missing key when presence was required")
+	}
+	if _, found := tc.Get("missing"); found {
+		t.Error("missing was set")
+	}
+
+	isString := func(current interface{}, found bool) bool {
+		_, ok := current.(string)
+		return ok
+	}
+	tc.Set("str", "a", DefaultExpiration)
+	if !tc.SetIf("str", "b", DefaultExpiration, isString) {
+		t.Error("SetIf did not replace a string value")
+	}
+	if tc.SetIf("max", "b", DefaultExpiration, isString) {
+		t.Error("SetIf replaced a non-string value")
+	}
+	if x, _ := tc.Get("str"); x.(string) != "b" {
+		t.Error("str is not b:", x)
+	}
+}
+
+func TestOnExpired(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var evicted, expired []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.OnExpired(func(k string, v interface{}) {
+		expired = append(expired, k)
+	})
+	tc.Set("deleted", 1, DefaultExpiration)
+	tc.Set("expired", 2, time.Millisecond)
+	tc.Set("overwritten", 3, DefaultExpiration)
+	tc.Set("overwritten", 4, DefaultExpiration)
+	<-time.After(5 * time.Millisecond)
+
+	tc.Delete("deleted")
+	tc.DeleteExpired()
+	if len(evicted) != 1 || evicted[0] != "deleted" {
+		t.Error("OnEvicted was not called for deleted only:", evicted)
+	}
+	if len(expired) != 1 || expired[0] != "expired" {
+		t.Error("OnExpired was not called for expired only:", expired)
+	}
+}
+
+func TestOnExpiredIndependent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var expired []string
+	tc.OnExpired(func(k string, v interface{}) {
+		expired = append(expired, k)
+	})
+	tc.Set("deleted", 1, DefaultExpiration)
+	tc.Set("expired", 2, time.Millisecond)
+	<-time.After(5 * time.Millisecond)
+	tc.Delete("deleted")
+	tc.DeleteExpired()
+	if len(expired) != 1 || expired[0] != "expired" {
+		t.Error("OnExpired was not called for expired only:", expired)
+	}
+
+	// Without an OnExpired function, OnEvicted is called for expired items.
+	tc = New(DefaultExpiration, 0)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Set("expired", 2, time.Millisecond)
+	<-time.After(5 * time.Millisecond)
+	tc.DeleteExpired()
+	if len(evicted) != 1 || evicted[0] != "expired" {
+		t.Error("OnEvicted was not called for expired:", evicted)
+	}
+}
+
+func TestFlushExcept(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Set("pinned:a", 1, time.Hour)
+	tc.Set("pinned:b", 2, NoExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+	tc.Set("d", 4, time.Hour)
+	_, expA, _ := tc.GetWithExpiration("pinned:a")
+
+	n := tc.FlushExcept(func(k string, item Item) bool {
+		return strings.HasPrefix(k, "pinned:")
+	})
+	if n != 2 {
+		t.Errorf("FlushExcept removed %d items, want 2", n)
+	}
+	sort.Strings(evicted)
+	if len(evicted) != 2 || evicted[0] != "c" || evicted[1] != "d" {
+		t.Error("OnEvicted was not called for the removed items:", evicted)
+	}
+	for _, k := range []string{"c", "d"} {
+		if _, found := tc.Get(k); found {
+			t.Errorf("%s was found after FlushExcept", k)
+		}
+	}
+	x, exp, found := tc.GetWithExpiration("pinned:a")
+	if !found || x.(int) != 1 || !exp.Equal(expA) {
+		t.Errorf("pinned:a is (%v, %v, %v), want (1, %v, true)", x, exp, found, expA)
+	}
+	x, exp, found = tc.GetWithExpiration("pinned:b")
+	if !found || x.(int) != 2 || !exp.IsZero() {
+		t.Errorf("pinned:b is (%v, %v, %v), want (2, zero time, true)", x, exp, found)
+	}
+}
+
+func TestFlushOnEvicted(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	evicted := map[string]interface{}{}
+	calls := 0
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted[k] = v
+		calls++
+	})
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", "two", DefaultExpiration)
+	tc.Set("c", 3.0, DefaultExpiration)
+	tc.Flush()
+
+	if calls != 3 {
+		t.Errorf("OnEvicted was called %d times, want 3", calls)
+	}
+	want := map[string]interface{}{"a": 1, "b": "two", "c": 3.0}
+	for k, v := range want {
+		if evicted[k] != v {
+			t.Errorf("OnEvicted was called with %s=%v, want %v", k, evicted[k], v)
+		}
+	}
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("ItemCount is %d after Flush, want 0", n)
+	}
+}
+
+func TestGetDeletesExpired(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Set("a", 1, time.Millisecond)
+	tc.Set("b", 2, time.Millisecond)
+	tc.Set("c", 3, DefaultExpiration)
+	<-time.After(5 * time.Millisecond)
+
+	if _, found := tc.Get("a"); found {
+		t.Error("a was found after it expired")
+	}
+	if _, _, found := tc.GetWithExpiration("b"); found {
+		t.Error("b was found after it expired")
+	}
+	if _, found := tc.Get("c"); !found {
+		t.Error("c was not found")
+	}
+	if len(evicted) != 2 || evicted[0] != "a" || evicted[1] != "b" {
+		t.Error("OnEvicted was not called for the expired items:", evicted)
+	}
+	if n := tc.ItemCount(); n != 1 {
+		t.Errorf("ItemCount is %d, want 1", n)
+	}
+
+	var expired []string
+	tc.OnExpired(func(k string, v interface{}) {
+		expired = append(expired, k)
+	})
+	tc.Set("d", 4, time.Millisecond)
+	<-time.After(5 * time.Millisecond)
+	tc.Get("d")
+	if len(expired) != 1 || expired[0] != "d" {
+		t.Error("OnExpired was not called for d:", expired)
+	}
+	if len(evicted) != 2 {
+		t.Error("OnEvicted was called for d:", evicted)
+	}
+}
+
+func TestSetManyGetMany(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetMany(map[string]interface{}{
+		"a": 1,
+		"b": "two",
+	}, DefaultExpiration)
+	tc.SetMany(map[string]interface{}{
+		"c": 3,
+		"d": 4,
+	}, time.Millisecond)
+	<-time.After(5 * time.Millisecond)
+
+	m := tc.GetMany([]string{"a", "b", "c", "d", "e"})
+	if len(m) != 2 {
+		t.Errorf("GetMany returned %d items, want 2: %v", len(m), m)
+	}
+	if m["a"] != 1 || m["b"] != "two" {
+		t.Error("GetMany returned the wrong values:", m)
+	}
+	for _, k := range []string{"c", "d", "e"} {
+		if _, ok := m[k]; ok {
+			t.Errorf("GetMany returned %s, which expired or doesn't exist", k)
+		}
+	}
+}
+
+func BenchmarkCacheSetMany(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	m := make(map[string]interface{}, 20)
+	for i := 0; i < 20; i++ {
+		m["foo"+strconv.Itoa(i)] = "bar"
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.SetMany(m, DefaultExpiration)
+	}
+}
+
+func BenchmarkCacheSetManyLoop(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	m := make(map[string]interface{}, 20)
+	for i := 0; i < 20; i++ {
+		m["foo"+strconv.Itoa(i)] = "bar"
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		for k, v := range m {
+			tc.Set(k, v, DefaultExpiration)
+		}
+	}
+}
+
+func BenchmarkCacheGetMany(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = "foo" + strconv.Itoa(i)
+		tc.Set(keys[i], "bar", DefaultExpiration)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.GetMany(keys)
+	}
+}
+
+func BenchmarkCacheGetManyLoop(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = "foo" + strconv.Itoa(i)
+		tc.Set(keys[i], "bar", DefaultExpiration)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		m := make(map[string]interface{}, len(keys))
+		for _, k := range keys {
+			if v, found := tc.Get(k); found {
+				m[k] = v
+			}
+		}
+	}
+}
+
+func TestJSONSerialization(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("string", "a", DefaultExpiration)
+	tc.Set("int", 42, DefaultExpiration)
+	tc.Set("bool", true, time.Hour)
+	tc.Set("map", map[string]interface{}{"x": 1, "y": "z"}, DefaultExpiration)
+	tc.Set("existing", "from save", DefaultExpiration)
+	_, exp, _ := tc.GetWithExpiration("bool")
+
+	fp := &bytes.Buffer{}
+	if err := tc.SaveJSON(fp); err != nil {
+		t.Fatal("Couldn't save cache as JSON:", err)
+	}
+
+	oc := New(DefaultExpiration, 0)
+	oc.Set("existing", "kept", DefaultExpiration)
+	if err := oc.LoadJSON(fp); err != nil {
+		t.Fatal("Couldn't load cache from JSON:", err)
+	}
+
+	if x, _ := oc.Get("string"); x != "a" {
+		t.Error("string is not a:", x)
+	}
+	if x, _ := oc.Get("int"); x != float64(42) {
+		t.Errorf("int is %#v, want float64(42)", x)
+	}
+	x, bexp, _ := oc.GetWithExpiration("bool")
+	if x != true {
+		t.Error("bool is not true:", x)
+	}
+	if !bexp.Equal(exp) {
+		t.Errorf("bool expires at %v, want %v", bexp, exp)
+	}
+	x, _ = oc.Get("map")
+	m, ok := x.(map[string]interface{})
+	if !ok || m["x"] != float64(1) || m["y"] != "z" {
+		t.Errorf("map is %#v", x)
+	}
+	if x, _ := oc.Get("existing"); x != "kept" {
+		t.Error("existing was overwritten:", x)
+	}
+
+	if err := oc.LoadJSON(strings.NewReader("{")); err == nil {
+		t.Error("Loading invalid JSON did not return an error")
+	}
+}
+
+func TestSerializeUnserializableNested(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < 10; i++ {
+		tc.Set("ok"+strconv.Itoa(i), map[string]interface{}{"n": i}, DefaultExpiration)
+	}
+	tc.Set("bad", map[string]interface{}{"ch": make(chan int)}, DefaultExpiration)
+	err := tc.Save(&bytes.Buffer{})
+	if err == nil {
+		t.Fatal("Save did not return an error")
+	}
+	if !strings.Contains(err.Error(), "item bad of type map[string]interface {}") {
+		t.Error("Error from Save does not name the key and type of the item:", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	for _, overwrite := range []bool{false, true} {
+		tc := New(DefaultExpiration, 0)
+		tc.Set("a", "dst", DefaultExpiration)
+		tc.Set("expired", "dst", time.Millisecond)
+		oc := New(DefaultExpiration, 0)
+		oc.Set("a", "src", DefaultExpiration)
+		oc.Set("b", "src", time.Hour)
+		oc.Set("c", "src", time.Millisecond)
+		oc.Set("expired", "src", DefaultExpiration)
+		_, bexp, _ := oc.GetWithExpiration("b")
+		<-time.After(5 * time.Millisecond)
+
+		tc.Merge(oc, overwrite)
+
+		want := "dst"
+		if overwrite {
+			want = "src"
+		}
+		if x, _ := tc.Get("a"); x != want {
+			t.Errorf("overwrite=%v: a is %v, want %s", overwrite, x, want)
+		}
+		x, exp, found := tc.GetWithExpiration("b")
+		if !found || x != "src" || !exp.Equal(bexp) {
+			t.Errorf("overwrite=%v: b is (%v, %v, %v), want (src, %v, true)", overwrite, x, exp, found, bexp)
+		}
+		if _, found := tc.Get("c"); found {
+			t.Errorf("overwrite=%v: expired source item c was merged", overwrite)
+		}
+		if x, _ := tc.Get("expired"); x != "src" {
+			t.Errorf("overwrite=%v: expired destination item was not replaced: %v", overwrite, x)
+		}
+	}
+}
+
+func TestMergeWithCallback(t *testing.T) {
+	tc := New(DefaultExpiration, 0, WithMaxItems(1))
+	oc := New(DefaultExpiration, 0)
+	var evicted []string
+	oc.SetWithCallback("a", 1, DefaultExpiration, func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+
+	tc.Merge(oc, false)
+	tc.Set("b", 2, DefaultExpiration)
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Errorf("evicted %v, want [a]", evicted)
+	}
+}
+
+func TestMergeConcurrent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	oc := New(DefaultExpiration, 0)
+	tc.Set("a", 1, DefaultExpiration)
+	oc.Set("b", 2, DefaultExpiration)
+	wg := new(sync.WaitGroup)
+	wg.Add(200)
+	for i := 0; i < 100; i++ {
+		go func() {
+			defer wg.Done()
+			tc.Merge(oc, true)
+		}()
+		go func() {
+			defer wg.Done()
+			oc.Merge(tc, true)
+		}()
+	}
+	wg.Wait()
+	if tc.ItemCount() != 2 || oc.ItemCount() != 2 {
+		t.Errorf("ItemCounts are %d and %d, want 2", tc.ItemCount(), oc.ItemCount())
+	}
+}
+
+func TestMostAccessed(t *testing.T) {
+	tc := New(DefaultExpiration, 0, WithAccessTracking())
+	counts := map[string]int{"a": 5, "b": 2, "c": 9, "d": 0, "e": 1}
+	for k, n := range counts {
+		tc.Set(k, n, DefaultExpiration)
+		for i := 0; i < n; i++ {
+			tc.Get(k)
+		}
+	}
+	tc.Get("missing")
+
+	top := tc.MostAccessed(3)
+	want := []KeyCount{{"c", 9}, {"a", 5}, {"b", 2}}
+	if len(top) != len(want) {
+		t.Fatalf("MostAccessed(3) is %v, want %v", top, want)
+	}
+	for i := range want {
+		if top[i] != want[i] {
+			t.Errorf("MostAccessed(3) is %v, want %v", top, want)
+			break
+		}
+	}
+	if all := tc.MostAccessed(10); len(all) != 4 {
+		t.Errorf("MostAccessed(10) is %v, want 4 accessed keys", all)
+	}
+
+	tc.Delete("c")
+	tc.Set("c", 0, DefaultExpiration)
+	tc.Get("c")
+	if top = tc.MostAccessed(1); len(top) != 1 || top[0] != (KeyCount{"a", 5}) {
+		t.Errorf("MostAccessed(1) after deleting c is %v, want [{a 5}]", top)
+	}
+
+	tc.Flush()
+	if top = tc.MostAccessed(10); len(top) != 0 {
+		t.Errorf("MostAccessed after Flush is %v, want none", top)
+	}
+}
+
+func TestMostAccessedDisabled(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("foo", "bar", DefaultExpiration)
+	tc.Get("foo")
+	if top := tc.MostAccessed(1); top != nil {
+		t.Errorf("MostAccessed(1) is %v without access tracking, want nil", top)
+	}
+	if hits := tc.Stats().Hits; hits != 1 {
+		t.Errorf("Hits is %d without access tracking, want 1", hits)
+	}
+}
+
+func TestMostAccessedConcurrent(t *testing.T) {
+	tc := New(DefaultExpiration, 0, WithAccessTracking())
+	tc.Set("foo", "bar", DefaultExpiration)
+	wg := new(sync.WaitGroup)
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tc.Get("foo")
+			}
+		}()
+	}
+	wg.Wait()
+	if top := tc.MostAccessed(1); len(top) != 1 || top[0].Count != 1000 {
+		t.Errorf("MostAccessed(1) is %v, want [{foo 1000}]", top)
+	}
+}
+
+func TestRename(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("upload-tmp", "data", 50*time.Millisecond)
+	tc.Set("upload-1", "old", NoExpiration)
+	_, want, _ := tc.GetWithExpiration("upload-tmp")
+
+	if !tc.Rename("upload-tmp", "upload-1") {
+		t.Fatal("Rename returned false for an existing key")
+	}
+	if _, found := tc.Get("upload-tmp"); found {
+		t.Error("upload-tmp was found after it was renamed")
+	}
+	x, exp, found := tc.GetWithExpiration("upload-1")
+	if !found || x.(string) != "data" {
+		t.Fatalf("upload-1 is %v (found: %v), want data", x, found)
+	}
+	if !exp.Equal(want) {
+		t.Errorf("upload-1 expires at %v, want %v", exp, want)
+	}
+	if n := tc.ItemCount(); n != 1 {
+		t.Errorf("ItemCount is %d after Rename, want 1", n)
+	}
+
+	<-time.After(60 * time.Millisecond)
+	if _, found := tc.Get("upload-1"); found {
+		t.Error("renamed item didn't keep its expiration time")
+	}
+}
+
+func TestRenameMissing(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("expired", 3, time.Nanosecond)
+	<-time.After(time.Millisecond)
+
+	if tc.Rename("a", "b") {
+		t.Error("Rename returned true for a missing key")
+	}
+	if tc.Rename("expired", "b") {
+		t.Error("Rename returned true for an expired key")
+	}
+	if x, found := tc.Get("b"); !found || x.(int) != 2 {
+		t.Errorf("b is %v (found: %v) after failed Renames, want 2", x, found)
+	}
+}
+
+func TestWaitGetPresent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("foo", "bar", DefaultExpiration)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	x, err := tc.WaitGet(ctx, "foo")
+	if err != nil {
+		t.Fatal("WaitGet returned an error for a present key:", err)
+	}
+	if x.(string) != "bar" {
+		t.Error("foo is not bar:", x)
+	}
+}
+
+func TestWaitGetSetLater(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+
+	const waiters = 5
+	results := make(chan interface{}, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			x, err := tc.WaitGet(context.Background(), "foo")
+			if err != nil {
+				t.Error("WaitGet returned an error:", err)
+			}
+			results <- x
+		}()
+	}
+	<-time.After(10 * time.Millisecond)
+	tc.Set("bar", "other", DefaultExpiration)
+	tc.Set("foo", "bar", DefaultExpiration)
+
+	for i := 0; i < waiters; i++ {
+		select {
+		case x := <-results:
+			if x != "bar" {
+				t.Error("WaitGet returned", x, "instead of bar")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("WaitGet didn't return after the key was set")
+		}
+	}
+}
+
+func TestWaitGetTimeout(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	x, err := tc.WaitGet(ctx, "foo")
+	if err != context.DeadlineExceeded {
+		t.Errorf("WaitGet returned error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if x != nil {
+		t.Error("WaitGet returned", x, "after timing out")
+	}
+	if n := len(tc.waiters); n != 0 {
+		t.Errorf("%d waiters are left after WaitGet timed out", n)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("counter", 1, DefaultExpiration)
+
+	if !tc.CompareAndSwap("counter", 1, 2, DefaultExpiration) {
+		t.Error("CompareAndSwap failed although the value matched")
+	}
+	if x, _ := tc.Get("counter"); x.(int) != 2 {
+		t.Error("counter is not 2:", x)
+	}
+
+	if tc.CompareAndSwap("counter", 1, 3, DefaultExpiration) {
+		t.Error("CompareAndSwap succeeded although the value didn't match")
+	}
+	if tc.CompareAndSwap("counter", int64(2), 3, DefaultExpiration) {
+		t.Error("CompareAndSwap succeeded although the type didn't match")
+	}
+	if x, _ := tc.Get("counter"); x.(int) != 2 {
+		t.Error("counter is not 2 after failed swaps:", x)
+	}
+
+	if tc.CompareAndSwap("missing", nil, 1, DefaultExpiration) {
+		t.Error("CompareAndSwap succeeded for a missing key")
+	}
+	if _, found := tc.Get("missing"); found {
+		t.Error("missing was set by a failed CompareAndSwap")
+	}
+}
+
+func TestCompareAndSwapNotComparable(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	s := []int{1}
+	tc.Set("slice", s, DefaultExpiration)
+	if tc.CompareAndSwap("slice", s, []int{2}, DefaultExpiration) {
+		t.Error("CompareAndSwap succeeded for a slice")
+	}
+	tc.Set("struct", struct{ v interface{} }{s}, DefaultExpiration)
+	if tc.CompareAndSwap("struct", struct{ v interface{} }{s}, 2, DefaultExpiration) {
+		t.Error("CompareAndSwap succeeded for a struct containing a slice")
+	}
+	tc.Set("nil", nil, DefaultExpiration)
+	if !tc.CompareAndSwap("nil", nil, 1, DefaultExpiration) {
+		t.Error("CompareAndSwap failed for a nil value")
+	}
+}
+
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("counter", 0, DefaultExpiration)
+	wg := new(sync.WaitGroup)
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; {
+				x, _ := tc.Get("counter")
+				if tc.CompareAndSwap("counter", x, x.(int)+1, DefaultExpiration) {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if x, _ := tc.Get("counter"); x.(int) != 1000 {
+		t.Error("counter is not 1000:", x)
+	}
+}
+
+func TestAppendString(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	s, err := tc.AppendString("log", "a", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error creating log:", err)
+	}
+	if s != "a" {
+		t.Errorf("log is %q after creating it, want %q", s, "a")
+	}
+	s, err = tc.AppendString("log", "bc", NoExpiration)
+	if err != nil {
+		t.Fatal("Error appending to log:", err)
+	}
+	if s != "abc" {
+		t.Errorf("log is %q after appending, want %q", s, "abc")
+	}
+
+	<-time.After(60 * time.Millisecond)
+	if x, found := tc.Get("log"); !found || x.(string) != "abc" {
+		t.Errorf("log is %v (found: %v), want abc without expiration", x, found)
+	}
+}
+
+func TestAppendStringWrongType(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("int", 1, DefaultExpiration)
+	if _, err := tc.AppendString("int", "a", DefaultExpiration); err == nil {
+		t.Error("No error appending to an int")
+	}
+	if x, _ := tc.Get("int"); x.(int) != 1 {
+		t.Error("int is not 1:", x)
+	}
+}
+
+func TestAppendStringConcurrent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	wg := new(sync.WaitGroup)
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := tc.AppendString("log", "xy", DefaultExpiration); err != nil {
+					t.Error("Error appending to log:", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if x, _ := tc.Get("log"); len(x.(string)) != 2000 {
+		t.Errorf("log has length %d, want 2000", len(x.(string)))
+	}
+}
+
+func TestIncrementInt64WithExpiration(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	n, err := tc.IncrementInt64WithExpiration("requests", 1, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error creating requests:", err)
+	}
+	if n != 1 {
+		t.Error("requests is not 1:", n)
+	}
+	_, want, _ := tc.GetWithExpiration("requests")
+
+	<-time.After(20 * time.Millisecond)
+	n, err = tc.IncrementInt64WithExpiration("requests", 2, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error incrementing requests:", err)
+	}
+	if n != 3 {
+		t.Error("requests is not 3:", n)
+	}
+	if _, exp, _ := tc.GetWithExpiration("requests"); !exp.Equal(want) {
+		t.Errorf("requests expires at %v after incrementing, want %v", exp, want)
+	}
+
+	<-time.After(40 * time.Millisecond)
+	n, err = tc.IncrementInt64WithExpiration("requests", 1, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error recreating requests:", err)
+	}
+	if n != 1 {
+		t.Error("requests is not 1 after its window expired:", n)
+	}
+}
+
+func TestIncrementInt64WithExpirationWrongType(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("int", 1, DefaultExpiration)
+	if _, err := tc.IncrementInt64WithExpiration("int", 1, DefaultExpiration); err == nil {
+		t.Error("No error incrementing an int")
+	}
+}
+
+func TestDeleteExpiredN(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	if !tc.LastCleanup().IsZero() {
+		t.Error("LastCleanup is set before any cleanup:", tc.LastCleanup())
+	}
+	tc.Set("a", 1, time.Second)
+	tc.Set("b", 2, time.Second)
+	tc.Set("c", 3, time.Minute)
+	tc.Set("d", 4, NoExpiration)
+
+	clock.Advance(2 * time.Second)
+	if n := tc.DeleteExpiredN(); n != 2 {
+		t.Errorf("DeleteExpiredN returned %d, want 2", n)
+	}
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("%d items are left, want 2", n)
+	}
+	if last := tc.LastCleanup(); !last.Equal(clock.Now()) {
+		t.Errorf("LastCleanup is %v, want %v", last, clock.Now())
+	}
+
+	clock.Advance(time.Minute)
+	tc.DeleteExpired()
+	if last := tc.LastCleanup(); !last.Equal(clock.Now()) {
+		t.Errorf("LastCleanup is %v after DeleteExpired, want %v", last, clock.Now())
+	}
+	if n := tc.DeleteExpiredN(); n != 0 {
+		t.Errorf("DeleteExpiredN returned %d with nothing expired, want 0", n)
+	}
+}
+
+func TestLastCleanupJanitor(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithCleanupInterval(time.Millisecond))
+	defer tc.StopJanitor()
+	clock.Advance(time.Hour)
+	want := clock.Now()
+	deadline := time.Now().Add(time.Second)
+	for !tc.LastCleanup().Equal(want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("LastCleanup is %v, want %v", tc.LastCleanup(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDrainExpired(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	var expired []string
+	tc.OnExpired(func(k string, v interface{}) {
+		expired = append(expired, k)
+	})
+	tc.Set("a", 1, time.Second)
+	tc.Set("b", "two", time.Second)
+	tc.Set("c", 3.0, 2*time.Second)
+	tc.Set("d", 4, time.Hour)
+	tc.Set("e", 5, NoExpiration)
+	clock.Advance(3 * time.Second)
+
+	drained := tc.DrainExpired()
+	want := map[string]interface{}{"a": 1, "b": "two", "c": 3.0}
+	if !reflect.DeepEqual(drained, want) {
+		t.Errorf("DrainExpired returned %v, want %v", drained, want)
+	}
+	if len(expired) != 3 {
+		t.Errorf("OnExpired called for %v, want 3 items", expired)
+	}
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("%d items left, want 2", n)
+	}
+	if drained := tc.DrainExpired(); len(drained) != 0 {
+		t.Errorf("second DrainExpired returned %v", drained)
+	}
+}
+
+func TestItemsByExpiration(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	tc.Set("forever2", 1, NoExpiration)
+	tc.Set("hour", 1, time.Hour)
+	tc.Set("second", 1, time.Second)
+	tc.Set("forever1", 1, NoExpiration)
+	tc.Set("minute", 1, time.Minute)
+	tc.Set("expired", 1, time.Millisecond)
+	clock.Advance(time.Millisecond * 2)
+
+	items := tc.ItemsByExpiration()
+	want := []string{"second", "minute", "hour", "forever1", "forever2"}
+	if len(items) != len(want) {
+		t.Fatalf("ItemsByExpiration returned %v, want keys %v", items, want)
+	}
+	for i, key := range want {
+		if items[i].Key != key {
+			t.Errorf("item %d is %s, want %s", i, items[i].Key, key)
+		}
+	}
+	_, exp, _ := tc.GetWithExpiration("minute")
+	if !items[1].Expiration.Equal(exp) {
+		t.Errorf("minute expires at %v, want %v", items[1].Expiration, exp)
+	}
+	if !items[3].Expiration.IsZero() {
+		t.Errorf("forever1 expires at %v", items[3].Expiration)
+	}
+}
+
+func TestItemsWithExpiration(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	tc.Set("forever", "a", NoExpiration)
+	tc.Set("minute", "b", time.Minute)
+	tc.Set("expired", "c", time.Millisecond)
+	clock.Advance(time.Millisecond * 2)
+
+	items := tc.ItemsWithExpiration()
+	if len(items) != 2 {
+		t.Fatalf("ItemsWithExpiration returned %d items, want 2: %v", len(items), items)
+	}
+	if v := items["forever"]; v.Object != "a" || !v.Expiration.IsZero() {
+		t.Errorf("forever is %v, want a with no expiration", v)
+	}
+	want := clock.Now().Add(time.Minute - time.Millisecond*2)
+	if v := items["minute"]; v.Object != "b" || !v.Expiration.Equal(want) {
+		t.Errorf("minute is %v, want b expiring at %v", v, want)
+	}
+	if _, found := items["expired"]; found {
+		t.Error("expired item was returned")
+	}
+}
+
+func TestTTLHistogram(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	ttls := map[string]time.Duration{
+		"a": 10 * time.Second,
+		"b": 30 * time.Second,
+		"c": time.Minute,
+		"d": 61 * time.Second,
+		"e": 5 * time.Minute,
+		"f": time.Hour,
+		"g": 2 * time.Hour,
+	}
+	for k, d := range ttls {
+		tc.Set(k, 1, d)
+	}
+	tc.Set("forever1", 1, NoExpiration)
+	tc.Set("forever2", 1, NoExpiration)
+	tc.Set("expired", 1, time.Second)
+	clock.Advance(2 * time.Second)
+	// x has exactly 1m left, so it counts toward the 1m bucket.
+	tc.Set("x", 1, time.Minute)
+
+	// a now has 8s left, b 28s, c 58s, d 59s, e 4m58s, f 59m58s and g
+	// 1h59m58s.
+	counts := tc.TTLHistogram([]time.Duration{30 * time.Second, time.Minute, time.Hour})
+	want := []int{2, 3, 2, 1, 2}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("TTLHistogram returned %v, want %v", counts, want)
+	}
+
+	if counts := tc.TTLHistogram(nil); !reflect.DeepEqual(counts, []int{8, 2}) {
+		t.Errorf("TTLHistogram returned %v without buckets, want [8 2]", counts)
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("live", 1, DefaultExpiration)
+	tc.Set("stale", 2, time.Nanosecond)
+	<-time.After(time.Millisecond)
+
+	x, expired, found := tc.GetStale("live")
+	if !found || expired || x.(int) != 1 {
+		t.Errorf("GetStale(live) is %v, %v, %v; want 1, false, true", x, expired, found)
+	}
+	x, expired, found = tc.GetStale("stale")
+	if !found || !expired || x.(int) != 2 {
+		t.Errorf("GetStale(stale) is %v, %v, %v; want 2, true, true", x, expired, found)
+	}
+	x, expired, found = tc.GetStale("missing")
+	if found || expired || x != nil {
+		t.Errorf("GetStale(missing) is %v, %v, %v; want nil, false, false", x, expired, found)
+	}
+
+	tc.DeleteExpired()
+	if _, _, found = tc.GetStale("stale"); found {
+		t.Error("stale was found after it was deleted")
+	}
+}
+
+func TestForEach(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+	tc.Set("expired", 4, time.Nanosecond)
+	<-time.After(time.Millisecond)
+
+	seen := map[string]int{}
+	tc.ForEach(func(key string, value interface{}) bool {
+		seen[key] = value.(int)
+		return true
+	})
+	if len(seen) != 3 || seen["a"] != 1 || seen["b"] != 2 || seen["c"] != 3 {
+		t.Errorf("ForEach visited %v, want a, b and c", seen)
+	}
+
+	calls := 0
+	tc.ForEach(func(key string, value interface{}) bool {
+		calls++
+		return calls < 2
+	})
+	if calls != 2 {
+		t.Errorf("ForEach called fn %d times after it returned false, want 2", calls)
+	}
+}
+
+func TestRangeUpdate(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	tc.Set("a", 1, time.Minute)
+	tc.Set("b", 2, time.Hour)
+	tc.Set("c", 3, NoExpiration)
+	tc.Set("expired", 4, time.Second)
+	clock.Advance(2 * time.Second)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+
+	seen := map[string]bool{}
+	removed := tc.RangeUpdate(func(key string, value interface{}) (interface{}, bool) {
+		seen[key] = true
+		if key == "b" {
+			return nil, false
+		}
+		return value.(int) - 1, true
+	})
+	if removed != 1 {
+		t.Errorf("RangeUpdate returned %d, want 1", removed)
+	}
+	if len(seen) != 3 || seen["expired"] {
+		t.Errorf("RangeUpdate visited %v, want a, b and c", seen)
+	}
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("evicted %v, want b", evicted)
+	}
+	if _, found := tc.Get("b"); found {
+		t.Error("b was not deleted")
+	}
+	if x, ttl, _ := tc.GetWithTTL("a"); x.(int) != 0 || ttl != time.Minute-2*time.Second {
+		t.Errorf("a is %v with a TTL of %v, want 0 with a TTL of 58s", x, ttl)
+	}
+	if x, ttl, _ := tc.GetWithTTL("c"); x.(int) != 2 || ttl != NoExpiration {
+		t.Errorf("c is %v with a TTL of %v, want 2 with no expiration", x, ttl)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithLRUEviction(), WithMaxItems(1000))
+	for i := 0; i < 100; i++ {
+		tc.Set(strconv.Itoa(i), i, time.Second)
+	}
+	for i := 100; i < 110; i++ {
+		tc.Set(strconv.Itoa(i), i, time.Hour)
+	}
+	tc.Set("forever", 0, NoExpiration)
+	if n := tc.StaleCount(); n != 0 {
+		t.Errorf("StaleCount is %d before expiry, want 0", n)
+	}
+	clock.Advance(2 * time.Second)
+	if n := tc.StaleCount(); n != 100 {
+		t.Errorf("StaleCount is %d, want 100", n)
+	}
+
+	if n := tc.Compact(); n != 100 {
+		t.Errorf("Compact reclaimed %d items, want 100", n)
+	}
+	if n := tc.StaleCount(); n != 0 {
+		t.Errorf("StaleCount is %d after Compact, want 0", n)
+	}
+	if n := tc.ItemCount(); n != 11 {
+		t.Errorf("ItemCount is %d after Compact, want 11", n)
+	}
+	if x, found := tc.Get("105"); !found || x.(int) != 105 {
+		t.Errorf("105 is %v (found: %v) after Compact", x, found)
+	}
+	clock.Advance(2 * time.Hour)
+	if n := tc.StaleCount(); n != 10 {
+		t.Errorf("StaleCount is %d, want 10", n)
+	}
+	if n := tc.Compact(); n != 10 {
+		t.Errorf("Compact reclaimed %d items, want 10", n)
+	}
+}
+
+func TestReplaceAll(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	for i := 0; i < 100; i++ {
+		tc.Set("old"+strconv.Itoa(i), "old", DefaultExpiration)
+	}
+	tc.Set("shared", "old", DefaultExpiration)
+
+	items := map[string]Item{"shared": {Object: "new"}}
+	for i := 0; i < 50; i++ {
+		items["new"+strconv.Itoa(i)] = Item{Object: "new"}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			seen := make(map[string]bool)
+			for _, item := range tc.Items() {
+				seen[item.Object.(string)] = true
+			}
+			if len(seen) != 1 {
+				t.Error("Items returned a mix of old and new items")
+				return
+			}
+			if seen["new"] {
+				return
+			}
+		}
+	}()
+	tc.ReplaceAll(items)
+	<-done
+
+	if n := tc.ItemCount(); n != 51 {
+		t.Errorf("ItemCount is %d, want 51", n)
+	}
+	if _, found := tc.Get("old0"); found {
+		t.Error("old0 was found after ReplaceAll")
+	}
+	if x, found := tc.Get("new0"); !found || x.(string) != "new" {
+		t.Errorf("new0 is %v (found: %v)", x, found)
+	}
+	if x, _ := tc.Get("shared"); x.(string) != "new" {
+		t.Error("shared is not new:", x)
+	}
+	if len(evicted) != 100 {
+		t.Errorf("OnEvicted was called %d times, want 100", len(evicted))
+	}
+}
+
+func TestResize(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < 10000; i++ {
+		tc.Set(strconv.Itoa(i), i, DefaultExpiration)
+	}
+	tc.Set("expired", -1, time.Nanosecond)
+	tc.FlushExcept(func(key string, item Item) bool {
+		return len(key) == 1
+	})
+	<-time.After(time.Millisecond)
+
+	tc.Resize(0)
+	if n := tc.ItemCount(); n != 10 {
+		t.Errorf("ItemCount is %d after Resize, want 10", n)
+	}
+	for i := 0; i < 10; i++ {
+		if x, found := tc.Get(strconv.Itoa(i)); !found || x.(int) != i {
+			t.Errorf("%d is %v (found: %v) after Resize", i, x, found)
+		}
+	}
+
+	tc.Resize(100)
+	tc.Set("new", "value", DefaultExpiration)
+	tc.Delete("0")
+	if x, found := tc.Get("new"); !found || x.(string) != "value" {
+		t.Errorf("new is %v (found: %v) after Resize", x, found)
+	}
+	if n := tc.ItemCount(); n != 10 {
+		t.Errorf("ItemCount is %d, want 10", n)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tc := New(time.Hour, 0)
+	tc.Set("list", []string{"a"}, time.Minute)
+	_, want, _ := tc.GetWithExpiration("list")
+
+	changed := tc.Update("list", func(value interface{}, found bool) (interface{}, bool) {
+		if !found {
+			t.Error("fn wasn't told list was found")
+		}
+		return append(value.([]string), "b"), true
+	})
+	if !changed {
+		t.Error("Update returned false after updating list")
+	}
+	x, exp, _ := tc.GetWithExpiration("list")
+	if l := x.([]string); len(l) != 2 || l[1] != "b" {
+		t.Errorf("list is %v after Update, want [a b]", l)
+	}
+	if !exp.Equal(want) {
+		t.Errorf("list expires at %v after Update, want %v", exp, want)
+	}
+}
+
+func TestUpdateCreate(t *testing.T) {
+	tc := New(time.Hour, 0)
+	changed := tc.Update("counter", func(value interface{}, found bool) (interface{}, bool) {
+		if found || value != nil {
+			t.Errorf("fn was called with %v, %v for a missing key", value, found)
+		}
+		return 1, true
+	})
+	if !changed {
+		t.Error("Update returned false after creating counter")
+	}
+	x, exp, found := tc.GetWithExpiration("counter")
+	if !found || x.(int) != 1 {
+		t.Errorf("counter is %v (found: %v), want 1", x, found)
+	}
+	if exp.IsZero() {
+		t.Error("counter was created without the default expiration")
+	}
+}
+
+func TestUpdateDelete(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Set("foo", "bar", DefaultExpiration)
+	remove := func(value interface{}, found bool) (interface{}, bool) {
+		return nil, false
+	}
+
+	if !tc.Update("foo", remove) {
+		t.Error("Update returned false after deleting foo")
+	}
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo was found after Update deleted it")
+	}
+	if len(evicted) != 1 || evicted[0] != "foo" {
+		t.Errorf("OnEvicted was called for %v, want [foo]", evicted)
+	}
+	if tc.Update("missing", remove) {
+		t.Error("Update returned true without changing anything")
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	evicted := map[string]interface{}{}
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted[k] = v
+	})
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+
+	if n := tc.DeleteMany([]string{"a", "missing", "c", "a"}); n != 2 {
+		t.Errorf("DeleteMany returned %d, want 2", n)
+	}
+	if len(evicted) != 2 || evicted["a"] != 1 || evicted["c"] != 3 {
+		t.Errorf("OnEvicted was called with %v, want a and c", evicted)
+	}
+	if keys := tc.Keys(); len(keys) != 1 || keys[0] != "b" {
+		t.Errorf("keys after DeleteMany are %v, want [b]", keys)
+	}
+	if n := tc.DeleteMany(nil); n != 0 {
+		t.Errorf("DeleteMany(nil) returned %d, want 0", n)
+	}
+}
+
+func TestIncrementIntOrCreate(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	n, err := tc.IncrementIntOrCreate("hits", 2, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error creating hits:", err)
+	}
+	if n != 2 {
+		t.Error("hits is not 2:", n)
+	}
+	_, want, _ := tc.GetWithExpiration("hits")
+	if want.IsZero() {
+		t.Error("hits was created without an expiration time")
+	}
+
+	n, err = tc.IncrementIntOrCreate("hits", 3, NoExpiration)
+	if err != nil {
+		t.Fatal("Error incrementing hits:", err)
+	}
+	if n != 5 {
+		t.Error("hits is not 5:", n)
+	}
+	if _, exp, _ := tc.GetWithExpiration("hits"); !exp.Equal(want) {
+		t.Errorf("hits expires at %v after incrementing, want %v", exp, want)
+	}
+
+	<-time.After(60 * time.Millisecond)
+	if n, _ = tc.IncrementIntOrCreate("hits", 1, NoExpiration); n != 1 {
+		t.Error("hits is not 1 after it expired:", n)
+	}
+
+	tc.Set("string", "foo", DefaultExpiration)
+	if _, err = tc.IncrementIntOrCreate("string", 1, DefaultExpiration); err == nil {
+		t.Error("No error incrementing a string")
+	}
+}
+
+func TestReplaceWithFunc(t *testing.T) {
+	type versioned struct {
+		version int
+		data    string
+	}
+	tc := New(DefaultExpiration, 0)
+	tc.Set("doc", versioned{2, "v2"}, DefaultExpiration)
+	newer := func(v versioned) func(old interface{}) (interface{}, bool) {
+		return func(old interface{}) (interface{}, bool) {
+			return v, v.version > old.(versioned).version
+		}
+	}
+
+	if err := tc.ReplaceWithFunc("doc", newer(versioned{3, "v3"}), DefaultExpiration); err != nil {
+		t.Error("Error replacing doc:", err)
+	}
+	if x, _ := tc.Get("doc"); x.(versioned).data != "v3" {
+		t.Error("doc is not v3:", x)
+	}
+
+	if err := tc.ReplaceWithFunc("doc", newer(versioned{1, "v1"}), DefaultExpiration); err != nil {
+		t.Error("Error replacing doc with an older version:", err)
+	}
+	if x, _ := tc.Get("doc"); x.(versioned).data != "v3" {
+		t.Error("doc was replaced by an older version:", x)
+	}
+
+	called := false
+	err := tc.ReplaceWithFunc("missing", func(old interface{}) (interface{}, bool) {
+		called = true
+		return 1, true
+	}, DefaultExpiration)
+	if err == nil {
+		t.Error("No error replacing a missing item")
+	}
+	if called {
+		t.Error("fn was called for a missing item")
+	}
+	if _, found := tc.Get("missing"); found {
+		t.Error("missing was added by ReplaceWithFunc")
+	}
+}
+
+func TestGetWithTTL(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("finite", 1, time.Minute)
+	tc.Set("forever", 2, NoExpiration)
+
+	x, ttl, found := tc.GetWithTTL("finite")
+	if !found || x.(int) != 1 {
+		t.Errorf("finite is %v (found: %v), want 1", x, found)
+	}
+	if ttl > time.Minute || ttl < time.Minute-time.Second {
+		t.Errorf("TTL of finite is %v, want about 1m", ttl)
+	}
+
+	x, ttl, found = tc.GetWithTTL("forever")
+	if !found || x.(int) != 2 {
+		t.Errorf("forever is %v (found: %v), want 2", x, found)
+	}
+	if ttl != NoExpiration {
+		t.Errorf("TTL of forever is %v, want NoExpiration", ttl)
+	}
+
+	x, ttl, found = tc.GetWithTTL("missing")
+	if found || x != nil || ttl != 0 {
+		t.Errorf("GetWithTTL(missing) is %v, %v, %v; want nil, 0, false", x, ttl, found)
+	}
+}
+
+func TestSetManyWithExpiration(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 1, time.Hour)
+	tc.Set("b", "two", 2*time.Hour)
+	tc.Set("c", 3.0, NoExpiration)
+	items := tc.Items()
+	tc.Flush()
+	<-time.After(time.Millisecond)
+
+	tc.SetManyWithExpiration(items)
+	if n := tc.ItemCount(); n != 3 {
+		t.Errorf("ItemCount is %d, want 3", n)
+	}
+	for key, want := range items {
+		x, exp, found := tc.GetWithExpiration(key)
+		if !found || x != want.Object {
+			t.Errorf("%s is %v (found: %v), want %v", key, x, found, want.Object)
+		}
+		if want.Expiration == 0 {
+			if !exp.IsZero() {
+				t.Errorf("%s expires at %v, want never", key, exp)
+			}
+		} else if exp.UnixNano() != want.Expiration {
+			t.Errorf("%s expires at %d, want %d", key, exp.UnixNano(), want.Expiration)
+		}
+	}
+
+	tc.SetManyWithExpiration(map[string]Item{
+		"expired": {Object: 1, Expiration: time.Now().Add(-time.Second).UnixNano()},
+		"a":       {Object: "new"},
+	})
+	if _, found := tc.Get("expired"); found {
+		t.Error("expired was found")
+	}
+	if x, _, _ := tc.GetWithExpiration("a"); x != "new" {
+		t.Error("a was not overwritten:", x)
+	}
+}
+
+type flagConfig struct {
+	NewUI    bool
+	MaxUsers int
+	Name     string
+	secret   string
+}
+
+func TestSetStruct(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	cfg := flagConfig{NewUI: true, MaxUsers: 10, Name: "beta", secret: "hidden"}
+	if err := tc.SetStruct("flags.", cfg, time.Minute); err != nil {
+		t.Fatal("SetStruct returned an error:", err)
+	}
+	want := map[string]interface{}{"flags.NewUI": true, "flags.MaxUsers": 10, "flags.Name": "beta"}
+	for key, v := range want {
+		x, ttl, found := tc.GetWithTTL(key)
+		if !found || x != v {
+			t.Errorf("%s is %v, want %v", key, x, v)
+		}
+		if ttl <= 0 || ttl > time.Minute {
+			t.Errorf("TTL of %s is %v, want at most 1m", key, ttl)
+		}
+	}
+	if n := tc.ItemCount(); n != len(want) {
+		t.Errorf("ItemCount is %d, want %d", n, len(want))
+	}
+	if _, found := tc.Get("flags.secret"); found {
+		t.Error("unexported field secret was stored")
+	}
+
+	cfg.Name = "ga"
+	if err := tc.SetStruct("", &cfg, DefaultExpiration); err != nil {
+		t.Fatal("SetStruct returned an error for a pointer:", err)
+	}
+	if x, _ := tc.Get("Name"); x != "ga" {
+		t.Error("Name is not ga:", x)
+	}
+
+	var nilCfg *flagConfig
+	for _, v := range []interface{}{42, "config", nilCfg, nil} {
+		if err := tc.SetStruct("bad.", v, DefaultExpiration); err == nil {
+			t.Errorf("SetStruct didn't return an error for %#v", v)
+		}
+	}
+}
+
+func TestSetWithAbsoluteExpiration(t *testing.T) {
+	tc := New(time.Hour, 0)
+	at := time.Now().Add(time.Minute).Round(0)
+	tc.SetWithAbsoluteExpiration("future", 1, at)
+	tc.SetWithAbsoluteExpiration("past", 2, time.Now().Add(-time.Second))
+	tc.SetWithAbsoluteExpiration("never", 3, time.Time{})
+
+	x, exp, found := tc.GetWithExpiration("future")
+	if !found || x.(int) != 1 {
+		t.Errorf("future is %v (found: %v), want 1", x, found)
+	}
+	if !exp.Equal(at) {
+		t.Errorf("future expires at %v, want %v", exp, at)
+	}
+	if _, found := tc.Get("past"); found {
+		t.Error("past was found although it expired when it was set")
+	}
+	x, exp, found = tc.GetWithExpiration("never")
+	if !found || x.(int) != 3 {
+		t.Errorf("never is %v (found: %v), want 3", x, found)
+	}
+	if !exp.IsZero() {
+		t.Errorf("never expires at %v, want no expiration", exp)
+	}
+}
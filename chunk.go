@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ChunkCache is a read-through cache of byte ranges ("chunks") of an
+// io.ReaderAt, e.g. a file or a memory-mapped blob. Chunks are stored in a
+// Cache keyed by their offset and length, so overlapping ranges are cached
+// independently.
+type ChunkCache struct {
+	r          io.ReaderAt
+	c          *Cache
+	expiration time.Duration
+}
+
+// Return a new ChunkCache that reads chunks from r and stores them in c with
+// the given expiration duration, which follows the same rules as for Set. c
+// should not be used to store anything else.
+func NewChunkCache(r io.ReaderAt, c *Cache, expiration time.Duration) *ChunkCache {
+	return &ChunkCache{
+		r:          r,
+		c:          c,
+		expiration: expiration,
+	}
+}
+
+// Get the chunk of the given length at the given offset, reading it from the
+// underlying io.ReaderAt if it isn't cached. Concurrent misses for the same
+// chunk only result in one read. If fewer than length bytes could be read, the
+// bytes that were read are returned along with the error (e.g. io.EOF), and
+// nothing is cached. The returned slice is shared with the cache and must not
+// be modified. Returns an error if offset or length is negative.
+func (cc *ChunkCache) GetChunk(offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid chunk: offset %d, length %d", offset, length)
+	}
+	key := strconv.FormatInt(offset, 10) + ":" + strconv.FormatInt(length, 10)
+	var partial []byte
+	v, err := cc.c.GetOrCompute(key, cc.expiration, func() (interface{}, error) {
+		buf := make([]byte, length)
+		n, err := cc.r.ReadAt(buf, offset)
+		if n < len(buf) {
+			partial = buf[:n]
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return buf, nil
+	})
+	if err != nil {
+		return partial, err
+	}
+
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("the value for chunk %s does not have type []byte", key)
+	}
+	return b, nil
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int32
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return c.r.ReadAt(p, off)
+}
+
+func TestChunkCache(t *testing.T) {
+	r := &countingReaderAt{r: bytes.NewReader([]byte("0123456789"))}
+	cc := NewChunkCache(r, New(DefaultExpiration, 0), DefaultExpiration)
+
+	reads := []struct {
+		offset, length int64
+		want           string
+		reads          int32
+	}{
+		{0, 4, "0123", 1},
+		{0, 4, "0123", 1},
+		{2, 4, "2345", 2},
+		{2, 4, "2345", 2},
+		{0, 4, "0123", 2},
+		{4, 6, "456789", 3},
+	}
+	for _, tt := range reads {
+		b, err := cc.GetChunk(tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("GetChunk(%d, %d) returned an error: %v", tt.offset, tt.length, err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("GetChunk(%d, %d) is %q, want %q", tt.offset, tt.length, b, tt.want)
+		}
+		if n := atomic.LoadInt32(&r.reads); n != tt.reads {
+			t.Errorf("after GetChunk(%d, %d), ReadAt was called %d times, want %d", tt.offset, tt.length, n, tt.reads)
+		}
+	}
+}
+
+func TestChunkCacheShortRead(t *testing.T) {
+	r := &countingReaderAt{r: bytes.NewReader([]byte("0123456789"))}
+	cc := NewChunkCache(r, New(DefaultExpiration, 0), DefaultExpiration)
+
+	for i := int32(1); i <= 2; i++ {
+		b, err := cc.GetChunk(8, 4)
+		if err != io.EOF {
+			t.Error("GetChunk past the end did not return io.EOF:", err)
+		}
+		if string(b) != "89" {
+			t.Errorf("GetChunk past the end returned %q, want %q", b, "89")
+		}
+		if n := atomic.LoadInt32(&r.reads); n != i {
+			t.Errorf("ReadAt was called %d times, want %d", n, i)
+		}
+	}
+}
+
+func TestChunkCacheInvalid(t *testing.T) {
+	r := &countingReaderAt{r: bytes.NewReader([]byte("0123456789"))}
+	tc := New(DefaultExpiration, 0)
+	cc := NewChunkCache(r, tc, DefaultExpiration)
+	for _, c := range [][2]int64{{-1, 4}, {0, -1}} {
+		if b, err := cc.GetChunk(c[0], c[1]); err == nil || b != nil {
+			t.Errorf("GetChunk(%d, %d) returned (%q, %v), want an error", c[0], c[1], b, err)
+		}
+	}
+	if n := atomic.LoadInt32(&r.reads); n != 0 {
+		t.Errorf("%d reads for invalid chunks, want 0", n)
+	}
+
+	tc.Set("0:4", "not a chunk", DefaultExpiration)
+	if _, err := cc.GetChunk(0, 4); err == nil {
+		t.Error("GetChunk returned no error for a value that isn't a chunk")
+	}
+}
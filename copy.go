@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"reflect"
+)
+
+// DefaultCopier returns a copy of a value using reflection, for use with
+// WithCopyOnGet: slices, arrays and maps are copied, as are any slices, arrays
+// and maps they contain. Other values, including pointers and structs, are
+// returned as is, so the values they refer to are still shared. A slice or map
+// that occurs more than once in the value is copied once, so the copy shares it
+// in the same way, and values that contain themselves are copied correctly.
+func DefaultCopier(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return copyOf(reflect.ValueOf(value), map[visit]reflect.Value{}).Interface()
+}
+
+// copyOf returns a copy of v, using the copies of the slices and maps in copies
+// instead of copying them again.
+func copyOf(v reflect.Value, copies map[visit]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		k := visit{ptr: v.Pointer(), typ: v.Type(), len: v.Len()}
+		if c, ok := copies[k]; ok {
+			return c
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		copies[k] = c
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyOf(v.Index(i), copies))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyOf(v.Index(i), copies))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		k := visit{ptr: v.Pointer(), typ: v.Type()}
+		if c, ok := copies[k]; ok {
+			return c
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		copies[k] = c
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), copyOf(iter.Value(), copies))
+		}
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(copyOf(v.Elem(), copies))
+		return c
+	}
+	return v
+}
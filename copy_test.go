@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultCopier(t *testing.T) {
+	p := &TestStruct{Num: 1}
+	v := map[string]interface{}{
+		"slice": []int{1, 2},
+		"map":   map[string][]string{"a": {"b"}},
+		"array": [2][]int{{1}, {2}},
+		"ptr":   p,
+		"nil":   []int(nil),
+	}
+	c := DefaultCopier(v).(map[string]interface{})
+	if !reflect.DeepEqual(c, v) {
+		t.Fatalf("copy is %v, want %v", c, v)
+	}
+	c["slice"].([]int)[0] = 100
+	c["map"].(map[string][]string)["a"][0] = "changed"
+	c["array"].([2][]int)[0][0] = 100
+	c["new"] = true
+	if v["slice"].([]int)[0] != 1 || v["map"].(map[string][]string)["a"][0] != "b" || v["array"].([2][]int)[0][0] != 1 {
+		t.Errorf("modifying the copy changed the original: %v", v)
+	}
+	if _, found := v["new"]; found {
+		t.Error("adding to the copy changed the original")
+	}
+	if c["ptr"] != p {
+		t.Error("pointers were copied")
+	}
+	if DefaultCopier(nil) != nil || DefaultCopier(42) != 42 {
+		t.Error("DefaultCopier changed a scalar value")
+	}
+}
+
+func TestDefaultCopierCycle(t *testing.T) {
+	m := map[string]interface{}{"a": 1}
+	m["self"] = m
+	c := DefaultCopier(m).(map[string]interface{})
+	c["a"] = 2
+	if m["a"] != 1 {
+		t.Error("modifying the copy changed the original")
+	}
+	if self := c["self"].(map[string]interface{}); self["a"] != 2 {
+		t.Error("the copy doesn't contain itself:", self["a"])
+	}
+
+	s := []interface{}{1, nil}
+	s[1] = s
+	cs := DefaultCopier(s).([]interface{})
+	cs[0] = 2
+	if s[0] != 1 || cs[1].([]interface{})[0] != 2 {
+		t.Error("the copy of a slice containing itself doesn't contain itself")
+	}
+}
+
+func TestWithCopyOnGet(t *testing.T) {
+	tc := NewWithOptions(WithCopyOnGet(nil))
+	tc.Set("slice", []string{"a", "b"}, DefaultExpiration)
+	x, _ := tc.Get("slice")
+	x.([]string)[0] = "changed"
+	y, _, _ := tc.GetWithExpiration("slice")
+	if y.([]string)[0] != "a" {
+		t.Error("modifying a value returned by Get changed the cached value:", y)
+	}
+	y.([]string)[1] = "changed"
+	if z, _ := tc.Get("slice"); z.([]string)[1] != "b" {
+		t.Error("modifying a value returned by GetWithExpiration changed the cached value:", z)
+	}
+
+	tc = New(DefaultExpiration, 0)
+	tc.Set("slice", []string{"a"}, DefaultExpiration)
+	x, _ = tc.Get("slice")
+	x.([]string)[0] = "changed"
+	if z, _ := tc.Get("slice"); z.([]string)[0] != "changed" {
+		t.Error("Get returned a copy without WithCopyOnGet")
+	}
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// EventOp is the kind of change to a cache that an Event describes.
+type EventOp int
+
+const (
+	// An item was added to the cache, or replaced.
+	EventSet EventOp = iota
+	// An item was deleted from the cache, e.g. by Delete or Flush.
+	EventDelete
+	// An expired item was deleted from the cache, e.g. by the janitor.
+	EventExpired
+	// An item was evicted to make room for a new one (see WithMaxItems.)
+	EventEvicted
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventSet:
+		return "Set"
+	case EventDelete:
+		return "Delete"
+	case EventExpired:
+		return "Expired"
+	case EventEvicted:
+		return "Evicted"
+	}
+	return "EventOp(" + strconv.Itoa(int(op)) + ")"
+}
+
+// An Event describes a change to a cache. Value is the new value of the item
+// for EventSet, and its last value otherwise.
+type Event struct {
+	Key   string
+	Op    EventOp
+	Value interface{}
+}
+
+// The number of events that can be buffered for a subscriber before further
+// events are dropped.
+const eventBufferSize = 128
+
+// Returns a channel on which the changes made to the cache from now on are
+// delivered, in order, until Unsubscribe is called with it. Changes are only
+// delivered for items that are set, deleted, expired or evicted, and not e.g.
+// for incremented ones. Events are sent without blocking the cache: if the
+// subscriber doesn't receive them quickly enough and the channel's buffer is
+// full, they are dropped, and counted by DroppedEvents.
+func (c *cache) Subscribe() <-chan Event {
+	ch := make(chan Event, eventBufferSize)
+
+	c.mutex.Lock()
+	c.subscribers = append(c.subscribers, ch)
+	c.mutex.Unlock()
+
+	return ch
+}
+
+// Stop delivering events on a channel returned by Subscribe, and close it. Does
+// nothing if the channel isn't subscribed.
+func (c *cache) Unsubscribe(ch <-chan Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, sub := range c.subscribers {
+		if (<-chan Event)(sub) == ch {
+			c.subscribers = append(c.subscribers[:i], c.subscribers[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+// Returns the number of events that were dropped because a subscriber's
+// channel was full.
+func (c *cache) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&c.droppedEvents)
+}
+
+// publish sends an event to each subscriber whose channel isn't full. It must
+// be called while holding mutex.
+func (c *cache) publish(op EventOp, key string, value interface{}) {
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- Event{Key: key, Op: op, Value: value}:
+		default:
+			atomic.AddUint64(&c.droppedEvents, 1)
+		}
+	}
+}
+
+// publishRemoval publishes an event for the removal of the item with the given
+// key, if it exists. It must be called while holding mutex, before removing
+// the item.
+func (c *cache) publishRemoval(op EventOp, key string) {
+	if len(c.subscribers) == 0 {
+		return
+	}
+	if item, found := c.items[key]; found {
+		c.publish(op, key, item.Object)
+	}
+}
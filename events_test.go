@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// receiveEvents receives n events from ch, failing the test if they aren't
+// delivered.
+func receiveEvents(t *testing.T, ch <-chan Event, n int) []Event {
+	var events []Event
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		case <-time.After(time.Second):
+			t.Fatalf("received %d events, want %d", len(events), n)
+		}
+	}
+	return events
+}
+
+func TestSubscribe(t *testing.T) {
+	tc := NewWithOptions(WithMaxItems(2))
+	ch := tc.Subscribe()
+
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, time.Nanosecond)
+	tc.Delete("a")
+	tc.Delete("missing")
+	<-time.After(time.Millisecond)
+	tc.DeleteExpired()
+	tc.Set("c", 3, DefaultExpiration)
+	tc.Set("d", 4, DefaultExpiration)
+	tc.Set("e", 5, DefaultExpiration)
+
+	want := []Event{
+		{"a", EventSet, 1},
+		{"b", EventSet, 2},
+		{"a", EventDelete, 1},
+		{"b", EventExpired, 2},
+		{"c", EventSet, 3},
+		{"d", EventSet, 4},
+		{"", EventEvicted, nil},
+		{"e", EventSet, 5},
+	}
+	got := receiveEvents(t, ch, len(want))
+	for i, e := range got {
+		if want[i].Op == EventEvicted {
+			if e.Op != EventEvicted || (e.Key != "c" && e.Key != "d") {
+				t.Errorf("event %d is %+v, want c or d to be evicted", i, e)
+			}
+			continue
+		}
+		if e != want[i] {
+			t.Errorf("event %d is %+v, want %+v", i, e, want[i])
+		}
+	}
+
+	tc.Unsubscribe(ch)
+	tc.Set("f", 6, DefaultExpiration)
+	if _, ok := <-ch; ok {
+		t.Error("received an event after unsubscribing")
+	}
+	tc.Unsubscribe(ch)
+}
+
+func TestSubscribeMultiple(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	ch1 := tc.Subscribe()
+	ch2 := tc.Subscribe()
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Unsubscribe(ch1)
+	tc.Flush()
+
+	if got := receiveEvents(t, ch1, 1); got[0] != (Event{"a", EventSet, 1}) {
+		t.Errorf("first subscriber received %+v", got)
+	}
+	got := receiveEvents(t, ch2, 2)
+	if got[0] != (Event{"a", EventSet, 1}) || got[1] != (Event{"a", EventDelete, 1}) {
+		t.Errorf("second subscriber received %+v", got)
+	}
+}
+
+func TestSubscribeSlowSubscriber(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	ch := tc.Subscribe()
+	for i := 0; i < eventBufferSize+10; i++ {
+		tc.Set("a", i, DefaultExpiration)
+	}
+	if n := tc.DroppedEvents(); n != 10 {
+		t.Errorf("DroppedEvents is %d, want 10", n)
+	}
+	if e := <-ch; e.Value.(int) != 0 {
+		t.Errorf("first event is %+v, want the first Set", e)
+	}
+}
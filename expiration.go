@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"container/heap"
+)
+
+// expirationHeap is a min-heap of the keys of the items in a cache that expire,
+// ordered by their expiration times, so that expired items can be found without
+// scanning the whole cache. It is indexed by a map so that items can be updated
+// and removed in O(log n).
+//
+// It is guarded by the cache's mutex, and must only be modified while holding
+// it for writing. Its zero value is an empty heap.
+type expirationHeap struct {
+	entries []*expirationEntry
+	index   map[string]*expirationEntry
+}
+
+type expirationEntry struct {
+	key        string
+	expiration int64
+	pos        int
+}
+
+// init replaces the contents of the heap with the expiring items in items.
+func (h *expirationHeap) init(items map[string]Item) {
+	h.entries = nil
+	h.index = make(map[string]*expirationEntry)
+	for k, v := range items {
+		if v.Expiration > 0 {
+			e := &expirationEntry{key: k, expiration: v.Expiration, pos: len(h.entries)}
+			h.entries = append(h.entries, e)
+			h.index[k] = e
+		}
+	}
+	heap.Init(h)
+}
+
+// update records the expiration time of key, removing it from the heap if it
+// is 0 (i.e. the item doesn't expire.)
+func (h *expirationHeap) update(key string, expiration int64) {
+	e, ok := h.index[key]
+	if expiration <= 0 {
+		if ok {
+			h.remove(key)
+		}
+		return
+	}
+	if ok {
+		if e.expiration != expiration {
+			e.expiration = expiration
+			heap.Fix(h, e.pos)
+		}
+		return
+	}
+	if h.index == nil {
+		h.index = make(map[string]*expirationEntry)
+	}
+	e = &expirationEntry{key: key, expiration: expiration}
+	h.index[key] = e
+	heap.Push(h, e)
+}
+
+// remove removes key from the heap, if it is in it.
+func (h *expirationHeap) remove(key string) {
+	if e, ok := h.index[key]; ok {
+		heap.Remove(h, e.pos)
+		delete(h.index, key)
+	}
+}
+
+// peek returns the key that expires first, and its expiration time.
+func (h *expirationHeap) peek() (string, int64, bool) {
+	if len(h.entries) == 0 {
+		return "", 0, false
+	}
+	e := h.entries[0]
+	return e.key, e.expiration, true
+}
+
+// reset removes all keys from the heap.
+func (h *expirationHeap) reset() {
+	h.entries = nil
+	h.index = nil
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface.
+
+func (h *expirationHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *expirationHeap) Less(i, j int) bool {
+	return h.entries[i].expiration < h.entries[j].expiration
+}
+
+func (h *expirationHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].pos = i
+	h.entries[j].pos = j
+}
+
+func (h *expirationHeap) Push(x interface{}) {
+	e := x.(*expirationEntry)
+	e.pos = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *expirationHeap) Pop() interface{} {
+	n := len(h.entries)
+	e := h.entries[n-1]
+	h.entries[n-1] = nil
+	h.entries = h.entries[:n-1]
+	return e
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpirationHeapOrder(t *testing.T) {
+	var h expirationHeap
+	h.update("c", 30)
+	h.update("a", 10)
+	h.update("d", 40)
+	h.update("b", 20)
+	h.update("x", 5)
+	h.update("x", 0)
+	h.update("d", 1)
+	h.remove("missing")
+
+	var got []string
+	for {
+		key, _, ok := h.peek()
+		if !ok {
+			break
+		}
+		got = append(got, key)
+		h.remove(key)
+	}
+	want := []string{"d", "a", "b", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("heap order is %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("heap order is %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDeleteExpiredUsesCurrentExpirations(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithInitialItems(map[string]Item{
+		"initial": {Object: 0, Expiration: clock.Now().Add(time.Minute).UnixNano()},
+	}))
+	tc.Set("a", 1, time.Minute)
+	tc.Set("b", 2, time.Minute)
+	tc.Set("b", 2, NoExpiration)
+	tc.Set("c", 3, time.Minute)
+	tc.Touch("c", time.Hour)
+	tc.Set("d", 4, time.Minute)
+	tc.Delete("d")
+	tc.Set("e", 5, time.Minute)
+	tc.Rename("e", "f")
+
+	clock.Advance(2 * time.Minute)
+	tc.DeleteExpired()
+
+	keys := tc.Keys()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+		t.Errorf("keys after DeleteExpired are %v, want [b c]", keys)
+	}
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("ItemCount after DeleteExpired is %d, want 2", n)
+	}
+	if n := tc.expirations.Len(); n != 1 {
+		t.Errorf("%d keys are left in the expiration heap, want 1", n)
+	}
+
+	tc.Flush()
+	if n := tc.expirations.Len(); n != 0 {
+		t.Errorf("%d keys are left in the expiration heap after Flush, want 0", n)
+	}
+}
+
+func BenchmarkDeleteExpiredMostlyLive(b *testing.B) {
+	b.StopTimer()
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	for i := 0; i < 1000000; i++ {
+		tc.Set(strconv.Itoa(i), i, time.Hour)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 10; j++ {
+			tc.Set("expiring"+strconv.Itoa(j), j, time.Nanosecond)
+		}
+		clock.Advance(time.Nanosecond)
+		tc.DeleteExpired()
+	}
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"sync"
+)
+
+// lruList tracks the recency of use of the items in a cache with LRU eviction
+// (see WithLRUEviction.) It is an intrusive doubly-linked list of the keys,
+// most recently used first, indexed by a map so that all operations are O(1).
+// It implements EvictionPolicy, and is also used by the FIFO policy.
+//
+// Its methods are safe to call while holding only a read lock on the cache's
+// mutex, as it has its own mutex.
+type lruList struct {
+	mu    sync.Mutex
+	root  lruNode // sentinel; root.next is the front, root.prev the back
+	nodes map[string]*lruNode
+}
+
+type lruNode struct {
+	key        string
+	prev, next *lruNode
+}
+
+func newLRUList(items map[string]Item) *lruList {
+	l := &lruList{
+		nodes: make(map[string]*lruNode, len(items)),
+	}
+	l.root.next = &l.root
+	l.root.prev = &l.root
+	for k := range items {
+		l.pushFront(k)
+	}
+	return l
+}
+
+// touch marks key as the most recently used, adding it if necessary.
+func (l *lruList) touch(key string) {
+	l.mu.Lock()
+	if n, ok := l.nodes[key]; ok {
+		l.unlink(n)
+		l.link(n)
+	} else {
+		l.pushFront(key)
+	}
+	l.mu.Unlock()
+}
+
+// add adds key to the front of the list, unless it is already in it.
+func (l *lruList) add(key string) {
+	l.mu.Lock()
+	if _, ok := l.nodes[key]; !ok {
+		l.pushFront(key)
+	}
+	l.mu.Unlock()
+}
+
+// remove removes key from the list, if present.
+func (l *lruList) remove(key string) {
+	l.mu.Lock()
+	if n, ok := l.nodes[key]; ok {
+		l.unlink(n)
+		delete(l.nodes, key)
+	}
+	l.mu.Unlock()
+}
+
+// compact rebuilds the index of the list with room for exactly the keys in
+// it, keeping their order.
+func (l *lruList) compact() {
+	l.mu.Lock()
+	nodes := make(map[string]*lruNode, len(l.nodes))
+	for k, n := range l.nodes {
+		nodes[k] = n
+	}
+	l.nodes = nodes
+	l.mu.Unlock()
+}
+
+// back returns the least recently used key.
+func (l *lruList) back() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.root.prev == &l.root {
+		return "", false
+	}
+	return l.root.prev.key, true
+}
+
+// reset removes all keys from the list.
+func (l *lruList) reset() {
+	l.mu.Lock()
+	l.nodes = make(map[string]*lruNode)
+	l.root.next = &l.root
+	l.root.prev = &l.root
+	l.mu.Unlock()
+}
+
+// OnAccess, OnAdd, OnRemove and Victim implement EvictionPolicy.
+
+func (l *lruList) OnAccess(key string) {
+	l.touch(key)
+}
+
+func (l *lruList) OnAdd(key string) {
+	l.touch(key)
+}
+
+func (l *lruList) OnRemove(key string) {
+	l.remove(key)
+}
+
+func (l *lruList) Victim() (string, bool) {
+	return l.back()
+}
+
+func (l *lruList) pushFront(key string) {
+	n := &lruNode{key: key}
+	l.nodes[key] = n
+	l.link(n)
+}
+
+func (l *lruList) link(n *lruNode) {
+	n.prev = &l.root
+	n.next = l.root.next
+	l.root.next.prev = n
+	l.root.next = n
+}
+
+func (l *lruList) unlink(n *lruNode) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	n.prev = nil
+	n.next = nil
+}
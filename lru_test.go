@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLRUEviction(t *testing.T) {
+	tc := New(DefaultExpiration, 0, WithMaxItems(3), WithLRUEviction())
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+
+	// a is now the most recently used, so b is the victim.
+	tc.Get("a")
+	tc.Set("d", 4, DefaultExpiration)
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("evicted %v, want [b]", evicted)
+	}
+
+	// Overwriting c makes it the most recently used, so a is the victim.
+	tc.Set("c", 30, DefaultExpiration)
+	tc.Set("e", 5, DefaultExpiration)
+	if len(evicted) != 2 || evicted[1] != "a" {
+		t.Fatalf("evicted %v, want [b a]", evicted)
+	}
+
+	// Deleted items are not considered, so d is the victim.
+	tc.Delete("c")
+	tc.Set("f", 6, DefaultExpiration)
+	tc.Set("g", 7, DefaultExpiration)
+	if evicted[len(evicted)-1] != "d" {
+		t.Fatalf("evicted %v, want d last", evicted)
+	}
+
+	for _, k := range []string{"e", "f", "g"} {
+		if _, found := tc.Get(k); !found {
+			t.Errorf("%s was not found", k)
+		}
+	}
+	if n := tc.ItemCount(); n != 3 {
+		t.Errorf("ItemCount is %d, want 3", n)
+	}
+}
+
+func TestLRUEvictionNewFrom(t *testing.T) {
+	m := map[string]Item{
+		"a": {Object: 1},
+		"b": {Object: 2},
+	}
+	tc := NewFrom(DefaultExpiration, 0, m, WithMaxItems(2), WithLRUEviction())
+	tc.Get("a")
+	tc.Set("c", 3, DefaultExpiration)
+	if _, found := tc.Get("b"); found {
+		t.Error("b was not evicted")
+	}
+	if _, found := tc.Get("a"); !found {
+		t.Error("a was evicted even though it was used more recently than b")
+	}
+}
+
+func TestLRUEvictionFlush(t *testing.T) {
+	tc := New(DefaultExpiration, 0, WithMaxItems(5), WithLRUEviction())
+	for i := 0; i < 5; i++ {
+		tc.Set(strconv.Itoa(i), i, DefaultExpiration)
+	}
+	tc.Flush()
+	for i := 0; i < 10; i++ {
+		tc.Set(strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if n := tc.ItemCount(); n != 5 {
+		t.Errorf("ItemCount is %d, want 5", n)
+	}
+	for i := 5; i < 10; i++ {
+		if _, found := tc.Get(strconv.Itoa(i)); !found {
+			t.Errorf("%d was not found", i)
+		}
+	}
+}
+
+func TestCountExpiredTowardLimit(t *testing.T) {
+	for _, count := range []bool{false, true} {
+		tc := New(DefaultExpiration, 0, WithMaxItems(4), WithLRUEviction(), WithCountExpiredTowardLimit(count))
+		var evicted []string
+		tc.OnEvicted(func(k string, v interface{}) {
+			evicted = append(evicted, k)
+		})
+		tc.Set("live1", 1, DefaultExpiration)
+		tc.Set("exp1", 2, time.Millisecond)
+		tc.Set("live2", 3, DefaultExpiration)
+		tc.Set("exp2", 4, time.Millisecond)
+		<-time.After(5 * time.Millisecond)
+		// Looking up the expired items doesn't make them recently used. (Get
+		// would delete them, so they are looked up without deleting them.)
+		tc.getKeepExpired("exp1")
+		tc.getKeepExpired("exp2")
+
+		tc.Set("new", 5, DefaultExpiration)
+		if count {
+			// live1 is the least recently used item.
+			if len(evicted) != 1 || evicted[0] != "live1" {
+				t.Errorf("with expired items counted, evicted %v, want [live1]", evicted)
+			}
+			continue
+		}
+		sort.Strings(evicted)
+		if len(evicted) != 2 || evicted[0] != "exp1" || evicted[1] != "exp2" {
+			t.Errorf("with expired items not counted, evicted %v, want [exp1 exp2]", evicted)
+		}
+		for _, k := range []string{"live1", "live2", "new"} {
+			if _, found := tc.Get(k); !found {
+				t.Errorf("%s was not found", k)
+			}
+		}
+		if n := tc.ItemCount(); n != 3 {
+			t.Errorf("ItemCount is %d, want 3", n)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"strings"
+	"time"
+)
+
+// Namespaced is a view of a cache in which all keys are prefixed with the
+// namespace's prefix, so that several logical caches can share the items (and
+// the janitor) of one cache without their keys colliding. See Namespace.
+type Namespaced struct {
+	c      *cache
+	prefix string
+}
+
+// Returns a view of the cache in which all keys are prefixed with prefix, e.g.
+// Namespace("users:").Set("x", ...) sets the item "users:x". Prefixes should
+// not be prefixes of each other, e.g. "user" and "users", or the namespaces
+// will overlap.
+func (c *cache) Namespace(prefix string) *Namespaced {
+	return &Namespaced{
+		c:      c,
+		prefix: prefix,
+	}
+}
+
+// Add an item to the namespace, replacing any existing item. Duration rules are
+// the same as for Set.
+func (n *Namespaced) Set(key string, value interface{}, duration time.Duration) {
+	n.c.Set(n.prefix+key, value, duration)
+}
+
+// Get an item from the namespace. Returns the item or nil, and a bool
+// indicating whether the key was found.
+func (n *Namespaced) Get(key string) (interface{}, bool) {
+	return n.c.Get(n.prefix + key)
+}
+
+// Delete an item from the namespace. Does nothing if the key is not in the
+// namespace.
+func (n *Namespaced) Delete(key string) {
+	n.c.Delete(n.prefix + key)
+}
+
+// Delete all items in the namespace from the cache, leaving the items of other
+// namespaces intact, and calling the OnEvicted function (if one is set) for
+// each deleted item. Returns the number of deleted items.
+func (n *Namespaced) Flush() int {
+	return n.c.FlushExcept(func(key string, item Item) bool {
+		return !strings.HasPrefix(key, n.prefix)
+	})
+}
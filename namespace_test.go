@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNamespace(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	users := tc.Namespace("users:")
+	posts := tc.Namespace("posts:")
+
+	users.Set("1", "alice", DefaultExpiration)
+	posts.Set("1", "hello", DefaultExpiration)
+	tc.Set("1", "global", DefaultExpiration)
+
+	if x, found := users.Get("1"); !found || x.(string) != "alice" {
+		t.Errorf("users:1 is %v (found: %v), want alice", x, found)
+	}
+	if x, found := posts.Get("1"); !found || x.(string) != "hello" {
+		t.Errorf("posts:1 is %v (found: %v), want hello", x, found)
+	}
+	if x, found := tc.Get("users:1"); !found || x.(string) != "alice" {
+		t.Errorf("users:1 in the parent cache is %v (found: %v), want alice", x, found)
+	}
+
+	users.Delete("1")
+	if _, found := users.Get("1"); found {
+		t.Error("users:1 was found after it was deleted")
+	}
+	if _, found := posts.Get("1"); !found {
+		t.Error("posts:1 was deleted with users:1")
+	}
+}
+
+func TestNamespaceFlush(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	users := tc.Namespace("users:")
+	posts := tc.Namespace("posts:")
+	users.Set("1", "alice", DefaultExpiration)
+	users.Set("2", "bob", time.Minute)
+	posts.Set("1", "hello", DefaultExpiration)
+	tc.Set("other", "value", DefaultExpiration)
+
+	if n := users.Flush(); n != 2 {
+		t.Errorf("Flush deleted %d items, want 2", n)
+	}
+	if _, found := users.Get("2"); found {
+		t.Error("users:2 was found after flushing users")
+	}
+	if _, found := posts.Get("1"); !found {
+		t.Error("posts:1 was deleted by flushing users")
+	}
+	if _, found := tc.Get("other"); !found {
+		t.Error("other was deleted by flushing users")
+	}
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("ItemCount is %d after flushing users, want 2", n)
+	}
+}
@@ -0,0 +1,338 @@
+package cache
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// An Option configures a cache created with NewWithOptions, New or NewFrom.
+type Option func(*cache)
+
+// WithDefaultExpiration sets the default expiration duration of the cache,
+// which is used by Set etc. when passed DefaultExpiration. If d is less than
+// one (or NoExpiration), the items in the cache never expire by default, which
+// is the default.
+func WithDefaultExpiration(d time.Duration) Option {
+	return func(c *cache) {
+		if d == DefaultExpiration {
+			d = NoExpiration
+		}
+		c.expiration = d
+	}
+}
+
+// WithCleanupInterval sets the interval at which expired items are deleted
+// from the cache. If d is less than one, expired items are not deleted from the
+// cache before calling c.DeleteExpired(), which is the default.
+func WithCleanupInterval(d time.Duration) Option {
+	return func(c *cache) {
+		c.cleanupInterval = d
+	}
+}
+
+// WithInitialItems makes the cache start with the given items, using the map
+// as the cache's underlying map. See NewFrom for caveats.
+func WithInitialItems(items map[string]Item) Option {
+	return func(c *cache) {
+		c.items = items
+	}
+}
+
+// WithOnEvicted sets the function that is called when an item is evicted from
+// the cache. See OnEvicted.
+func WithOnEvicted(f func(string, interface{})) Option {
+	return func(c *cache) {
+		c.onEvicted = f
+	}
+}
+
+// WithOnExpired sets the function that is called when an expired item is
+// deleted from the cache. See OnExpired.
+func WithOnExpired(f func(string, interface{})) Option {
+	return func(c *cache) {
+		c.onExpired = f
+	}
+}
+
+// WithMaxItems limits the number of items in the cache to n. When an item is
+// added to a full cache, a random item (or one chosen by the eviction policy,
+// see WithEvictionPolicy) is evicted first, calling the OnEvicted function if
+// one is set. Items passed to NewFrom count toward the limit. If n
+// is less than one, the number of items is unlimited, which is the default.
+func WithMaxItems(n int) Option {
+	return func(c *cache) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxItems = n
+	}
+}
+
+// WithMaxBytes limits the total size of the items in the cache to n bytes, as
+// determined by the cache's Sizer (see WithSizer), or DefaultSizer if it has
+// none. When an item is added and the total would exceed the limit, items are
+// evicted first as with WithMaxItems. If n is less than one, the size of the
+// cache is unlimited, which is the default.
+func WithMaxBytes(n int64) Option {
+	return func(c *cache) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxBytes = n
+	}
+}
+
+// WithSizer sets the function that determines the size of the items in the
+// cache, which is reported by SizeBytes and limited by WithMaxBytes.
+func WithSizer(sizer Sizer) Option {
+	return func(c *cache) {
+		c.sizer = sizer
+	}
+}
+
+// WithLRUEviction makes a cache with a maximum number of items (see
+// WithMaxItems) evict the least recently used item, rather than a random one,
+// when an item is added to it while it is full. Getting or setting an item
+// counts as using it.
+func WithLRUEviction() Option {
+	return WithEvictionPolicy(NewLRUPolicy())
+}
+
+// WithEvictionPolicy makes a cache with a maximum number of items or bytes (see
+// WithMaxItems and WithMaxBytes) evict the items chosen by the given policy,
+// rather than random ones, when an item is added to it while it is full. See
+// NewLRUPolicy, NewLFUPolicy and NewFIFOPolicy for the built-in policies.
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(c *cache) {
+		// The policy is told about the cache's items once they are known.
+		c.policy = p
+	}
+}
+
+// WithCountExpiredTowardLimit determines whether expired items that haven't been
+// deleted yet count toward the maximum number of items (see WithMaxItems.) If
+// count is false, all expired items are deleted when an item is added to a full
+// cache, and a live item is only evicted if that didn't free up any space. The
+// default is true, in which case an expired item is only removed if it happens
+// to be chosen for eviction.
+func WithCountExpiredTowardLimit(count bool) Option {
+	return func(c *cache) {
+		c.reclaimExpired = !count
+	}
+}
+
+// WithEvictOnOverwrite determines whether the OnEvicted function is called with
+// the previous value when an item is replaced by Set (or any other method that
+// overwrites an existing item), e.g. to release a resource held by the old
+// value. The default is false, in which case OnEvicted is not called when an
+// item is overwritten.
+func WithEvictOnOverwrite(evict bool) Option {
+	return func(c *cache) {
+		c.evictOnOverwrite = evict
+	}
+}
+
+// WithExpirationJitter spreads out the expiration times of items that are added
+// with the same duration, so that they don't all expire at once, by offsetting
+// each item's expiration time by a random amount of up to ±fraction of its
+// duration, e.g. 0.1 for ±10%. The fraction is limited to between 0 and 1, and
+// items always expire at least a nanosecond after they are added. Items that
+// don't expire are not affected. Use WithRand to make the offsets
+// deterministic, e.g. in tests.
+func WithExpirationJitter(fraction float64) Option {
+	return func(c *cache) {
+		if fraction < 0 {
+			fraction = 0
+		} else if fraction > 1 {
+			fraction = 1
+		}
+		c.jitter = fraction
+	}
+}
+
+// WithRand makes the cache use r as its source of randomness, e.g. for the
+// offsets added by WithExpirationJitter. r is only used while holding a lock,
+// so it doesn't need to be safe for concurrent use.
+func WithRand(r *rand.Rand) Option {
+	return func(c *cache) {
+		c.rand = r
+	}
+}
+
+// WithMinTTL sets the shortest expiration duration of items added with Set,
+// Add, Replace etc. Shorter durations are raised to d, which avoids the churn
+// caused by items that expire almost immediately. Items that don't expire are
+// not affected.
+func WithMinTTL(d time.Duration) Option {
+	return func(c *cache) {
+		c.minTTL = d
+	}
+}
+
+// WithMaxTTL sets the longest expiration duration of items added with Set, Add,
+// Replace etc. Longer durations are lowered to d, and items that would never
+// expire (e.g. with NoExpiration) expire after d instead.
+func WithMaxTTL(d time.Duration) Option {
+	return func(c *cache) {
+		c.maxTTL = d
+	}
+}
+
+// WithCopyOnGet makes Get and GetWithExpiration return a copy of an item's value
+// made by copier, rather than the value itself, so that callers can't change the
+// stored value by modifying e.g. a returned slice or map. If copier is nil,
+// DefaultCopier is used. By default, values are returned as is.
+func WithCopyOnGet(copier func(interface{}) interface{}) Option {
+	return func(c *cache) {
+		if copier == nil {
+			copier = DefaultCopier
+		}
+		c.copier = copier
+	}
+}
+
+// WithAccessTracking makes the cache count how often each item is found by Get,
+// GetWithExpiration and GetWithMeta, for MostAccessed. This is disabled by
+// default, as it makes each of those calls update a counter shared by all
+// callers accessing the same item.
+func WithAccessTracking() Option {
+	return func(c *cache) {
+		c.accesses = new(sync.Map)
+	}
+}
+
+// WithSweepBatchSize makes DeleteExpired (and the janitor) delete expired items
+// in batches of at most n, releasing the cache's lock between batches, so that a
+// sweep that deletes a lot of items doesn't block other users of the cache for
+// its whole duration. Items that expire while the sweep is in progress are left
+// for the next one. The default, 0, deletes all expired items in one batch.
+func WithSweepBatchSize(n int) Option {
+	return func(c *cache) {
+		c.sweepBatchSize = n
+	}
+}
+
+// WithClock makes the cache use the given Clock, rather than time.Now(), to
+// determine the current time, e.g. when setting and checking the expiration
+// times of items. If clock is nil, time.Now() is used.
+func WithClock(clock Clock) Option {
+	return func(c *cache) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		c.clock = clock
+	}
+}
+
+// WithCoalescingWindow smooths the load on GetOrCompute when a frequently used
+// item expires: for the duration d after a computation of a missing item starts,
+// other callers requesting the same item are served its previous (expired but
+// not yet deleted) value rather than waiting for the computation to finish.
+// Callers only wait if there is no previous value, or the computation has taken
+// longer than d. The default, 0, disables this.
+func WithCoalescingWindow(d time.Duration) Option {
+	return func(c *cache) {
+		c.coalescingWindow = d
+	}
+}
+
+// WithLoader sets the function that GetOrLoad calls to load an item that isn't
+// in the cache. It returns the item's value, its expiration duration (which
+// follows the same rules as for Set), and whether the item could be loaded;
+// if not, nothing is stored.
+func WithLoader(fn func(key string) (interface{}, time.Duration, bool)) Option {
+	return func(c *cache) {
+		if fn == nil {
+			c.loader = nil
+			return
+		}
+		c.loader = func(key string) (interface{}, time.Duration, error) {
+			v, d, ok := fn(key)
+			if !ok {
+				return nil, 0, ErrNotLoaded
+			}
+			return v, d, nil
+		}
+	}
+}
+
+// WithLoaderErr sets the function that GetOrLoad calls to load an item that
+// isn't in the cache, like WithLoader, but fn returns an error if the item
+// couldn't be loaded: ErrNotLoaded (or an error wrapping it) if it doesn't
+// exist, or any other error if loading it failed, e.g. because the backing
+// store is unavailable. Only the latter count as failures for
+// WithLoaderCircuitBreaker. GetOrLoadErr returns the error.
+func WithLoaderErr(fn func(key string) (interface{}, time.Duration, error)) Option {
+	return func(c *cache) {
+		c.loader = fn
+	}
+}
+
+// WithMaxConcurrentLoads limits the number of calls of the loader (see
+// WithLoader) for different keys that run at the same time to n, e.g. to avoid
+// overwhelming a database when a lot of items are missing at once. Further
+// loads wait until one of them finishes. Concurrent loads of the same key are
+// still shared, and count once. The default, 0, doesn't limit them.
+func WithMaxConcurrentLoads(n int) Option {
+	return func(c *cache) {
+		if n > 0 {
+			c.loadSem = make(chan struct{}, n)
+		} else {
+			c.loadSem = nil
+		}
+	}
+}
+
+// WithLoaderCircuitBreaker stops GetOrLoad from calling the loader (see
+// WithLoaderErr) for the duration cooldown after it has returned an error
+// other than ErrNotLoaded failureThreshold times in a row, e.g. because the
+// backing store is down. Loads during that time fail immediately, and
+// GetOrLoadErr returns ErrLoaderUnavailable for them. After the cooldown, a
+// single trial load is allowed: if it doesn't fail, the loader is called as
+// usual again; if it does, loads fail for another cooldown. Items that the
+// loader doesn't find don't count as failures, so a loader set by WithLoader,
+// which can't report errors, never opens the breaker. The default, 0, disables
+// this.
+func WithLoaderCircuitBreaker(failureThreshold int, cooldown time.Duration) Option {
+	return func(c *cache) {
+		c.breakerThreshold = int32(failureThreshold)
+		c.breakerCooldown = cooldown
+	}
+}
+
+// WithNegativeCacheTTL makes GetOrLoad remember for the duration d that the
+// loader (see WithLoader) didn't find an item, and report it as missing without
+// calling the loader again during that time. These keys aren't visible to any
+// other method. The default, 0, disables this.
+func WithNegativeCacheTTL(d time.Duration) Option {
+	return func(c *cache) {
+		c.negativeTTL = d
+	}
+}
+
+// WithRefreshAhead makes Get reload an item with the loader (see WithLoader) in
+// the background when it is found within the duration window of its expiration
+// time, while still returning the current value, so that frequently used items
+// are replaced before they expire. Only one load per key is in progress at a
+// time, shared with GetOrLoad. If the loader doesn't return a value, the item is
+// left as is.
+func WithRefreshAhead(window time.Duration) Option {
+	return func(c *cache) {
+		c.refreshAhead = window
+	}
+}
+
+// WithAutoSave makes the cache save its items to the file at path every
+// interval, and one last time when it is closed (see Close) or its janitor is
+// stopped (see StopJanitor), using Save. The file is written atomically, by
+// writing a temporary file and renaming it, so it is never left partially
+// written. If interval is less than one, the items are only saved when the cache
+// is closed. They aren't saved when the cache is garbage collected. Use
+// NewFromFile to start with the saved items.
+func WithAutoSave(path string, interval time.Duration) Option {
+	return func(c *cache) {
+		c.autoSavePath = path
+		c.autoSaveInterval = interval
+	}
+}
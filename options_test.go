@@ -0,0 +1,1109 @@
+package cache
+
+import (
+	"errors"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewWithOptionsDefaults(t *testing.T) {
+	tc := NewWithOptions()
+	legacy := New(NoExpiration, 0)
+	if tc.expiration != legacy.expiration {
+		t.Errorf("default expiration is %v, want %v", tc.expiration, legacy.expiration)
+	}
+	if tc.janitor != nil {
+		t.Error("janitor is running without a cleanup interval")
+	}
+	if tc.items == nil {
+		t.Fatal("items map is nil")
+	}
+	if tc.onEvicted != nil {
+		t.Error("onEvicted is set")
+	}
+	tc.Set("foo", "bar", DefaultExpiration)
+	if _, exp, found := tc.GetWithExpiration("foo"); !found || !exp.IsZero() {
+		t.Error("item set with the default expiration expires:", exp)
+	}
+
+	legacy = New(DefaultExpiration, 0)
+	if legacy.expiration != NoExpiration {
+		t.Errorf("New(DefaultExpiration, 0) has default expiration %v, want %v", legacy.expiration, NoExpiration)
+	}
+}
+
+func TestWithDefaultExpiration(t *testing.T) {
+	tc := NewWithOptions(WithDefaultExpiration(time.Minute))
+	if tc.expiration != time.Minute {
+		t.Errorf("default expiration is %v, want %v", tc.expiration, time.Minute)
+	}
+	tc.Set("foo", "bar", DefaultExpiration)
+	_, exp, _ := tc.GetWithExpiration("foo")
+	if d := time.Until(exp); d <= 0 || d > time.Minute {
+		t.Error("item set with the default expiration does not expire in a minute:", exp)
+	}
+}
+
+func TestWithCleanupInterval(t *testing.T) {
+	tc := NewWithOptions(WithCleanupInterval(time.Millisecond))
+	if tc.janitor == nil || tc.janitor.Interval != time.Millisecond {
+		t.Fatal("janitor is not running with the configured interval")
+	}
+	tc.Set("foo", "bar", time.Millisecond)
+	<-time.After(20 * time.Millisecond)
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("ItemCount is %d, want 0 after cleanup", n)
+	}
+}
+
+func TestWithInitialItems(t *testing.T) {
+	m := map[string]Item{
+		"a": {Object: 1},
+		"b": {Object: 2},
+	}
+	tc := NewWithOptions(WithInitialItems(m))
+	for k, item := range m {
+		x, found := tc.Get(k)
+		if !found || x != item.Object {
+			t.Errorf("%s is %v, want %v", k, x, item.Object)
+		}
+	}
+}
+
+func TestWithOnEvicted(t *testing.T) {
+	var evicted []string
+	tc := NewWithOptions(WithOnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	}))
+	tc.Set("foo", "bar", DefaultExpiration)
+	tc.Delete("foo")
+	if len(evicted) != 1 || evicted[0] != "foo" {
+		t.Error("OnEvicted function was not called for foo:", evicted)
+	}
+}
+
+func TestWithEvictOnOverwrite(t *testing.T) {
+	for _, evict := range []bool{false, true} {
+		var evicted []interface{}
+		tc := NewWithOptions(WithEvictOnOverwrite(evict), WithOnEvicted(func(k string, v interface{}) {
+			evicted = append(evicted, v)
+		}))
+		tc.Set("foo", "old", DefaultExpiration)
+		tc.Set("foo", "new", DefaultExpiration)
+		tc.Set("bar", "first", DefaultExpiration)
+		if !evict {
+			if len(evicted) != 0 {
+				t.Errorf("OnEvicted called with %v without WithEvictOnOverwrite", evicted)
+			}
+			continue
+		}
+		if len(evicted) != 1 || evicted[0] != "old" {
+			t.Errorf("OnEvicted called with %v, want [old]", evicted)
+		}
+		if x, _ := tc.Get("foo"); x != "new" {
+			t.Errorf("foo is %v, want new", x)
+		}
+	}
+}
+
+func TestWithExpirationJitter(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithExpirationJitter(0.1), WithRand(rand.New(rand.NewSource(1))))
+	tc.Set("a", 1, time.Hour)
+	tc.Set("b", 2, time.Hour)
+	tc.Set("c", 3, NoExpiration)
+	_, a, _ := tc.GetWithExpiration("a")
+	_, b, _ := tc.GetWithExpiration("b")
+	if a.Equal(b) {
+		t.Error("a and b expire at the same time:", a)
+	}
+	base := clock.Now().Add(time.Hour)
+	for _, exp := range []time.Time{a, b} {
+		if d := exp.Sub(base); d < -6*time.Minute || d > 6*time.Minute {
+			t.Errorf("expiration is offset by %v, want at most ±6m", d)
+		}
+	}
+	if _, exp, _ := tc.GetWithExpiration("c"); !exp.IsZero() {
+		t.Error("c expires at", exp)
+	}
+
+	// The same seed gives the same expiration times.
+	oc := NewWithOptions(WithClock(clock), WithExpirationJitter(0.1), WithRand(rand.New(rand.NewSource(1))))
+	oc.Set("a", 1, time.Hour)
+	if _, exp, _ := oc.GetWithExpiration("a"); !exp.Equal(a) {
+		t.Errorf("a expires at %v with the same seed, want %v", exp, a)
+	}
+}
+
+func TestWithExpirationJitterBounds(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithExpirationJitter(2), WithRand(rand.New(rand.NewSource(1))))
+	base := clock.Now()
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		tc.Set(k, i, time.Hour)
+		_, exp, _ := tc.GetWithExpiration(k)
+		if !exp.After(base) || exp.After(base.Add(2*time.Hour)) {
+			t.Errorf("%s expires at %v with a jitter of 2, want after %v and at most 2h later", k, exp, base)
+		}
+	}
+
+	oc := NewWithOptions(WithClock(clock), WithExpirationJitter(-1))
+	oc.Set("a", 1, time.Hour)
+	if _, exp, _ := oc.GetWithExpiration("a"); !exp.Equal(base.Add(time.Hour)) {
+		t.Errorf("a expires at %v with a negative jitter, want %v", exp, base.Add(time.Hour))
+	}
+}
+
+func TestWithSweepBatchSize(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithSweepBatchSize(100))
+	for i := 0; i < 200000; i++ {
+		tc.Set(strconv.Itoa(i), i, time.Second)
+	}
+	tc.Set("live", "value", NoExpiration)
+	clock.Advance(2 * time.Second)
+
+	done := make(chan struct{})
+	var longest time.Duration
+	var reads int
+	go func() {
+		defer close(done)
+		for {
+			start := time.Now()
+			if _, found := tc.Get("live"); !found {
+				t.Error("live was not found")
+			}
+			if d := time.Since(start); d > longest {
+				longest = d
+			}
+			reads++
+			if tc.ItemCount() == 1 {
+				return
+			}
+		}
+	}()
+	tc.DeleteExpired()
+	<-done
+
+	if n := tc.ItemCount(); n != 1 {
+		t.Errorf("ItemCount is %d after DeleteExpired, want 1", n)
+	}
+	if longest > 100*time.Millisecond {
+		t.Errorf("a Get during the sweep took %v (of %d reads)", longest, reads)
+	}
+}
+
+func TestWithMinTTLAndMaxTTL(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithMinTTL(time.Minute), WithMaxTTL(time.Hour))
+	tc.Set("short", 1, time.Second)
+	tc.Add("long", 2, 24*time.Hour)
+	tc.Set("replaced", 3, DefaultExpiration)
+	tc.Replace("replaced", 3, time.Millisecond)
+	tc.Set("between", 4, 10*time.Minute)
+	tc.Set("forever", 5, NoExpiration)
+
+	now := clock.Now()
+	for key, want := range map[string]time.Time{
+		"short":    now.Add(time.Minute),
+		"long":     now.Add(time.Hour),
+		"replaced": now.Add(time.Minute),
+		"between":  now.Add(10 * time.Minute),
+		"forever":  now.Add(time.Hour),
+	} {
+		if _, exp, _ := tc.GetWithExpiration(key); !exp.Equal(want) {
+			t.Errorf("%s expires at %v, want %v", key, exp, want)
+		}
+	}
+
+	tc = NewWithOptions(WithClock(clock), WithMinTTL(time.Minute))
+	tc.Set("forever", 1, NoExpiration)
+	if _, exp, _ := tc.GetWithExpiration("forever"); !exp.IsZero() {
+		t.Error("forever expires at", exp)
+	}
+}
+
+// fakeClock is a Clock whose time only changes when it is advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000000, 0)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+}
+
+func TestWithClock(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithDefaultExpiration(time.Hour), WithClock(clock))
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, 2*time.Hour)
+	tc.Set("c", 3, NoExpiration)
+
+	_, exp, _ := tc.GetWithExpiration("a")
+	if want := clock.Now().Add(time.Hour); !exp.Equal(want) {
+		t.Errorf("a expires at %v, want %v", exp, want)
+	}
+
+	clock.Advance(time.Hour)
+	if _, found := tc.Get("a"); !found {
+		t.Error("a was not found at its expiration time")
+	}
+
+	clock.Advance(time.Nanosecond)
+	if _, found := tc.Get("a"); found {
+		t.Error("a was found after its expiration time")
+	}
+	if _, _, found := tc.GetWithExpiration("a"); found {
+		t.Error("GetWithExpiration found a after its expiration time")
+	}
+	if items := tc.Items(); len(items) != 2 {
+		t.Errorf("Items returned %d items, want 2", len(items))
+	}
+	if err := tc.Add("a", 10, DefaultExpiration); err != nil {
+		t.Error("Couldn't add a after its expiration time:", err)
+	}
+
+	clock.Advance(time.Hour)
+	if err := tc.Replace("b", 20, DefaultExpiration); err == nil {
+		t.Error("Replaced b after its expiration time")
+	}
+	tc.DeleteExpired()
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("ItemCount is %d after DeleteExpired, want 2", n)
+	}
+	if _, found := tc.Get("c"); !found {
+		t.Error("c was not found")
+	}
+}
+
+func TestWithClockNil(t *testing.T) {
+	tc := NewWithOptions(WithClock(nil))
+	tc.Set("a", 1, time.Hour)
+	if x, found := tc.Get("a"); !found || x.(int) != 1 {
+		t.Errorf("Get(a) with a nil clock is %v, %v; want 1, true", x, found)
+	}
+}
+
+func TestWithClockJanitor(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithCleanupInterval(time.Millisecond), WithClock(clock))
+	tc.Set("foo", "bar", time.Hour)
+
+	<-time.After(10 * time.Millisecond)
+	if n := tc.ItemCount(); n != 1 {
+		t.Fatalf("ItemCount is %d before the item expired, want 1", n)
+	}
+
+	clock.Advance(time.Hour + time.Nanosecond)
+	<-time.After(10 * time.Millisecond)
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("ItemCount is %d after the item expired, want 0", n)
+	}
+}
+
+func TestOnSweep(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithCleanupInterval(time.Millisecond), WithClock(clock))
+	sweeps := make(chan int, 100)
+	tc.OnSweep(func(removed int, duration time.Duration) {
+		if duration < 0 {
+			t.Error("negative sweep duration:", duration)
+		}
+		// The callback must be called without holding the lock.
+		tc.ItemCount()
+		select {
+		case sweeps <- removed:
+		default:
+		}
+	})
+	for i := 0; i < 10; i++ {
+		tc.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	tc.Set("live", 0, time.Hour)
+	clock.Advance(2 * time.Minute)
+
+	total := 0
+	timeout := time.After(time.Second)
+	for total < 10 {
+		select {
+		case n := <-sweeps:
+			total += n
+		case <-timeout:
+			t.Fatalf("the sweeps removed %d items, want 10", total)
+		}
+	}
+	if total != 10 {
+		t.Errorf("the sweeps removed %d items, want 10", total)
+	}
+
+	tc.StopJanitor()
+	tc.Set("manual", 0, time.Minute)
+	clock.Advance(2 * time.Minute)
+	for len(sweeps) > 0 {
+		<-sweeps
+	}
+	tc.DeleteExpired()
+	if n := <-sweeps; n != 1 {
+		t.Errorf("DeleteExpired reported %d removed items, want 1", n)
+	}
+}
+
+func TestJanitorStatus(t *testing.T) {
+	if status := New(DefaultExpiration, 0).JanitorStatus(); status != (JanitorStatus{}) {
+		t.Errorf("status of a cache without a janitor is %+v", status)
+	}
+
+	clock := newFakeClock()
+	tc := NewWithOptions(WithCleanupInterval(20*time.Millisecond), WithClock(clock))
+	status := tc.JanitorStatus()
+	if !status.Running || status.Interval != 20*time.Millisecond || status.Paused || !status.LastRun.IsZero() {
+		t.Errorf("initial status is %+v", status)
+	}
+
+	tc.PauseJanitor()
+	tc.Set("a", 1, time.Minute)
+	tc.Set("b", 2, time.Minute)
+	tc.Set("c", 3, time.Hour)
+	clock.Advance(2 * time.Minute)
+	<-time.After(50 * time.Millisecond)
+	status = tc.JanitorStatus()
+	if !status.Paused {
+		t.Error("janitor is not paused")
+	}
+	if !status.LastRun.IsZero() {
+		t.Error("janitor ran while paused at", status.LastRun)
+	}
+	if n := tc.ItemCount(); n != 3 {
+		t.Errorf("ItemCount is %d while the janitor is paused, want 3", n)
+	}
+
+	tc.ResumeJanitor()
+	status = waitForJanitorRun(t, tc, time.Time{})
+	if status.Paused {
+		t.Error("janitor is still paused")
+	}
+	if !status.LastRun.Equal(clock.Now()) {
+		t.Errorf("LastRun is %v, want %v", status.LastRun, clock.Now())
+	}
+	if status.LastRemoved != 2 {
+		t.Errorf("LastRemoved is %d, want 2", status.LastRemoved)
+	}
+
+	clock.Advance(time.Minute)
+	status = waitForJanitorRun(t, tc, status.LastRun)
+	if status.LastRemoved != 0 {
+		t.Errorf("LastRemoved is %d, want 0", status.LastRemoved)
+	}
+}
+
+// waitForJanitorRun waits until the janitor of tc has run after the given time,
+// and returns its status.
+func waitForJanitorRun(t *testing.T, tc *Cache, after time.Time) JanitorStatus {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if status := tc.JanitorStatus(); status.LastRun.After(after) {
+			return status
+		}
+		<-time.After(time.Millisecond)
+	}
+	t.Fatal("janitor did not run")
+	return JanitorStatus{}
+}
+
+func TestSetCleanupInterval(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithCleanupInterval(time.Hour), WithClock(clock))
+	tc.Set("a", 1, time.Minute)
+	tc.Set("b", 2, time.Hour)
+	clock.Advance(2 * time.Minute)
+
+	tc.SetCleanupInterval(10 * time.Millisecond)
+	status := waitForJanitorRun(t, tc, time.Time{})
+	if status.Interval != 10*time.Millisecond {
+		t.Errorf("Interval is %v, want 10ms", status.Interval)
+	}
+	if status.LastRemoved != 1 {
+		t.Errorf("LastRemoved is %d, want 1", status.LastRemoved)
+	}
+	if n := tc.ItemCount(); n != 1 {
+		t.Errorf("ItemCount is %d after the janitor ran, want 1", n)
+	}
+
+	tc.PauseJanitor()
+	tc.SetCleanupInterval(20 * time.Millisecond)
+	if status := tc.JanitorStatus(); !status.Running || !status.Paused {
+		t.Errorf("status after changing the interval of a paused janitor is %+v", status)
+	}
+
+	tc.SetCleanupInterval(0)
+	if status := tc.JanitorStatus(); status.Running {
+		t.Errorf("janitor is still running after disabling it: %+v", status)
+	}
+	tc.SetCleanupInterval(0)
+}
+
+func TestStopJanitor(t *testing.T) {
+	before := runtime.NumGoroutine()
+	clock := newFakeClock()
+	tc := NewWithOptions(WithCleanupInterval(time.Millisecond), WithClock(clock))
+	if !tc.JanitorStatus().Running {
+		t.Fatal("janitor isn't running")
+	}
+
+	tc.StopJanitor()
+	tc.StopJanitor()
+	stopJanitor(tc)
+	if status := tc.JanitorStatus(); status.Running {
+		t.Errorf("janitor is still running after StopJanitor: %+v", status)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		<-time.After(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines are running after StopJanitor, want %d", n, before)
+	}
+
+	tc.Set("a", 1, time.Minute)
+	clock.Advance(2 * time.Minute)
+	tc.DeleteExpired()
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("ItemCount is %d after DeleteExpired, want 0", n)
+	}
+
+	New(DefaultExpiration, 0).StopJanitor()
+}
+
+func TestJanitorStopTwice(t *testing.T) {
+	j := &janitor{Interval: time.Millisecond, stop: make(chan bool)}
+	done := make(chan struct{})
+	go func() {
+		j.Run(New(DefaultExpiration, 0).cache)
+		close(done)
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		j.Stop()
+		j.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stopping the janitor twice didn't return")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("janitor is still running after Stop")
+	}
+}
+
+func TestSetCleanupIntervalConcurrent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	wg := new(sync.WaitGroup)
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			defer wg.Done()
+			tc.SetCleanupInterval(time.Duration(i%3) * time.Millisecond)
+			tc.JanitorStatus()
+		}(i)
+	}
+	wg.Wait()
+	tc.SetCleanupInterval(0)
+}
+
+func TestWithCoalescingWindow(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithCoalescingWindow(time.Second))
+	tc.Set("hot", "old", time.Minute)
+	clock.Advance(time.Minute + time.Nanosecond)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var calls int32
+	fn := func() (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return "new", nil
+	}
+	loaded := make(chan interface{})
+	go func() {
+		v, _ := tc.GetOrCompute("hot", time.Minute, fn)
+		loaded <- v
+	}()
+	<-started
+
+	// Within the window, callers get the previous value without blocking.
+	for i := 0; i < 10; i++ {
+		v, err := tc.GetOrCompute("hot", time.Minute, fn)
+		if err != nil || v != "old" {
+			t.Errorf("GetOrCompute within the window returned (%v, %v), want (old, nil)", v, err)
+		}
+	}
+
+	// Without a previous value, callers wait.
+	tc.Delete("hot")
+	waited := make(chan interface{})
+	go func() {
+		v, _ := tc.GetOrCompute("hot", time.Minute, fn)
+		waited <- v
+	}()
+	select {
+	case v := <-waited:
+		t.Fatal("GetOrCompute without a previous value did not wait:", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	if v := <-loaded; v != "new" {
+		t.Error("loader returned", v)
+	}
+	if v := <-waited; v != "new" {
+		t.Error("waiting caller received", v)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("fn was called %d times, want 1", n)
+	}
+}
+
+func TestWithCoalescingWindowExpired(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithCoalescingWindow(time.Second))
+	tc.Set("hot", "old", time.Minute)
+	clock.Advance(time.Minute + time.Nanosecond)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go tc.GetOrCompute("hot", time.Minute, func() (interface{}, error) {
+		close(started)
+		<-release
+		return "new", nil
+	})
+	<-started
+
+	// After the window, callers wait even if there is a previous value.
+	clock.Advance(time.Second)
+	waited := make(chan interface{})
+	go func() {
+		v, _ := tc.GetOrCompute("hot", time.Minute, nil)
+		waited <- v
+	}()
+	select {
+	case v := <-waited:
+		t.Fatal("GetOrCompute after the window did not wait:", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if v := <-waited; v != "new" {
+		t.Error("waiting caller received", v)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	tc.Set("finite", 1, time.Minute)
+	tc.Set("forever", 2, NoExpiration)
+	clock.Advance(15 * time.Second)
+
+	if ttl, found := tc.TTL("finite"); !found || ttl != 45*time.Second {
+		t.Errorf("TTL(finite) is %v, %v; want 45s, true", ttl, found)
+	}
+	if exp, found := tc.ExpirationTime("finite"); !found || !exp.Equal(clock.Now().Add(45*time.Second)) {
+		t.Errorf("ExpirationTime(finite) is %v, %v; want %v, true", exp, found, clock.Now().Add(45*time.Second))
+	}
+
+	if ttl, found := tc.TTL("forever"); !found || ttl != NoExpiration {
+		t.Errorf("TTL(forever) is %v, %v; want NoExpiration, true", ttl, found)
+	}
+	if exp, found := tc.ExpirationTime("forever"); !found || !exp.IsZero() {
+		t.Errorf("ExpirationTime(forever) is %v, %v; want zero time, true", exp, found)
+	}
+
+	if ttl, found := tc.TTL("missing"); found || ttl != 0 {
+		t.Errorf("TTL(missing) is %v, %v; want 0, false", ttl, found)
+	}
+	if exp, found := tc.ExpirationTime("missing"); found || !exp.IsZero() {
+		t.Errorf("ExpirationTime(missing) is %v, %v; want zero time, false", exp, found)
+	}
+
+	clock.Advance(time.Minute)
+	if _, found := tc.TTL("finite"); found {
+		t.Error("TTL found an expired item")
+	}
+	if _, found := tc.ExpirationTime("finite"); found {
+		t.Error("ExpirationTime found an expired item")
+	}
+}
+
+func TestStats(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithMaxItems(2), WithLRUEviction())
+	tc.Set("a", 1, time.Hour)
+	tc.Get("a")
+	tc.Get("a")
+	tc.GetWithExpiration("a")
+	tc.Get("missing")
+	tc.GetWithExpiration("missing")
+
+	tc.Set("b", 2, time.Minute)
+	tc.Set("c", 3, time.Hour) // evicts a
+	clock.Advance(2 * time.Minute)
+	tc.Get("a")
+	tc.Get("b") // expires b
+	tc.Get("c")
+	tc.Set("d", 4, time.Minute)
+	clock.Advance(2 * time.Minute)
+	tc.DeleteExpired() // expires d
+
+	want := Stats{Hits: 4, Misses: 4, Evictions: 1, Expirations: 2}
+	if got := tc.Stats(); got != want {
+		t.Errorf("Stats are %+v, want %+v", got, want)
+	}
+}
+
+func TestHas(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithMaxItems(2), WithLRUEviction(), WithAccessTracking())
+	tc.Set("a", 1, time.Minute)
+	tc.Set("b", 2, time.Hour)
+	if !tc.Has("a") || !tc.Has("b") {
+		t.Error("Has returned false for an existing item")
+	}
+	if tc.Has("missing") {
+		t.Error("Has returned true for a missing item")
+	}
+	if stats := tc.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("Has changed the stats to %+v", stats)
+	}
+	if top := tc.MostAccessed(2); len(top) != 0 {
+		t.Errorf("Has was counted as an access: %v", top)
+	}
+
+	// a is still the least recently used item, so it is evicted.
+	tc.Set("c", 3, time.Hour)
+	if tc.Has("a") {
+		t.Error("Has changed the recency of use of a")
+	}
+
+	clock.Advance(2 * time.Hour)
+	if tc.Has("b") {
+		t.Error("Has returned true for an expired item")
+	}
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("ItemCount is %d, want 2; Has deleted an expired item", n)
+	}
+}
+
+func TestStatsRemovals(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithMaxItems(3))
+	tc.Set("a", 1, time.Minute)
+	tc.Set("b", 2, time.Minute)
+	tc.Set("c", int64(3), NoExpiration)
+	clock.Advance(2 * time.Minute)
+	tc.DeleteExpired()
+	if s := tc.Stats(); s.Expirations != 2 || s.Evictions != 0 {
+		t.Errorf("Stats after DeleteExpired are %+v, want 2 expirations", s)
+	}
+
+	tc.Delete("c")
+	tc.Delete("missing")
+	if s := tc.Stats(); s.Expirations != 2 || s.Evictions != 1 {
+		t.Errorf("Stats after Delete are %+v, want 1 eviction", s)
+	}
+
+	tc.Set("c", int64(3), NoExpiration)
+	tc.DecrementAndDeleteAtZero("c", 3)
+	tc.Set("d", 4, NoExpiration)
+	tc.GetAndDelete("d")
+	tc.GetAndDelete("d")
+	if s := tc.Stats(); s.Evictions != 3 {
+		t.Errorf("Stats after DecrementAndDeleteAtZero and GetAndDelete are %+v, want 3 evictions", s)
+	}
+
+	tc.Set("e", 5, NoExpiration)
+	tc.Set("f", 6, NoExpiration)
+	tc.Set("g", 7, NoExpiration)
+	tc.Set("h", 8, NoExpiration)
+	if s := tc.Stats(); s.Evictions != 4 {
+		t.Errorf("Stats after exceeding MaxItems are %+v, want 4 evictions", s)
+	}
+
+	tc.FlushExcept(func(key string, item Item) bool {
+		return false
+	})
+	tc.Set("i", 9, NoExpiration)
+	tc.Set("j", 10, NoExpiration)
+	tc.Flush()
+	if s := tc.Stats(); s.Evictions != 9 || s.Expirations != 2 {
+		t.Errorf("Stats after FlushExcept and Flush are %+v, want 9 evictions and 2 expirations", s)
+	}
+}
+
+func TestWithLoader(t *testing.T) {
+	var calls int32
+	tc := NewWithOptions(WithLoader(func(key string) (interface{}, time.Duration, bool) {
+		atomic.AddInt32(&calls, 1)
+		if key == "missing" {
+			return nil, 0, false
+		}
+		return "loaded " + key, time.Minute, true
+	}))
+	tc.Set("cached", "value", DefaultExpiration)
+
+	x, found := tc.GetOrLoad("cached")
+	if !found || x.(string) != "value" {
+		t.Errorf("GetOrLoad(cached) is %v, %v; want value, true", x, found)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("loader was called %d times for a cached item", n)
+	}
+
+	x, found = tc.GetOrLoad("foo")
+	if !found || x.(string) != "loaded foo" {
+		t.Errorf("GetOrLoad(foo) is %v, %v; want loaded foo, true", x, found)
+	}
+	if ttl, _ := tc.TTL("foo"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL of the loaded item is %v, want at most 1m", ttl)
+	}
+	tc.GetOrLoad("foo")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("loader was called %d times, want 1", n)
+	}
+
+	x, found = tc.GetOrLoad("missing")
+	if found || x != nil {
+		t.Errorf("GetOrLoad(missing) is %v, %v; want nil, false", x, found)
+	}
+	if _, found = tc.Get("missing"); found {
+		t.Error("missing was stored although the loader failed")
+	}
+}
+
+func TestWithLoaderConcurrent(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	tc := NewWithOptions(WithLoader(func(key string) (interface{}, time.Duration, bool) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 42, DefaultExpiration, true
+	}))
+
+	wg := new(sync.WaitGroup)
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer wg.Done()
+			if x, found := tc.GetOrLoad("answer"); !found || x.(int) != 42 {
+				t.Errorf("GetOrLoad(answer) is %v, %v; want 42, true", x, found)
+			}
+		}()
+	}
+	<-time.After(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("loader was called %d times, want 1", n)
+	}
+}
+
+func TestWithLoaderCircuitBreaker(t *testing.T) {
+	clock := newFakeClock()
+	var calls int32
+	var failing int32 = 1
+	storeErr := errors.New("store unavailable")
+	tc := NewWithOptions(WithClock(clock), WithLoaderCircuitBreaker(3, time.Minute), WithLoaderErr(func(key string) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, 0, storeErr
+		}
+		return "loaded " + key, DefaultExpiration, nil
+	}))
+
+	for i := 0; i < 3; i++ {
+		if _, err := tc.GetOrLoadErr("k" + strconv.Itoa(i)); err != storeErr {
+			t.Errorf("load %d returned %v, want %v", i, err, storeErr)
+		}
+	}
+	if _, err := tc.GetOrLoadErr("foo"); err != ErrLoaderUnavailable {
+		t.Errorf("GetOrLoadErr returned %v with the breaker open, want %v", err, ErrLoaderUnavailable)
+	}
+	if x, found := tc.GetOrLoad("foo"); found {
+		t.Error("GetOrLoad returned a value with the breaker open:", x)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("loader was called %d times, want 3", n)
+	}
+
+	// The trial load after the cooldown fails, so the breaker opens again.
+	clock.Advance(time.Minute)
+	if _, err := tc.GetOrLoadErr("foo"); err != storeErr {
+		t.Errorf("trial load returned %v, want %v", err, storeErr)
+	}
+	if _, err := tc.GetOrLoadErr("foo"); err != ErrLoaderUnavailable {
+		t.Errorf("GetOrLoadErr returned %v after a failed trial, want %v", err, ErrLoaderUnavailable)
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("loader was called %d times, want 4", n)
+	}
+
+	// The trial load after the next cooldown succeeds, closing the breaker.
+	atomic.StoreInt32(&failing, 0)
+	clock.Advance(time.Minute)
+	if x, err := tc.GetOrLoadErr("foo"); err != nil || x != "loaded foo" {
+		t.Errorf("trial load returned (%v, %v), want (loaded foo, nil)", x, err)
+	}
+	if x, found := tc.GetOrLoad("bar"); !found || x != "loaded bar" {
+		t.Errorf("GetOrLoad(bar) is %v, %v; want loaded bar, true", x, found)
+	}
+	if n := atomic.LoadInt32(&calls); n != 6 {
+		t.Errorf("loader was called %d times, want 6", n)
+	}
+}
+
+func TestWithLoaderCircuitBreakerMisses(t *testing.T) {
+	var calls int32
+	tc := NewWithOptions(WithLoaderCircuitBreaker(3, time.Minute), WithLoader(func(key string) (interface{}, time.Duration, bool) {
+		atomic.AddInt32(&calls, 1)
+		if key == "exists" {
+			return "value", DefaultExpiration, true
+		}
+		return nil, 0, false
+	}))
+
+	for i := 0; i < 10; i++ {
+		if _, err := tc.GetOrLoadErr("missing" + strconv.Itoa(i)); err != ErrNotLoaded {
+			t.Errorf("load %d returned %v, want %v", i, err, ErrNotLoaded)
+		}
+	}
+	if x, err := tc.GetOrLoadErr("exists"); err != nil || x != "value" {
+		t.Errorf("GetOrLoadErr(exists) returned (%v, %v) after misses, want (value, nil)", x, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 11 {
+		t.Errorf("loader was called %d times, want 11", n)
+	}
+}
+
+func TestWithRefreshAhead(t *testing.T) {
+	clock := newFakeClock()
+	var calls int32
+	release := make(chan struct{})
+	tc := NewWithOptions(WithClock(clock), WithRefreshAhead(10*time.Second), WithLoader(func(key string) (interface{}, time.Duration, bool) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "fresh", time.Minute, true
+	}))
+	tc.Set("foo", "stale", time.Minute)
+
+	if x, _ := tc.Get("foo"); x.(string) != "stale" {
+		t.Error("foo is not stale:", x)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("loader was called %d times long before expiry, want 0", n)
+	}
+
+	clock.Advance(55 * time.Second)
+	for i := 0; i < 10; i++ {
+		if x, found := tc.Get("foo"); !found || x.(string) != "stale" {
+			t.Errorf("Get(foo) during the refresh is %v, %v; want stale, true", x, found)
+		}
+	}
+	close(release)
+	for i := 0; i < 100; i++ {
+		if x, _ := tc.Get("foo"); x.(string) == "fresh" {
+			break
+		}
+		<-time.After(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("loader was called %d times, want 1", n)
+	}
+	x, exp, _ := tc.GetWithExpiration("foo")
+	if x.(string) != "fresh" {
+		t.Error("foo was not refreshed:", x)
+	}
+	if want := clock.Now().Add(time.Minute); !exp.Equal(want) {
+		t.Errorf("foo expires at %v, want %v", exp, want)
+	}
+}
+
+func TestWithRefreshAheadPanic(t *testing.T) {
+	clock := newFakeClock()
+	done := make(chan struct{})
+	tc := NewWithOptions(WithClock(clock), WithRefreshAhead(10*time.Second), WithLoader(func(key string) (interface{}, time.Duration, bool) {
+		defer close(done)
+		panic("boom")
+	}))
+	tc.Set("foo", "stale", time.Minute)
+
+	clock.Advance(55 * time.Second)
+	tc.Get("foo")
+	<-done
+	for i := 0; i < 100; i++ {
+		tc.callsMu.Lock()
+		_, loading := tc.calls["foo"]
+		tc.callsMu.Unlock()
+		if !loading {
+			break
+		}
+		<-time.After(time.Millisecond)
+	}
+	if x, found := tc.Get("foo"); !found || x.(string) != "stale" {
+		t.Errorf("Get(foo) after the loader panicked is %v, %v; want stale, true", x, found)
+	}
+}
+
+func TestWithMaxConcurrentLoads(t *testing.T) {
+	var inFlight, maxInFlight, calls int32
+	tc := NewWithOptions(WithMaxConcurrentLoads(3), WithLoader(func(key string) (interface{}, time.Duration, bool) {
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		<-time.After(5 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		return key, DefaultExpiration, true
+	}))
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 20; i++ {
+		key := strconv.Itoa(i % 10)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if x, found := tc.GetOrLoad(key); !found || x.(string) != key {
+				t.Errorf("GetOrLoad(%s) is %v, %v", key, x, found)
+			}
+		}()
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&maxInFlight); max > 3 {
+		t.Errorf("%d loads ran concurrently, want at most 3", max)
+	} else if max < 2 {
+		t.Errorf("%d loads ran concurrently, want more than 1", max)
+	}
+	if n := atomic.LoadInt32(&calls); n != 10 {
+		t.Errorf("loader was called %d times, want 10", n)
+	}
+}
+
+func TestGetOrLoadWithoutLoader(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("foo", "bar", DefaultExpiration)
+	if x, found := tc.GetOrLoad("foo"); !found || x.(string) != "bar" {
+		t.Errorf("GetOrLoad(foo) is %v, %v; want bar, true", x, found)
+	}
+	if _, found := tc.GetOrLoad("missing"); found {
+		t.Error("GetOrLoad found a missing item without a loader")
+	}
+}
+
+func TestWithNegativeCacheTTL(t *testing.T) {
+	clock := newFakeClock()
+	var calls int32
+	var exists int32
+	tc := NewWithOptions(WithClock(clock), WithNegativeCacheTTL(time.Minute), WithLoader(func(key string) (interface{}, time.Duration, bool) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&exists) == 0 {
+			return nil, 0, false
+		}
+		return "found", DefaultExpiration, true
+	}))
+
+	for i := 0; i < 3; i++ {
+		if _, found := tc.GetOrLoad("foo"); found {
+			t.Fatal("GetOrLoad found foo although the loader didn't")
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("loader was called %d times within the negative cache TTL, want 1", n)
+	}
+	if _, found := tc.Get("foo"); found {
+		t.Error("Get found the negative cache entry")
+	}
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("ItemCount is %d with a negative cache entry, want 0", n)
+	}
+	if items := tc.Items(); len(items) != 0 {
+		t.Errorf("Items returned %v with a negative cache entry", items)
+	}
+
+	atomic.StoreInt32(&exists, 1)
+	clock.Advance(time.Minute + time.Nanosecond)
+	if x, found := tc.GetOrLoad("foo"); !found || x.(string) != "found" {
+		t.Errorf("GetOrLoad(foo) after the negative cache TTL is %v, %v; want found, true", x, found)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("loader was called %d times, want 2", n)
+	}
+}
+
+func TestNegativeCacheBounded(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithNegativeCacheTTL(time.Minute), WithLoader(func(key string) (interface{}, time.Duration, bool) {
+		return nil, 0, false
+	}))
+	for i := 0; i < 10000; i++ {
+		tc.GetOrLoad(strconv.Itoa(i))
+		clock.Advance(time.Second)
+	}
+	// At most the keys of the last minute (and as many expired ones) remain.
+	if n := len(tc.negatives); n > 2*61 {
+		t.Errorf("%d negative cache entries without a janitor, want at most %d", n, 2*61)
+	}
+}
+
+func TestNegativeCacheEntryCleared(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock), WithNegativeCacheTTL(time.Minute), WithLoader(func(key string) (interface{}, time.Duration, bool) {
+		return nil, 0, false
+	}))
+	tc.GetOrLoad("foo")
+	tc.GetOrLoad("bar")
+
+	tc.Set("foo", "set", DefaultExpiration)
+	tc.Delete("foo")
+	tc.mutex.RLock()
+	_, found := tc.negatives["foo"]
+	tc.mutex.RUnlock()
+	if found {
+		t.Error("negative cache entry wasn't removed when the key was set")
+	}
+
+	clock.Advance(2 * time.Minute)
+	tc.DeleteExpired()
+	tc.mutex.RLock()
+	n := len(tc.negatives)
+	tc.mutex.RUnlock()
+	if n != 0 {
+		t.Errorf("%d negative cache entries are left after they expired", n)
+	}
+}
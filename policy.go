@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// An EvictionPolicy chooses which item to evict when an item is added to a cache
+// that is full (see WithMaxItems and WithMaxBytes.) The cache reports the keys
+// of the items it stores, uses and removes to the policy, and asks it for a
+// victim until there is enough room.
+//
+// OnAccess may be called concurrently while the cache is only read-locked (e.g.
+// by Get), so a policy must be safe for concurrent use. A policy must not use
+// the cache, and must not be shared between caches.
+type EvictionPolicy interface {
+	// OnAccess is called when the item with the given key is used, e.g. by
+	// Get.
+	OnAccess(key string)
+	// OnAdd is called when an item is stored under the given key, whether or
+	// not an item already existed for it.
+	OnAdd(key string)
+	// OnRemove is called when the item with the given key is removed from
+	// the cache.
+	OnRemove(key string)
+	// Victim returns the key of the item that should be evicted next, or
+	// false if the policy has no preference, in which case a random item is
+	// evicted.
+	Victim() (key string, ok bool)
+}
+
+// NewLRUPolicy returns an EvictionPolicy that evicts the least recently used
+// item, as with WithLRUEviction. Getting or setting an item counts as using it.
+func NewLRUPolicy() EvictionPolicy {
+	return newLRUList(nil)
+}
+
+// NewFIFOPolicy returns an EvictionPolicy that evicts the item that was added
+// first. Overwriting an item doesn't change its position, and neither does
+// using it.
+func NewFIFOPolicy() EvictionPolicy {
+	return fifoPolicy{newLRUList(nil)}
+}
+
+// NewLFUPolicy returns an EvictionPolicy that evicts the least frequently used
+// item, or of those, the least recently used one. Getting or setting an item
+// counts as using it.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{
+		index: make(map[string]*lfuEntry),
+	}
+}
+
+// fifoPolicy keeps the keys in the order they were added, newest first.
+type fifoPolicy struct {
+	list *lruList
+}
+
+func (p fifoPolicy) OnAccess(key string) {}
+
+func (p fifoPolicy) OnAdd(key string) {
+	p.list.add(key)
+}
+
+func (p fifoPolicy) OnRemove(key string) {
+	p.list.remove(key)
+}
+
+func (p fifoPolicy) Victim() (string, bool) {
+	return p.list.back()
+}
+
+func (p fifoPolicy) reset() {
+	p.list.reset()
+}
+
+func (p fifoPolicy) compact() {
+	p.list.compact()
+}
+
+// lfuPolicy is a min-heap of keys ordered by how often, and then how recently,
+// they were used, indexed by a map so that they can be updated in O(log n).
+type lfuPolicy struct {
+	mu      sync.Mutex
+	entries []*lfuEntry
+	index   map[string]*lfuEntry
+	// incremented on every use, to order keys used as often by recency
+	clock uint64
+}
+
+type lfuEntry struct {
+	key      string
+	uses     uint64
+	lastUsed uint64
+	pos      int
+}
+
+func (p *lfuPolicy) OnAccess(key string) {
+	p.mu.Lock()
+	p.use(key)
+	p.mu.Unlock()
+}
+
+func (p *lfuPolicy) OnAdd(key string) {
+	p.mu.Lock()
+	p.use(key)
+	p.mu.Unlock()
+}
+
+func (p *lfuPolicy) OnRemove(key string) {
+	p.mu.Lock()
+	if e, ok := p.index[key]; ok {
+		heap.Remove(p, e.pos)
+		delete(p.index, key)
+	}
+	p.mu.Unlock()
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.entries) == 0 {
+		return "", false
+	}
+	return p.entries[0].key, true
+}
+
+// use counts a use of key, adding it if necessary. It must be called while
+// holding mu.
+func (p *lfuPolicy) use(key string) {
+	p.clock++
+	if e, ok := p.index[key]; ok {
+		e.uses++
+		e.lastUsed = p.clock
+		heap.Fix(p, e.pos)
+		return
+	}
+	e := &lfuEntry{key: key, uses: 1, lastUsed: p.clock}
+	p.index[key] = e
+	heap.Push(p, e)
+}
+
+func (p *lfuPolicy) reset() {
+	p.mu.Lock()
+	p.entries = nil
+	p.index = make(map[string]*lfuEntry)
+	p.mu.Unlock()
+}
+
+func (p *lfuPolicy) compact() {
+	p.mu.Lock()
+	index := make(map[string]*lfuEntry, len(p.index))
+	for k, e := range p.index {
+		index[k] = e
+	}
+	p.index = index
+	p.mu.Unlock()
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface.
+
+func (p *lfuPolicy) Len() int {
+	return len(p.entries)
+}
+
+func (p *lfuPolicy) Less(i, j int) bool {
+	a, b := p.entries[i], p.entries[j]
+	if a.uses != b.uses {
+		return a.uses < b.uses
+	}
+	return a.lastUsed < b.lastUsed
+}
+
+func (p *lfuPolicy) Swap(i, j int) {
+	p.entries[i], p.entries[j] = p.entries[j], p.entries[i]
+	p.entries[i].pos = i
+	p.entries[j].pos = j
+}
+
+func (p *lfuPolicy) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.pos = len(p.entries)
+	p.entries = append(p.entries, e)
+}
+
+func (p *lfuPolicy) Pop() interface{} {
+	n := len(p.entries)
+	e := p.entries[n-1]
+	p.entries[n-1] = nil
+	p.entries = p.entries[:n-1]
+	return e
+}
+
+// resetPolicy removes all keys in the cache from its eviction policy, if it has
+// one. It must be called while holding mutex, before the items are replaced.
+func (c *cache) resetPolicy() {
+	if c.policy == nil {
+		return
+	}
+	if p, ok := c.policy.(interface{ reset() }); ok {
+		p.reset()
+		return
+	}
+	for key := range c.items {
+		c.policy.OnRemove(key)
+	}
+}
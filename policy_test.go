@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"testing"
+)
+
+// evictions sets up a cache with room for three items using the given policy,
+// and returns it with a function that returns the keys evicted so far.
+func evictions(p EvictionPolicy) (*Cache, func() []string) {
+	tc := New(DefaultExpiration, 0, WithMaxItems(3), WithEvictionPolicy(p))
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	return tc, func() []string { return evicted }
+}
+
+func TestLRUPolicy(t *testing.T) {
+	tc, evicted := evictions(NewLRUPolicy())
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+	tc.Get("a")
+	tc.Set("d", 4, DefaultExpiration)
+	tc.Set("c", 30, DefaultExpiration)
+	tc.Set("e", 5, DefaultExpiration)
+
+	// b was used least recently, then a (c was overwritten after it.)
+	if e := evicted(); len(e) != 2 || e[0] != "b" || e[1] != "a" {
+		t.Errorf("evicted %v, want [b a]", e)
+	}
+}
+
+func TestLFUPolicy(t *testing.T) {
+	tc, evicted := evictions(NewLFUPolicy())
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+	tc.Get("a")
+	tc.Get("a")
+	tc.Get("b")
+	tc.Get("c")
+	tc.Get("c")
+	tc.Get("c")
+	// b has been used least often, so it is evicted for d, which is then
+	// used twice, as often as b was, but less often than a and c.
+	tc.Set("d", 4, DefaultExpiration)
+	tc.Get("d")
+	tc.Set("e", 5, DefaultExpiration)
+
+	if e := evicted(); len(e) != 2 || e[0] != "b" || e[1] != "d" {
+		t.Errorf("evicted %v, want [b d]", e)
+	}
+	for _, k := range []string{"a", "c", "e"} {
+		if _, found := tc.Get(k); !found {
+			t.Errorf("%s was not found", k)
+		}
+	}
+}
+
+func TestFIFOPolicy(t *testing.T) {
+	tc, evicted := evictions(NewFIFOPolicy())
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+	// Neither using nor overwriting an item changes its position.
+	tc.Get("a")
+	tc.Set("a", 10, DefaultExpiration)
+	tc.Set("d", 4, DefaultExpiration)
+	tc.Delete("b")
+	tc.Set("e", 5, DefaultExpiration)
+	tc.Set("f", 6, DefaultExpiration)
+
+	if e := evicted(); len(e) != 3 || e[0] != "a" || e[1] != "b" || e[2] != "c" {
+		t.Errorf("evicted %v, want [a b c]", e)
+	}
+}
+
+func TestLFUPolicyTie(t *testing.T) {
+	p := NewLFUPolicy()
+	p.OnAdd("a")
+	p.OnAdd("b")
+	p.OnAccess("b")
+	p.OnAccess("a")
+	if key, _ := p.Victim(); key != "b" {
+		t.Errorf("Victim is %s, want b, which was used as often as a, but less recently", key)
+	}
+	p.OnRemove("b")
+	if key, _ := p.Victim(); key != "a" {
+		t.Errorf("Victim is %s after b was removed, want a", key)
+	}
+}
+
+func TestPolicyFlush(t *testing.T) {
+	for name, p := range map[string]EvictionPolicy{"lru": NewLRUPolicy(), "lfu": NewLFUPolicy(), "fifo": NewFIFOPolicy()} {
+		tc := New(DefaultExpiration, 0, WithMaxItems(2), WithEvictionPolicy(p))
+		tc.Set("a", 1, DefaultExpiration)
+		tc.Set("b", 2, DefaultExpiration)
+		tc.Flush()
+		if key, ok := p.Victim(); ok {
+			t.Errorf("%s: Victim is %s after Flush", name, key)
+		}
+		tc.Set("c", 3, DefaultExpiration)
+		tc.Set("d", 4, DefaultExpiration)
+		tc.Set("e", 5, DefaultExpiration)
+		if n := tc.ItemCount(); n != 2 {
+			t.Errorf("%s: ItemCount is %d, want 2", name, n)
+		}
+		if _, found := tc.Get("e"); !found {
+			t.Errorf("%s: e was not found", name)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Package promcache exports the statistics of a cache as Prometheus metrics.
+// It is a separate package so that using go-cache doesn't require depending on
+// the Prometheus client library.
+package promcache
+
+import (
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector that exports the number of items in a
+// cache as a gauge, and its Stats as counters. Its values are read from the
+// cache whenever it is collected, so it should be registered once, e.g.:
+//
+//	prometheus.MustRegister(promcache.NewCollector(c, "myapp", nil))
+type Collector struct {
+	c           *cache.Cache
+	items       *prometheus.Desc
+	hits        *prometheus.Desc
+	misses      *prometheus.Desc
+	evictions   *prometheus.Desc
+	expirations *prometheus.Desc
+}
+
+// Returns a new Collector for c. The names of its metrics are prefixed with
+// the given namespace (if it isn't empty) and "cache", e.g. "myapp_cache_hits_total",
+// and they have the given constant labels, which can be used to tell several
+// caches apart.
+func NewCollector(c *cache.Cache, namespace string, labels prometheus.Labels) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", name), help, nil, labels)
+	}
+	return &Collector{
+		c:           c,
+		items:       desc("items", "Number of items in the cache, including expired items that haven't been deleted yet."),
+		hits:        desc("hits_total", "Number of lookups that found an item."),
+		misses:      desc("misses_total", "Number of lookups that didn't find an item, or found an expired one."),
+		evictions:   desc("evictions_total", "Number of items removed from the cache other than because they expired."),
+		expirations: desc("expirations_total", "Number of expired items deleted from the cache."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (col *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- col.items
+	ch <- col.hits
+	ch <- col.misses
+	ch <- col.evictions
+	ch <- col.expirations
+}
+
+// Collect implements prometheus.Collector.
+func (col *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := col.c.Stats()
+	ch <- prometheus.MustNewConstMetric(col.items, prometheus.GaugeValue, float64(col.c.ItemCount()))
+	ch <- prometheus.MustNewConstMetric(col.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(col.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(col.evictions, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(col.expirations, prometheus.CounterValue, float64(stats.Expirations))
+}
@@ -0,0 +1,50 @@
+package promcache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	c := cache.NewWithOptions(cache.WithMaxItems(2), cache.WithLRUEviction())
+	c.Set("a", 1, cache.DefaultExpiration)
+	c.Set("b", 2, cache.DefaultExpiration)
+	c.Set("c", 3, cache.DefaultExpiration) // evicts a
+	c.Get("c")
+	c.Set("expired", 4, time.Nanosecond) // evicts b
+	c.Get("missing")
+	c.Get("c")
+	<-time.After(time.Millisecond)
+	c.DeleteExpired()
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(NewCollector(c, "test", prometheus.Labels{"cache": "things"})); err != nil {
+		t.Fatal("Error registering collector:", err)
+	}
+
+	want := `
+# HELP test_cache_evictions_total Number of items removed from the cache other than because they expired.
+# TYPE test_cache_evictions_total counter
+test_cache_evictions_total{cache="things"} 2
+# HELP test_cache_expirations_total Number of expired items deleted from the cache.
+# TYPE test_cache_expirations_total counter
+test_cache_expirations_total{cache="things"} 1
+# HELP test_cache_hits_total Number of lookups that found an item.
+# TYPE test_cache_hits_total counter
+test_cache_hits_total{cache="things"} 2
+# HELP test_cache_items Number of items in the cache, including expired items that haven't been deleted yet.
+# TYPE test_cache_items gauge
+test_cache_items{cache="things"} 1
+# HELP test_cache_misses_total Number of lookups that didn't find an item, or found an expired one.
+# TYPE test_cache_misses_total counter
+test_cache_misses_total{cache="things"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"time"
+)
+
+// ReadOnly is the subset of the methods of a cache that don't modify its
+// items, for passing the cache to code that should only read it. See
+// ReadOnlyView.
+type ReadOnly interface {
+	Get(key string) (interface{}, bool)
+	GetWithExpiration(key string) (interface{}, time.Time, bool)
+	Items() map[string]Item
+	ItemCount() int
+	Keys() []string
+}
+
+// readOnlyView implements ReadOnly for a cache without exposing its other
+// methods.
+type readOnlyView struct {
+	c *cache
+}
+
+// Returns a view of the cache that only has the methods of ReadOnly. The view
+// shares the cache's items, so it reflects any changes made to the cache.
+func (c *cache) ReadOnlyView() ReadOnly {
+	return readOnlyView{c}
+}
+
+func (v readOnlyView) Get(key string) (interface{}, bool) {
+	return v.c.Get(key)
+}
+
+func (v readOnlyView) GetWithExpiration(key string) (interface{}, time.Time, bool) {
+	return v.c.GetWithExpiration(key)
+}
+
+func (v readOnlyView) Items() map[string]Item {
+	return v.c.Items()
+}
+
+func (v readOnlyView) ItemCount() int {
+	return v.c.ItemCount()
+}
+
+func (v readOnlyView) Keys() []string {
+	return v.c.Keys()
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyView(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	v := tc.ReadOnlyView()
+	if _, found := v.Get("a"); found {
+		t.Error("a was found before it was set")
+	}
+	tc.Set("a", 1, time.Hour)
+	x, found := v.Get("a")
+	if !found || x.(int) != 1 {
+		t.Errorf("a is %v, %v, want 1, true", x, found)
+	}
+	if _, exp, _ := v.GetWithExpiration("a"); exp.IsZero() {
+		t.Error("a has no expiration time")
+	}
+	tc.Set("b", 2, DefaultExpiration)
+	if n := v.ItemCount(); n != 2 {
+		t.Errorf("ItemCount is %d, want 2", n)
+	}
+	if n := len(v.Keys()); n != 2 {
+		t.Errorf("Keys returned %d keys, want 2", n)
+	}
+	tc.Delete("a")
+	if items := v.Items(); len(items) != 1 || items["b"].Object.(int) != 2 {
+		t.Errorf("Items returned %v, want only b", items)
+	}
+}
+
+func TestReadOnlyViewMethods(t *testing.T) {
+	v := New(DefaultExpiration, 0).ReadOnlyView()
+	if _, ok := v.(interface {
+		Set(string, interface{}, time.Duration)
+	}); ok {
+		t.Error("The view has a Set method")
+	}
+	want := reflect.TypeOf((*ReadOnly)(nil)).Elem().NumMethod()
+	if n := reflect.TypeOf(v).NumMethod(); n != want {
+		t.Errorf("The view has %d methods, want %d", n, want)
+	}
+}
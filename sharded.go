@@ -7,20 +7,21 @@ import (
 	insecurerand "math/rand"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// This is an experimental and unexported (for now) attempt at making a cache
-// with better algorithmic complexity than the standard one, namely by
-// preventing write locks of the entire cache when an item is added. As of the
-// time of writing, the overhead of selecting buckets results in cache
-// operations being about twice as slow as for the standard cache with small
-// total cache sizes, and faster for larger ones.
+// A ShardedCache spreads its items across a number of independent caches
+// ("shards") by hashing their keys, so that goroutines accessing different keys
+// rarely contend for the same lock. With few goroutines, the overhead of
+// selecting a shard makes its operations somewhat slower than those of a Cache,
+// but it scales better when many goroutines use it concurrently.
 //
-// See cache_test.go for a few benchmarks.
-
-type unexportedShardedCache struct {
+// See sharded_test.go for a few benchmarks.
+type ShardedCache struct {
 	*shardedCache
+	// If this is confusing, see the comment at the bottom of New()
 }
 
 type shardedCache struct {
@@ -28,42 +29,51 @@ type shardedCache struct {
 	m       uint32
 	cs      []*cache
 	janitor *shardedJanitor
+	// maximum number of shards cleaned concurrently by DeleteExpired
+	cleanupConcurrency int32
+	// hashes keys to select their shards, if set; otherwise fnv1a is used
+	hasher func(string) uint32
 }
 
-// djb2 with better shuffling. 5x faster than FNV with the hash.Hash overhead.
-func djb33(seed uint32, k string) uint32 {
-	var (
-		l = uint32(len(k))
-		d = 5381 + seed + l
-		i = uint32(0)
-	)
-	// Why is all this 5x faster than a for loop?
-	if l >= 4 {
-		for i < l-4 {
-			d = (d * 33) ^ uint32(k[i])
-			d = (d * 33) ^ uint32(k[i+1])
-			d = (d * 33) ^ uint32(k[i+2])
-			d = (d * 33) ^ uint32(k[i+3])
-			i += 4
-		}
+// A ShardedOption configures a sharded cache created with NewSharded.
+type ShardedOption func(*shardedCache)
+
+// WithShardHasher makes a sharded cache select the shard of an item by hashing
+// its key with hasher, rather than with FNV-1a, e.g. to store related items in
+// the same shard by only hashing a prefix of their keys. The shard is the hash
+// modulo the number of shards.
+func WithShardHasher(hasher func(key string) uint32) ShardedOption {
+	return func(sc *shardedCache) {
+		sc.hasher = hasher
 	}
-	switch l - i {
-	case 1:
-	case 2:
-		d = (d * 33) ^ uint32(k[i])
-	case 3:
-		d = (d * 33) ^ uint32(k[i])
-		d = (d * 33) ^ uint32(k[i+1])
-	case 4:
-		d = (d * 33) ^ uint32(k[i])
-		d = (d * 33) ^ uint32(k[i+1])
-		d = (d * 33) ^ uint32(k[i+2])
+}
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// fnv1a is the 32-bit FNV-1a hash of k, with the offset basis perturbed by
+// seed. Inlined to avoid the overhead of hash.Hash.
+func fnv1a(seed uint32, k string) uint32 {
+	h := uint32(fnvOffset32) ^ seed
+	for i := 0; i < len(k); i++ {
+		h ^= uint32(k[i])
+		h *= fnvPrime32
 	}
-	return d ^ (d >> 16)
+	return h
 }
 
 func (sc *shardedCache) bucket(k string) *cache {
-	return sc.cs[djb33(sc.seed, k)%sc.m]
+	return sc.cs[sc.shardIndex(k)]
+}
+
+// shardIndex returns the index of the shard that stores the item with key k.
+func (sc *shardedCache) shardIndex(k string) uint32 {
+	if sc.hasher != nil {
+		return sc.hasher(k) % sc.m
+	}
+	return fnv1a(sc.seed, k) % sc.m
 }
 
 func (sc *shardedCache) Set(k string, x interface{}, d time.Duration) {
@@ -94,14 +104,68 @@ func (sc *shardedCache) Decrement(k string, n int64) error {
 	return sc.bucket(k).Decrement(k, n)
 }
 
+// Returns the number of items in all shards. This may include items that have
+// expired, but have not yet been cleaned up.
+func (sc *shardedCache) ItemCount() int {
+	n := 0
+	for _, v := range sc.cs {
+		n += v.ItemCount()
+	}
+	return n
+}
+
 func (sc *shardedCache) Delete(k string) {
 	sc.bucket(k).Delete(k)
 }
 
+// Delete all expired items from all shards, cleaning up to the configured
+// number of shards concurrently (see SetCleanupConcurrency.)
 func (sc *shardedCache) DeleteExpired() {
-	for _, v := range sc.cs {
-		v.DeleteExpired()
+	sc.deleteExpired(sc.cs)
+}
+
+// deleteExpired deletes all expired items from the given shards, cleaning up to
+// the configured number of them concurrently. It is used both by DeleteExpired
+// and the janitor.
+func (sc *shardedCache) deleteExpired(cs []*cache) {
+	n := int(atomic.LoadInt32(&sc.cleanupConcurrency))
+	if n < 1 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if n > len(cs) {
+		n = len(cs)
 	}
+	if n <= 1 {
+		for _, v := range cs {
+			v.DeleteExpired()
+		}
+		return
+	}
+
+	shards := make(chan *cache)
+	wg := new(sync.WaitGroup)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for c := range shards {
+				c.DeleteExpired()
+			}
+		}()
+	}
+	for _, v := range cs {
+		shards <- v
+	}
+	close(shards)
+	wg.Wait()
+}
+
+// Set the maximum number of shards that DeleteExpired cleans concurrently. If n
+// is less than one, GOMAXPROCS is used, which is the default. The janitor only
+// sweeps one shard at a time, so it never cleans more than one concurrently,
+// whatever n is.
+func (sc *shardedCache) SetCleanupConcurrency(n int) {
+	atomic.StoreInt32(&sc.cleanupConcurrency, int32(n))
 }
 
 // Returns the items in the cache. This may include items that have expired,
@@ -126,28 +190,61 @@ func (sc *shardedCache) Flush() {
 type shardedJanitor struct {
 	Interval time.Duration
 	stop     chan bool
+	stopOnce sync.Once
+	// receives the times to sweep the next shard, if set, rather than a ticker
+	ticks <-chan time.Time
 }
 
+// Run sweeps one shard every Interval/len(sc.cs), in turn, so that each shard
+// is swept once per Interval, but at a different time than the others, rather
+// than pausing all of them at once.
 func (j *shardedJanitor) Run(sc *shardedCache) {
-	j.stop = make(chan bool)
-	tick := time.Tick(j.Interval)
+	ticks := j.ticks
+	if ticks == nil {
+		step := j.Interval / time.Duration(len(sc.cs))
+		if step <= 0 {
+			step = 1
+		}
+		ticker := time.NewTicker(step)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	i := 0
 	for {
 		select {
-		case <-tick:
-			sc.DeleteExpired()
+		case <-ticks:
+			sc.deleteExpired(sc.cs[i : i+1])
+			i = (i + 1) % len(sc.cs)
 		case <-j.stop:
 			return
 		}
 	}
 }
 
-func stopShardedJanitor(sc *unexportedShardedCache) {
-	sc.janitor.stop <- true
+// Stop stops the janitor. It is safe to call Stop more than once.
+func (j *shardedJanitor) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+	})
+}
+
+// Stop the janitor of the sharded cache, if it has one, instead of waiting for
+// the cache to be garbage collected. Expired items are then only deleted by
+// calling DeleteExpired. It is safe to call StopJanitor more than once.
+func (sc *shardedCache) StopJanitor() {
+	if sc.janitor != nil {
+		sc.janitor.Stop()
+	}
+}
+
+func stopShardedJanitor(sc *ShardedCache) {
+	sc.StopJanitor()
 }
 
 func runShardedJanitor(sc *shardedCache, ci time.Duration) {
 	j := &shardedJanitor{
 		Interval: ci,
+		stop:     make(chan bool),
 	}
 	sc.janitor = j
 	go j.Run(sc)
@@ -172,18 +269,29 @@ func newShardedCache(n int, de time.Duration) *shardedCache {
 		c := &cache{
 			expiration: de,
 			items:      map[string]Item{},
+			clock:      realClock{},
 		}
 		sc.cs[i] = c
 	}
 	return sc
 }
 
-func unexportedNewSharded(defaultExpiration, cleanupInterval time.Duration, shards int) *unexportedShardedCache {
+// Return a new sharded cache with the given number of shards, default
+// expiration duration and cleanup interval, which work as for New, and the
+// given ShardedOptions. A single janitor cleans up all shards, one at a time, at
+// evenly spaced times during each cleanup interval.
+func NewSharded(defaultExpiration, cleanupInterval time.Duration, shards int, opts ...ShardedOption) *ShardedCache {
+	if shards < 1 {
+		shards = 1
+	}
 	if defaultExpiration == 0 {
 		defaultExpiration = -1
 	}
 	sc := newShardedCache(shards, defaultExpiration)
-	SC := &unexportedShardedCache{sc}
+	for _, opt := range opts {
+		opt(sc)
+	}
+	SC := &ShardedCache{sc}
 	if cleanupInterval > 0 {
 		runShardedJanitor(sc, cleanupInterval)
 		runtime.SetFinalizer(SC, stopShardedJanitor)
@@ -2,7 +2,9 @@ package cache
 
 import (
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -27,10 +29,168 @@ var shardedKeys = []string{
 }
 
 func TestShardedCache(t *testing.T) {
-	tc := unexportedNewSharded(DefaultExpiration, 0, 13)
+	tc := NewSharded(DefaultExpiration, 0, 13)
 	for _, v := range shardedKeys {
 		tc.Set(v, "value", DefaultExpiration)
 	}
+	for _, v := range shardedKeys {
+		x, found := tc.Get(v)
+		if !found || x.(string) != "value" {
+			t.Errorf("%s is %v, want value", v, x)
+		}
+	}
+	if n := tc.ItemCount(); n != len(shardedKeys) {
+		t.Errorf("ItemCount is %d, want %d", n, len(shardedKeys))
+	}
+
+	if err := tc.Add("f", "other", DefaultExpiration); err == nil {
+		t.Error("Added f even though it exists")
+	}
+	if err := tc.Add("new", "other", DefaultExpiration); err != nil {
+		t.Error("Couldn't add new:", err)
+	}
+	if err := tc.Replace("missing", "other", DefaultExpiration); err == nil {
+		t.Error("Replaced missing even though it doesn't exist")
+	}
+	if err := tc.Replace("foo", "other", DefaultExpiration); err != nil {
+		t.Error("Couldn't replace foo:", err)
+	}
+	if x, _ := tc.Get("foo"); x.(string) != "other" {
+		t.Error("foo is not other:", x)
+	}
+
+	tc.Delete("foo")
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo was found after being deleted")
+	}
+	tc.Flush()
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("ItemCount is %d after Flush, want 0", n)
+	}
+}
+
+func TestWithShardHasher(t *testing.T) {
+	// Hash only the tenant prefix of a key, up to the colon.
+	hasher := func(key string) uint32 {
+		if i := strings.IndexByte(key, ':'); i >= 0 {
+			key = key[:i]
+		}
+		return fnv1a(0, key)
+	}
+	tc := NewSharded(DefaultExpiration, 0, 16, WithShardHasher(hasher))
+	shard := tc.shardIndex("tenant1:")
+	for i := 0; i < 100; i++ {
+		key := "tenant1:" + strconv.Itoa(i)
+		tc.Set(key, i, DefaultExpiration)
+		if n := tc.shardIndex(key); n != shard {
+			t.Errorf("%s is in shard %d, want %d", key, n, shard)
+		}
+	}
+	if n := tc.cs[shard].ItemCount(); n != 100 {
+		t.Errorf("shard %d has %d items, want 100", shard, n)
+	}
+	if x, found := tc.Get("tenant1:42"); !found || x.(int) != 42 {
+		t.Errorf("tenant1:42 is %v (found: %v)", x, found)
+	}
+}
+
+func TestShardedCacheJanitor(t *testing.T) {
+	tc := NewSharded(DefaultExpiration, time.Millisecond, 8)
+	for _, v := range shardedKeys {
+		tc.Set(v, "value", time.Millisecond)
+	}
+	tc.Set("live", "value", NoExpiration)
+	<-time.After(20 * time.Millisecond)
+	if n := tc.ItemCount(); n != 1 {
+		t.Errorf("ItemCount is %d after cleanup, want 1", n)
+	}
+}
+
+func TestShardedCacheStopJanitor(t *testing.T) {
+	tc := NewSharded(DefaultExpiration, time.Millisecond, 4)
+	stopped := make(chan struct{})
+	go func() {
+		tc.StopJanitor()
+		tc.StopJanitor()
+		stopShardedJanitor(tc)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stopping the janitor more than once didn't return")
+	}
+
+	tc.Set("a", 1, time.Millisecond)
+	<-time.After(20 * time.Millisecond)
+	if n := tc.ItemCount(); n != 1 {
+		t.Errorf("ItemCount is %d after the janitor was stopped, want 1", n)
+	}
+
+	NewSharded(DefaultExpiration, 0, 4).StopJanitor()
+}
+
+func TestShardedCacheJanitorStaggered(t *testing.T) {
+	tc := NewSharded(DefaultExpiration, 0, 4)
+	// The janitor cleans one shard at a time, whatever the cleanup concurrency.
+	tc.SetCleanupConcurrency(4)
+	swept := make(chan int, len(tc.cs))
+	for i, c := range tc.cs {
+		i := i
+		c.OnSweep(func(removed int, duration time.Duration) {
+			swept <- i
+		})
+	}
+	ticks := make(chan time.Time)
+	j := &shardedJanitor{stop: make(chan bool), ticks: ticks}
+	go j.Run(tc.shardedCache)
+	defer j.Stop()
+
+	for n := 0; n < 2*len(tc.cs); n++ {
+		ticks <- time.Now()
+		if i := <-swept; i != n%len(tc.cs) {
+			t.Fatalf("tick %d swept shard %d, want %d", n, i, n%len(tc.cs))
+		}
+		select {
+		case i := <-swept:
+			t.Fatalf("tick %d also swept shard %d", n, i)
+		default:
+		}
+	}
+}
+
+func TestShardedCacheDeleteExpiredConcurrency(t *testing.T) {
+	tc := NewSharded(DefaultExpiration, 0, 16)
+	tc.SetCleanupConcurrency(4)
+	var inFlight, maxInFlight int32
+	for i, c := range tc.cs {
+		c.OnEvicted(func(k string, v interface{}) {
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			<-time.After(5 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+		})
+		c.Set("expired"+strconv.Itoa(i), i, time.Millisecond)
+		c.Set("live"+strconv.Itoa(i), i, NoExpiration)
+	}
+	<-time.After(5 * time.Millisecond)
+	tc.DeleteExpired()
+
+	for i, c := range tc.cs {
+		if n := c.ItemCount(); n != 1 {
+			t.Errorf("shard %d has %d items after DeleteExpired, want 1", i, n)
+		}
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > 4 {
+		t.Errorf("%d shards were cleaned concurrently, want at most 4", max)
+	} else if max < 2 {
+		t.Errorf("%d shards were cleaned concurrently, want more than 1", max)
+	}
 }
 
 func BenchmarkShardedCacheGetExpiring(b *testing.B) {
@@ -43,7 +203,7 @@ func BenchmarkShardedCacheGetNotExpiring(b *testing.B) {
 
 func benchmarkShardedCacheGet(b *testing.B, exp time.Duration) {
 	b.StopTimer()
-	tc := unexportedNewSharded(exp, 0, 10)
+	tc := NewSharded(exp, 0, 10)
 	tc.Set("foobarba", "zquux", DefaultExpiration)
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
@@ -62,7 +222,7 @@ func BenchmarkShardedCacheGetManyConcurrentNotExpiring(b *testing.B) {
 func benchmarkShardedCacheGetManyConcurrent(b *testing.B, exp time.Duration) {
 	b.StopTimer()
 	n := 10000
-	tsc := unexportedNewSharded(exp, 0, 20)
+	tsc := NewSharded(exp, 0, 20)
 	keys := make([]string, n)
 	for i := 0; i < n; i++ {
 		k := "foo" + strconv.Itoa(i)
@@ -83,3 +243,35 @@ func benchmarkShardedCacheGetManyConcurrent(b *testing.B, exp time.Duration) {
 	b.StartTimer()
 	wg.Wait()
 }
+
+func BenchmarkCacheSetGetHighConcurrency(b *testing.B) {
+	tc := New(DefaultExpiration, 0)
+	benchmarkSetGetHighConcurrency(b, tc.Set, tc.Get)
+}
+
+func BenchmarkShardedCacheSetGetHighConcurrency(b *testing.B) {
+	tsc := NewSharded(DefaultExpiration, 0, 32)
+	benchmarkSetGetHighConcurrency(b, tsc.Set, tsc.Get)
+}
+
+func benchmarkSetGetHighConcurrency(b *testing.B, set func(string, interface{}, time.Duration), get func(string) (interface{}, bool)) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "foo" + strconv.Itoa(i)
+		set(keys[i], "bar", DefaultExpiration)
+	}
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := keys[i%len(keys)]
+			if i%4 == 0 {
+				set(k, "bar", DefaultExpiration)
+			} else {
+				get(k)
+			}
+			i++
+		}
+	})
+}
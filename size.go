@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"reflect"
+)
+
+// A Sizer returns the size of a value in bytes, or an estimate of it. See
+// WithSizer and WithMaxBytes.
+type Sizer func(value interface{}) int64
+
+// DefaultSizer estimates the size of a value using reflection: strings and byte
+// slices count their length, numbers and other fixed-size values their size in
+// memory, and slices, arrays, maps, structs and pointers the sizes of their
+// contents. Pointers, maps and slices that were already visited are counted only
+// once, so values that refer to themselves are counted correctly.
+func DefaultSizer(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	}
+	return sizeOf(reflect.ValueOf(value), map[visit]bool{})
+}
+
+// A visit is a pointer, map or slice visited by sizeOf or copyOf. The type (and
+// length, for slices) are needed as well as the address, as e.g. a slice and a
+// pointer to its first element, or two slices of different lengths, have the
+// same address.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// visited returns true if v was already visited, and marks it visited
+// otherwise.
+func visited(v reflect.Value, seen map[visit]bool) bool {
+	k := visit{ptr: v.Pointer(), typ: v.Type()}
+	if v.Kind() == reflect.Slice {
+		k.len = v.Len()
+	}
+	if seen[k] {
+		return true
+	}
+	seen[k] = true
+	return false
+}
+
+func sizeOf(v reflect.Value, seen map[visit]bool) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && (v.IsNil() || visited(v, seen)) {
+			return 0
+		}
+		if fixedSize(v.Type().Elem()) {
+			return int64(v.Len()) * int64(v.Type().Elem().Size())
+		}
+		var size int64
+		for i := 0; i < v.Len(); i++ {
+			size += sizeOf(v.Index(i), seen)
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() || visited(v, seen) {
+			return 0
+		}
+		var size int64
+		iter := v.MapRange()
+		for iter.Next() {
+			size += sizeOf(iter.Key(), seen) + sizeOf(iter.Value(), seen)
+		}
+		return size
+	case reflect.Struct:
+		if fixedSize(v.Type()) {
+			return int64(v.Type().Size())
+		}
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += sizeOf(v.Field(i), seen)
+		}
+		return size
+	case reflect.Ptr:
+		if v.IsNil() || visited(v, seen) {
+			return 0
+		}
+		return sizeOf(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return sizeOf(v.Elem(), seen)
+	case reflect.Invalid, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return 0
+	}
+	return int64(v.Type().Size())
+}
+
+// fixedSize returns true if values of type t don't refer to any other memory,
+// so their size is t.Size().
+func fixedSize(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	case reflect.Array:
+		return fixedSize(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !fixedSize(t.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Returns the total size of the items in the cache (including expired items
+// that haven't been deleted yet) according to its Sizer, or 0 if it has none.
+func (c *cache) SizeBytes() int64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.size
+}
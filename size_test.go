@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultSizer(t *testing.T) {
+	type point struct {
+		X, Y int32
+	}
+	type named struct {
+		Name string
+		Tags []string
+		P    *point
+	}
+	p := &point{1, 2}
+	cases := []struct {
+		value interface{}
+		want  int64
+	}{
+		{nil, 0},
+		{"hello", 5},
+		{[]byte("abc"), 3},
+		{int64(1), 8},
+		{int8(1), 1},
+		{[]int32{1, 2, 3}, 12},
+		{[2]uint16{}, 4},
+		{point{}, 8},
+		{map[string]int8{"ab": 1, "c": 2}, 5},
+		{named{"bob", []string{"x", "yz"}, p}, 3 + 3 + 8},
+		{[]*point{p, p}, 8},
+	}
+	for _, tc := range cases {
+		if got := DefaultSizer(tc.value); got != tc.want {
+			t.Errorf("DefaultSizer(%#v) is %d, want %d", tc.value, got, tc.want)
+		}
+	}
+
+	type node struct {
+		Next *node
+		V    int64
+	}
+	n := &node{V: 1}
+	n.Next = n
+	if got := DefaultSizer(n); got != 8 {
+		t.Errorf("DefaultSizer of a cycle is %d, want 8", got)
+	}
+
+	m := map[string]interface{}{"a": int64(1)}
+	m["self"] = m
+	if got := DefaultSizer(m); got != 1+8+4 {
+		t.Errorf("DefaultSizer of a map containing itself is %d, want 13", got)
+	}
+	s := []interface{}{int64(1), nil}
+	s[1] = s
+	if got := DefaultSizer(s); got != 8 {
+		t.Errorf("DefaultSizer of a slice containing itself is %d, want 8", got)
+	}
+}
+
+func TestWithMaxBytes(t *testing.T) {
+	tc := NewWithOptions(WithMaxBytes(100), WithLRUEviction())
+	tc.Set("a", strings.Repeat("a", 40), DefaultExpiration)
+	tc.Set("b", strings.Repeat("b", 40), DefaultExpiration)
+	if n := tc.SizeBytes(); n != 80 {
+		t.Errorf("SizeBytes is %d, want 80", n)
+	}
+
+	tc.Set("c", strings.Repeat("c", 20), DefaultExpiration)
+	if n := tc.ItemCount(); n != 3 {
+		t.Errorf("ItemCount is %d at the limit, want 3", n)
+	}
+	tc.Set("d", "d", DefaultExpiration)
+	if _, found := tc.Get("a"); found {
+		t.Error("a wasn't evicted when the limit was exceeded")
+	}
+	if n := tc.SizeBytes(); n != 61 {
+		t.Errorf("SizeBytes is %d after eviction, want 61", n)
+	}
+
+	// Replacing an item only needs room for the difference in size.
+	tc.Set("b", strings.Repeat("b", 79), DefaultExpiration)
+	if n := tc.ItemCount(); n != 3 {
+		t.Errorf("ItemCount is %d after growing b, want 3", n)
+	}
+	tc.Set("b", strings.Repeat("b", 90), DefaultExpiration)
+	if _, found := tc.Get("b"); !found {
+		t.Error("b was evicted to make room for itself")
+	}
+	if n, size := tc.ItemCount(), tc.SizeBytes(); n != 2 || size != 91 {
+		t.Errorf("ItemCount and SizeBytes are %d and %d after growing b, want 2 and 91", n, size)
+	}
+
+	tc.Delete("d")
+	if n := tc.SizeBytes(); n != 90 {
+		t.Errorf("SizeBytes is %d after Delete, want 90", n)
+	}
+	tc.Set("huge", strings.Repeat("h", 200), DefaultExpiration)
+	if n, size := tc.ItemCount(), tc.SizeBytes(); n != 1 || size != 200 {
+		t.Errorf("ItemCount and SizeBytes are %d and %d after adding a huge item, want 1 and 200", n, size)
+	}
+	tc.Flush()
+	if n := tc.SizeBytes(); n != 0 {
+		t.Errorf("SizeBytes is %d after Flush, want 0", n)
+	}
+}
+
+func TestWithSizer(t *testing.T) {
+	tc := NewWithOptions(WithSizer(func(value interface{}) int64 {
+		return 10
+	}), WithInitialItems(map[string]Item{
+		"a": {Object: 1},
+	}))
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("b", 3, DefaultExpiration)
+	tc.Rename("b", "c")
+	if n := tc.SizeBytes(); n != 20 {
+		t.Errorf("SizeBytes is %d, want 20", n)
+	}
+	if n := New(DefaultExpiration, 0).SizeBytes(); n != 0 {
+		t.Errorf("SizeBytes of a cache without a Sizer is %d, want 0", n)
+	}
+}
@@ -0,0 +1,63 @@
+package cache
+
+// A Snapshot records the versions of the items in a cache at one point in time,
+// so that the items that changed since then can be found with Diff.
+type Snapshot struct {
+	versions map[string]uint64
+}
+
+// stamp returns a new version for an item that is being changed. It must be
+// called while holding mutex.
+func (c *cache) stamp() uint64 {
+	c.version++
+	return c.version
+}
+
+// Returns a Snapshot of the unexpired items in the cache, to be passed to Diff
+// later. It only records the keys and versions of the items, not their values.
+func (c *cache) Snapshot() Snapshot {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	versions := make(map[string]uint64, len(c.items))
+	now := c.clock.Now().UnixNano()
+	for key, value := range c.items {
+		// "Inlining" of Expired
+		if value.Expiration > 0 && now > value.Expiration {
+			continue
+		}
+		versions[key] = value.version
+	}
+
+	return Snapshot{versions}
+}
+
+// Returns the changes to the cache since the Snapshot since was taken, e.g. to
+// send them to a replica: the unexpired items that were added or changed (by
+// Set, Increment etc.) since then, and the keys of the items in the snapshot
+// that have since been deleted or have expired. The order of the deleted keys
+// is not deterministic.
+func (c *cache) Diff(since Snapshot) (changed map[string]Item, deleted []string) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	changed = make(map[string]Item)
+	now := c.clock.Now().UnixNano()
+	for key, value := range c.items {
+		// "Inlining" of Expired
+		if value.Expiration > 0 && now > value.Expiration {
+			continue
+		}
+		if version, found := since.versions[key]; !found || version != value.version {
+			changed[key] = value
+		}
+	}
+	for key := range since.versions {
+		value, found := c.items[key]
+		if !found || (value.Expiration > 0 && now > value.Expiration) {
+			deleted = append(deleted, key)
+		}
+	}
+
+	return changed, deleted
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	clock := newFakeClock()
+	tc := NewWithOptions(WithClock(clock))
+	tc.Set("unchanged", 1, DefaultExpiration)
+	tc.Set("overwritten", 1, DefaultExpiration)
+	tc.Set("incremented", 1, DefaultExpiration)
+	tc.Set("deleted", 1, DefaultExpiration)
+	tc.Set("expiring", 1, time.Minute)
+	tc.Set("readded", 1, DefaultExpiration)
+	snap := tc.Snapshot()
+
+	if changed, deleted := tc.Diff(snap); len(changed) != 0 || len(deleted) != 0 {
+		t.Errorf("Diff without changes returned %v, %v", changed, deleted)
+	}
+
+	tc.Set("overwritten", 2, DefaultExpiration)
+	tc.Increment("incremented", 1)
+	tc.Delete("deleted")
+	tc.Set("added", 1, DefaultExpiration)
+	tc.Delete("readded")
+	tc.Set("readded", 1, DefaultExpiration)
+	clock.Advance(2 * time.Minute)
+
+	changed, deleted := tc.Diff(snap)
+	if len(changed) != 4 {
+		t.Errorf("Diff returned %d changed items, want 4: %v", len(changed), changed)
+	}
+	for key, want := range map[string]int{"overwritten": 2, "incremented": 2, "added": 1, "readded": 1} {
+		if item, found := changed[key]; !found || item.Object.(int) != want {
+			t.Errorf("changed item %s is %v (found: %v), want %d", key, item.Object, found, want)
+		}
+	}
+	sort.Strings(deleted)
+	if len(deleted) != 2 || deleted[0] != "deleted" || deleted[1] != "expiring" {
+		t.Errorf("Diff returned deleted keys %v, want [deleted expiring]", deleted)
+	}
+
+	if changed, deleted := tc.Diff(tc.Snapshot()); len(changed) != 0 || len(deleted) != 0 {
+		t.Errorf("Diff against a new snapshot returned %v, %v", changed, deleted)
+	}
+}
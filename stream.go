@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// maxStreamRecordSize is the maximum size of a record written by SaveStream,
+// so that LoadStream doesn't allocate a huge buffer for a corrupt length.
+const maxStreamRecordSize = 64 << 20
+
+// streamRecord is a single item written by SaveStream.
+type streamRecord struct {
+	Key  string
+	Item Item
+}
+
+// Write the cache's items to an io.Writer as a sequence of records, each of
+// which is an independent Gob encoding of a single item preceded by its length
+// as a 4-byte big-endian integer. Unlike Save, this never encodes the whole
+// cache as a single value, so that LoadStream can read a large dump one item at
+// a time. Returns an error if an item is larger than 64 MiB once encoded.
+func (c *cache) SaveStream(w io.Writer) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var buf bytes.Buffer
+	var prefix [4]byte
+	registered := make(map[reflect.Type]bool)
+	for key, value := range c.items {
+		if value.Object != nil {
+			t := reflect.TypeOf(value.Object)
+			if !registered[t] {
+				if err := gobRegister(value.Object); err != nil {
+					return fmt.Errorf("error registering type %s of item %s with Gob library: %v", t, key, err)
+				}
+				registered[t] = true
+			}
+		}
+		buf.Reset()
+		if err := gob.NewEncoder(&buf).Encode(&streamRecord{key, value}); err != nil {
+			return fmt.Errorf("error encoding item %s of type %T: %v", key, value.Object, err)
+		}
+		if buf.Len() > maxStreamRecordSize {
+			return fmt.Errorf("item %s is too large: %d bytes encoded", key, buf.Len())
+		}
+		binary.BigEndian.PutUint32(prefix[:], uint32(buf.Len()))
+		if _, err := w.Write(prefix[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add cache items written by SaveStream from an io.Reader, one at a time,
+// excluding any items with keys that already exist (and haven't expired) in the
+// current cache. If an error occurs, e.g. because the stream was truncated or a
+// record is larger than SaveStream allows, the items read before it remain in
+// the cache.
+func (c *cache) LoadStream(r io.Reader) error {
+	var prefix [4]byte
+	var buf []byte
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("error reading record %d: %v", n, err)
+		}
+		size := binary.BigEndian.Uint32(prefix[:])
+		if size > maxStreamRecordSize {
+			return fmt.Errorf("error reading record %d: size %d exceeds the maximum of %d bytes", n, size, maxStreamRecordSize)
+		}
+		if uint32(cap(buf)) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("error reading record %d: %v", n, err)
+		}
+		var rec streamRecord
+		if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&rec); err != nil {
+			return fmt.Errorf("error decoding record %d: %v", n, err)
+		}
+
+		c.mutex.Lock()
+		ov, found := c.items[rec.Key]
+		if !found || c.expired(ov) {
+			c.insert(rec.Key, rec.Item)
+		}
+		c.unlock()
+	}
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveStreamLoadStream(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < 1000; i++ {
+		tc.Set("int"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	tc.Set("*struct", &TestStruct{Num: 1}, time.Hour)
+	tc.Set("nil", nil, DefaultExpiration)
+
+	var buf bytes.Buffer
+	if err := tc.SaveStream(&buf); err != nil {
+		t.Fatal("Couldn't save cache:", err)
+	}
+
+	oc := New(DefaultExpiration, 0)
+	oc.Set("int0", "existing", DefaultExpiration)
+	if err := oc.LoadStream(&buf); err != nil {
+		t.Fatal("Couldn't load cache:", err)
+	}
+	if n := oc.ItemCount(); n != 1002 {
+		t.Errorf("ItemCount is %d, want 1002", n)
+	}
+	if x, _ := oc.Get("int0"); x != "existing" {
+		t.Errorf("int0 is %v, want existing", x)
+	}
+	if x, _ := oc.Get("int999"); x != 999 {
+		t.Errorf("int999 is %v, want 999", x)
+	}
+	x, exp, found := oc.GetWithExpiration("*struct")
+	if !found || x.(*TestStruct).Num != 1 {
+		t.Errorf("*struct is %v, want &{Num: 1}", x)
+	}
+	_, want, _ := tc.GetWithExpiration("*struct")
+	if !exp.Equal(want) {
+		t.Errorf("*struct expires at %v, want %v", exp, want)
+	}
+	if _, found := oc.Get("nil"); !found {
+		t.Error("nil was not found")
+	}
+}
+
+func TestLoadStreamTruncated(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	var buf bytes.Buffer
+	if err := tc.SaveStream(&buf); err != nil {
+		t.Fatal("Couldn't save cache:", err)
+	}
+	data := buf.Bytes()
+
+	for _, n := range []int{2, len(data) - 1} {
+		oc := New(DefaultExpiration, 0)
+		err := oc.LoadStream(bytes.NewReader(data[:n]))
+		if err == nil || !strings.Contains(err.Error(), "unexpected EOF") {
+			t.Errorf("LoadStream of %d bytes returned %v, want unexpected EOF", n, err)
+		}
+		if n == len(data)-1 && oc.ItemCount() != 1 {
+			t.Errorf("ItemCount is %d after a truncated second record, want 1", oc.ItemCount())
+		}
+	}
+
+	oc := New(DefaultExpiration, 0)
+	corrupt := append([]byte(nil), data...)
+	for i := 4; i < 12; i++ {
+		corrupt[i] = 0xff
+	}
+	if err := oc.LoadStream(bytes.NewReader(corrupt)); err == nil {
+		t.Error("No error loading a corrupt record")
+	}
+}
+
+func TestLoadStreamTooLarge(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 1, DefaultExpiration)
+	var buf bytes.Buffer
+	if err := tc.SaveStream(&buf); err != nil {
+		t.Fatal("Couldn't save cache:", err)
+	}
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+
+	oc := New(DefaultExpiration, 0)
+	err := oc.LoadStream(&buf)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Errorf("LoadStream returned %v for a bogus record size, want an error", err)
+	}
+	if oc.ItemCount() != 1 {
+		t.Errorf("ItemCount is %d after a bogus second record, want 1", oc.ItemCount())
+	}
+}
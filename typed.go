@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Get an item holding JSON-encoded bytes from the cache and decode it into a
+// value of type T. Returns the decoded value or the zero value of T, a bool
+// indicating whether the key was found, and an error if the item's value is not
+// a []byte or could not be decoded into a T.
+func GetJSONTyped[T any](c *Cache, key string) (T, bool, error) {
+	var v T
+	x, found := c.Get(key)
+	if !found {
+		return v, false, nil
+	}
+	b, ok := x.([]byte)
+	if !ok {
+		return v, true, fmt.Errorf("the value for %s is not a []byte", key)
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		var zero T
+		return zero, true, fmt.Errorf("error decoding the value for %s: %w", key, err)
+	}
+
+	return v, true, nil
+}
+
+// Get an item of type T from the cache. Returns the item or the zero value of
+// T, and a bool indicating whether the key was found and its value is a T.
+func GetAs[T any](c *Cache, key string) (T, bool) {
+	x, found := c.Get(key)
+	if !found {
+		var zero T
+		return zero, false
+	}
+	v, ok := x.(T)
+	if !ok && x == nil {
+		ok = isInterface[T]()
+	}
+
+	return v, ok
+}
+
+// isInterface returns true if T is an interface type, so that a nil value is a
+// T, although a type assertion of nil to T fails.
+func isInterface[T any]() bool {
+	return reflect.TypeOf((*T)(nil)).Elem().Kind() == reflect.Interface
+}
+
+// Returns a map of the keys of all unexpired items in the cache whose values
+// are of type T to their values. Items of other types are left out.
+func ItemsAs[T any](c *Cache) map[string]T {
+	m := make(map[string]T)
+	nilIsT := isInterface[T]()
+	c.ForEach(func(key string, value interface{}) bool {
+		if v, ok := value.(T); ok || (value == nil && nilIsT) {
+			m[key] = v
+		}
+		return true
+	})
+
+	return m
+}
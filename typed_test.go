@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"testing"
+)
+
+type jsonUser struct {
+	Name  string   `json:"name"`
+	Age   int      `json:"age"`
+	Roles []string `json:"roles"`
+}
+
+func TestGetJSONTyped(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("user", []byte(`{"name":"Ann","age":42,"roles":["admin","dev"]}`), DefaultExpiration)
+
+	u, found, err := GetJSONTyped[jsonUser](tc, "user")
+	if err != nil {
+		t.Fatal("Error decoding user:", err)
+	}
+	if !found {
+		t.Fatal("user was not found")
+	}
+	if u.Name != "Ann" || u.Age != 42 || len(u.Roles) != 2 || u.Roles[1] != "dev" {
+		t.Errorf("decoded user is %+v", u)
+	}
+
+	u, found, err = GetJSONTyped[jsonUser](tc, "missing")
+	if found || err != nil || u.Name != "" {
+		t.Errorf("GetJSONTyped of a missing key returned (%+v, %v, %v)", u, found, err)
+	}
+}
+
+func TestGetJSONTypedInvalid(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("corrupt", []byte(`{"name":"Ann",`), DefaultExpiration)
+	tc.Set("wrongtype", []byte(`{"name":42}`), DefaultExpiration)
+	tc.Set("string", `{"name":"Ann"}`, DefaultExpiration)
+
+	for _, key := range []string{"corrupt", "wrongtype", "string"} {
+		u, found, err := GetJSONTyped[jsonUser](tc, key)
+		if err == nil {
+			t.Errorf("GetJSONTyped of %s did not return an error", key)
+		}
+		if !found {
+			t.Errorf("%s was not found", key)
+		}
+		if u.Name != "" || u.Age != 0 {
+			t.Errorf("GetJSONTyped of %s did not return the zero value: %+v", key, u)
+		}
+	}
+}
+
+func TestGetAs(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("int", 1, DefaultExpiration)
+	tc.Set("user", &jsonUser{Name: "Ann"}, DefaultExpiration)
+
+	if n, ok := GetAs[int](tc, "int"); !ok || n != 1 {
+		t.Errorf("GetAs[int] returned (%v, %v), want (1, true)", n, ok)
+	}
+	if u, ok := GetAs[*jsonUser](tc, "user"); !ok || u.Name != "Ann" {
+		t.Errorf("GetAs[*jsonUser] returned (%v, %v)", u, ok)
+	}
+	if s, ok := GetAs[string](tc, "int"); ok || s != "" {
+		t.Errorf("GetAs[string] of an int returned (%q, %v), want (\"\", false)", s, ok)
+	}
+	if n, ok := GetAs[int](tc, "missing"); ok || n != 0 {
+		t.Errorf("GetAs[int] of a missing key returned (%v, %v), want (0, false)", n, ok)
+	}
+}
+
+func TestItemsAs(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if m := ItemsAs[int](tc); len(m) != 0 {
+		t.Errorf("ItemsAs of an empty cache returned %v", m)
+	}
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", "three", DefaultExpiration)
+	tc.Set("d", int64(4), DefaultExpiration)
+
+	m := ItemsAs[int](tc)
+	if len(m) != 2 || m["a"] != 1 || m["b"] != 2 {
+		t.Errorf("ItemsAs[int] returned %v, want map[a:1 b:2]", m)
+	}
+	if m := ItemsAs[float64](tc); len(m) != 0 {
+		t.Errorf("ItemsAs[float64] returned %v, want an empty map", m)
+	}
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"time"
+)
+
+// Add an item to the cache, replacing any existing item, holding only a weak
+// reference to its value, so that the garbage collector may reclaim the value
+// before the item expires if nothing else references it, e.g. for large
+// derived objects that are cheap enough to compute again under memory
+// pressure. Once the value has been collected, Get reports the item as missing
+// and deletes it, without calling the OnEvicted function. Duration rules are
+// the same as for Set.
+//
+// This is experimental: only Get (and Has, SetNX and other methods that check
+// whether an item exists) resolve the weak reference. Other methods that return
+// values, such as GetWithExpiration and Items, return nil for weak items, and
+// Save doesn't save their values. Only pointers can be referenced weakly; other
+// values are stored as with Set. Weak references need Go 1.24 or later; with
+// earlier versions, all values are stored as with Set.
+func (c *cache) SetWeak(key string, value interface{}, d time.Duration) {
+	c.mutex.Lock()
+	defer c.unlock()
+
+	c.set(key, value, d)
+	ref := newWeakRef(value)
+	if ref == nil {
+		return
+	}
+	item := c.items[key]
+	item.Object = nil
+	item.weak = ref
+	c.items[key] = item
+}
+
+// deleteIfCollected deletes the item with the given key if it was stored with
+// SetWeak and its value has been garbage collected.
+func (c *cache) deleteIfCollected(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	item, found := c.items[key]
+	if !found || item.weak == nil {
+		return
+	}
+	if _, ok := item.weak.value(); !ok {
+		c.publish(EventExpired, key, nil)
+		c.delete(key)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build go1.24
+
+package cache
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+type weakValue struct {
+	data [1 << 16]byte
+}
+
+func TestSetWeak(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	v := &weakValue{}
+	v.data[0] = 42
+	tc.SetWeak("foo", v, DefaultExpiration)
+
+	runtime.GC()
+	x, found := tc.Get("foo")
+	if !found {
+		t.Fatal("foo was not found while it is still referenced")
+	}
+	if p, ok := x.(*weakValue); !ok || p != v {
+		t.Errorf("foo is %T %p, want %p", x, x, v)
+	}
+	if !tc.Has("foo") {
+		t.Error("Has(foo) is false while it is still referenced")
+	}
+	runtime.KeepAlive(v)
+
+	runtime.GC()
+	runtime.GC()
+	if _, found := tc.Get("foo"); found {
+		t.Fatal("foo was found after its value was collected")
+	}
+	if tc.Has("foo") {
+		t.Error("Has(foo) is true after its value was collected")
+	}
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("ItemCount is %d after the collected item was found missing, want 0", n)
+	}
+}
+
+func TestSetWeakNonPointer(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetWeak("foo", "bar", time.Minute)
+	runtime.GC()
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Errorf("Get(foo) is %v, %v; want bar, true", x, found)
+	}
+}
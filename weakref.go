@@ -0,0 +1,38 @@
+//go:build go1.24
+
+package cache
+
+import (
+	"reflect"
+	"unsafe"
+	"weak"
+)
+
+// weakRef is a weak reference to the value of an item stored with SetWeak.
+type weakRef struct {
+	typ reflect.Type
+	ptr weak.Pointer[byte]
+}
+
+// newWeakRef returns a weak reference to v, or nil if v isn't a non-nil
+// pointer.
+func newWeakRef(v interface{}) *weakRef {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return nil
+	}
+	return &weakRef{
+		typ: rv.Type(),
+		ptr: weak.Make((*byte)(rv.UnsafePointer())),
+	}
+}
+
+// value returns the referenced value, and false if it has been garbage
+// collected.
+func (r *weakRef) value() (interface{}, bool) {
+	p := r.ptr.Value()
+	if p == nil {
+		return nil, false
+	}
+	return reflect.NewAt(r.typ.Elem(), unsafe.Pointer(p)).Interface(), true
+}
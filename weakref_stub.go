@@ -0,0 +1,18 @@
+//go:build !go1.24
+
+package cache
+
+// weakRef is a weak reference to the value of an item stored with SetWeak.
+// Weak references need Go 1.24, so with earlier versions, there are none, and
+// SetWeak stores values as Set does.
+type weakRef struct{}
+
+// newWeakRef returns nil, as weak references aren't supported.
+func newWeakRef(v interface{}) *weakRef {
+	return nil
+}
+
+// value is never called, as there are no weak references.
+func (r *weakRef) value() (interface{}, bool) {
+	return nil, false
+}